@@ -0,0 +1,358 @@
+package helpers
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+// Charsets the crawler can decode. ISO-8859-1 and US-ASCII are read as windows-1252, like browsers do.
+const (
+	CharsetUTF8        = "utf-8"
+	CharsetUTF16LE     = "utf-16le"
+	CharsetUTF16BE     = "utf-16be"
+	CharsetWindows1256 = "windows-1256"
+	CharsetISO88596    = "iso-8859-6"
+	CharsetWindows1252 = "windows-1252"
+)
+
+// metaPrescanBytes is how far into the document <meta charset> is looked for
+const metaPrescanBytes = 1024
+
+var charsetLabels = map[string]string{
+	"utf-8": CharsetUTF8, "utf8": CharsetUTF8, "unicode-1-1-utf-8": CharsetUTF8,
+	"utf-16": CharsetUTF16LE, "utf-16le": CharsetUTF16LE, "utf-16be": CharsetUTF16BE,
+	"windows-1256": CharsetWindows1256, "cp1256": CharsetWindows1256, "x-cp1256": CharsetWindows1256,
+	"iso-8859-6": CharsetISO88596, "iso_8859-6": CharsetISO88596, "iso8859-6": CharsetISO88596,
+	"iso-8859-6-i": CharsetISO88596, "iso-8859-6-e": CharsetISO88596, "arabic": CharsetISO88596,
+	"asmo-708": CharsetISO88596, "ecma-114": CharsetISO88596, "csisolatinarabic": CharsetISO88596,
+	"windows-1252": CharsetWindows1252, "cp1252": CharsetWindows1252, "iso-8859-1": CharsetWindows1252,
+	"iso_8859-1": CharsetWindows1252, "iso8859-1": CharsetWindows1252, "latin1": CharsetWindows1252,
+	"l1": CharsetWindows1252, "us-ascii": CharsetWindows1252, "ascii": CharsetWindows1252,
+}
+
+// windows1256 maps the bytes 0x80-0xFF of windows-1256
+var windows1256 = [128]rune{
+	0x20AC, 0x067E, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021,
+	0x02C6, 0x2030, 0x0679, 0x2039, 0x0152, 0x0686, 0x0698, 0x0688,
+	0x06AF, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+	0x06A9, 0x2122, 0x0691, 0x203A, 0x0153, 0x200C, 0x200D, 0x06BA,
+	0x00A0, 0x060C, 0x00A2, 0x00A3, 0x00A4, 0x00A5, 0x00A6, 0x00A7,
+	0x00A8, 0x00A9, 0x06BE, 0x00AB, 0x00AC, 0x00AD, 0x00AE, 0x00AF,
+	0x00B0, 0x00B1, 0x00B2, 0x00B3, 0x00B4, 0x00B5, 0x00B6, 0x00B7,
+	0x00B8, 0x00B9, 0x061B, 0x00BB, 0x00BC, 0x00BD, 0x00BE, 0x061F,
+	0x06C1, 0x0621, 0x0622, 0x0623, 0x0624, 0x0625, 0x0626, 0x0627,
+	0x0628, 0x0629, 0x062A, 0x062B, 0x062C, 0x062D, 0x062E, 0x062F,
+	0x0630, 0x0631, 0x0632, 0x0633, 0x0634, 0x0635, 0x0636, 0x00D7,
+	0x0637, 0x0638, 0x0639, 0x063A, 0x0640, 0x0641, 0x0642, 0x0643,
+	0x00E0, 0x0644, 0x00E2, 0x0645, 0x0646, 0x0647, 0x0648, 0x00E7,
+	0x00E8, 0x00E9, 0x00EA, 0x00EB, 0x0649, 0x064A, 0x00EE, 0x00EF,
+	0x064B, 0x064C, 0x064D, 0x064E, 0x00F4, 0x064F, 0x0650, 0x00F7,
+	0x0651, 0x00F9, 0x0652, 0x00FB, 0x00FC, 0x200E, 0x200F, 0x06D2,
+}
+
+// windows1252 maps the bytes 0x80-0xFF of windows-1252, unassigned bytes map to C1 controls
+var windows1252 = func() [128]rune {
+	table := [128]rune{
+		0x20AC, 0x0081, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021,
+		0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0x008D, 0x017D, 0x008F,
+		0x0090, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+		0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0x009D, 0x017E, 0x0178,
+	}
+	// The upper half is Latin-1
+	for b := 0xA0; b <= 0xFF; b++ {
+		table[b-0x80] = rune(b)
+	}
+	return table
+}()
+
+// iso88596 maps the bytes 0x80-0xFF of ISO-8859-6, unassigned bytes map to U+FFFD
+var iso88596 = func() [128]rune {
+	var table [128]rune
+	for b := 0x80; b <= 0xFF; b++ {
+		table[b-0x80] = utf8.RuneError
+	}
+	for b := 0x80; b <= 0xA0; b++ {
+		table[b-0x80] = rune(b)
+	}
+	table[0xA4-0x80] = 0x00A4
+	table[0xAC-0x80] = 0x060C
+	table[0xAD-0x80] = 0x00AD
+	table[0xBB-0x80] = 0x061B
+	table[0xBF-0x80] = 0x061F
+	for b := 0xC1; b <= 0xDA; b++ {
+		table[b-0x80] = rune(0x0621 + b - 0xC1)
+	}
+	for b := 0xE0; b <= 0xF2; b++ {
+		table[b-0x80] = rune(0x0640 + b - 0xE0)
+	}
+	return table
+}()
+
+var singleByteTables = map[string]*[128]rune{
+	CharsetWindows1256: &windows1256,
+	CharsetWindows1252: &windows1252,
+	CharsetISO88596:    &iso88596,
+}
+
+// NormalizeCharset maps a charset label to one of the supported charsets, "" if it isn't supported
+func NormalizeCharset(label string) string {
+	return charsetLabels[strings.ToLower(strings.Trim(strings.TrimSpace(label), `"'`))]
+}
+
+// DetectCharset works out the encoding of an HTML document like a browser would:
+// the BOM first, then the charset of the Content-Type header, then the XML declaration,
+// <meta charset> or http-equiv in the first 1024 bytes, and finally sniffing the bytes themselves.
+func DetectCharset(raw []byte, contentType string) string {
+	if charset, _ := bomCharset(raw); charset != "" {
+		return charset
+	}
+	if _, params, err := mime.ParseMediaType(contentType); err == nil {
+		if charset := NormalizeCharset(params["charset"]); charset != "" {
+			return charset
+		}
+	}
+	head := raw[:min(len(raw), metaPrescanBytes)]
+	if charset := xmlDeclarationCharset(head); charset != "" {
+		return charset
+	}
+	if charset := metaCharset(head); charset != "" {
+		return charset
+	}
+	return sniffCharset(raw)
+}
+
+var xmlDeclaration = regexp.MustCompile(`^\s*<\?xml[^>]*\sencoding\s*=\s*["']([^"']+)["']`)
+
+// xmlDeclarationCharset reads the encoding of an XHTML document's <?xml ... encoding="..."?>
+func xmlDeclarationCharset(head []byte) string {
+	if match := xmlDeclaration.FindSubmatch(head); match != nil {
+		return metaOverride(NormalizeCharset(string(match[1])))
+	}
+	return ""
+}
+
+func bomCharset(raw []byte) (string, int) {
+	switch {
+	case bytes.HasPrefix(raw, []byte{0xEF, 0xBB, 0xBF}):
+		return CharsetUTF8, 3
+	case bytes.HasPrefix(raw, []byte{0xFF, 0xFE}):
+		return CharsetUTF16LE, 2
+	case bytes.HasPrefix(raw, []byte{0xFE, 0xFF}):
+		return CharsetUTF16BE, 2
+	}
+	return "", 0
+}
+
+// metaCharset looks for <meta charset="..."> and <meta http-equiv="Content-Type" content="...; charset=...">
+func metaCharset(head []byte) string {
+	tokenizer := html.NewTokenizer(bytes.NewReader(head))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return ""
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			if token.Data != "meta" {
+				continue
+			}
+			var httpEquiv, content string
+			for _, attr := range token.Attr {
+				switch strings.ToLower(attr.Key) {
+				case "charset":
+					if charset := NormalizeCharset(attr.Val); charset != "" {
+						return metaOverride(charset)
+					}
+				case "http-equiv":
+					httpEquiv = strings.ToLower(strings.TrimSpace(attr.Val))
+				case "content":
+					content = attr.Val
+				}
+			}
+			if httpEquiv == "content-type" {
+				if _, params, err := mime.ParseMediaType(content); err == nil {
+					if charset := NormalizeCharset(params["charset"]); charset != "" {
+						return metaOverride(charset)
+					}
+				}
+			}
+		}
+	}
+}
+
+// metaOverride ignores a UTF-16 meta declaration, the document could not have been read that far if it were true
+func metaOverride(charset string) string {
+	if charset == CharsetUTF16LE || charset == CharsetUTF16BE {
+		return CharsetUTF8
+	}
+	return charset
+}
+
+// sniffCharset guesses the encoding of undeclared documents: valid UTF-8 is UTF-8, otherwise
+// the Arabic single-byte charset that decodes to the most Arabic script wins, windows-1252 if none does
+func sniffCharset(raw []byte) string {
+	if utf8.Valid(raw) {
+		return CharsetUTF8
+	}
+	best, bestScore := CharsetWindows1252, 0
+	for _, charset := range []string{CharsetWindows1256, CharsetISO88596} {
+		table := singleByteTables[charset]
+		score := 0
+		for _, b := range raw {
+			if b < 0x80 {
+				continue
+			}
+			if r := table[b-0x80]; r >= 0x0600 && r <= 0x06FF {
+				score++
+			} else if r == utf8.RuneError {
+				score--
+			}
+		}
+		if score > bestScore {
+			best, bestScore = charset, score
+		}
+	}
+	return best
+}
+
+// DecodeToUTF8 transcodes raw from charset to UTF-8, dropping any BOM.
+// Unsupported charsets and invalid sequences come out as U+FFFD.
+func DecodeToUTF8(raw []byte, charset string) []byte {
+	if bom, n := bomCharset(raw); bom == charset {
+		raw = raw[n:]
+	}
+	switch charset {
+	case CharsetUTF8:
+		return bytes.ToValidUTF8(raw, []byte(string(utf8.RuneError)))
+	case CharsetUTF16LE, CharsetUTF16BE:
+		units := make([]uint16, len(raw)/2)
+		for i := range units {
+			if charset == CharsetUTF16LE {
+				units[i] = uint16(raw[2*i]) | uint16(raw[2*i+1])<<8
+			} else {
+				units[i] = uint16(raw[2*i])<<8 | uint16(raw[2*i+1])
+			}
+		}
+		return []byte(string(utf16.Decode(units)))
+	}
+	table, ok := singleByteTables[charset]
+	if !ok {
+		return bytes.ToValidUTF8(raw, []byte(string(utf8.RuneError)))
+	}
+	out := make([]byte, 0, len(raw)*2)
+	for _, b := range raw {
+		if b < 0x80 {
+			out = append(out, b)
+		} else {
+			out = utf8.AppendRune(out, table[b-0x80])
+		}
+	}
+	return out
+}
+
+// ToUTF8 detects the charset of an HTML document and transcodes it, see DetectCharset
+func ToUTF8(raw []byte, contentType string) ([]byte, string) {
+	charset := DetectCharset(raw, contentType)
+	return DecodeToUTF8(raw, charset), charset
+}
+
+// ParseHTML transcodes an HTML document to UTF-8 and parses it, returning the detected charset
+func ParseHTML(r io.Reader, contentType string) (*html.Node, string, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, "", err
+	}
+	decoded, charset := ToUTF8(raw, contentType)
+	root, err := html.Parse(bytes.NewReader(decoded))
+	return root, charset, err
+}
+
+// mojibakeLeads are the characters the UTF-8 lead bytes of Arabic script (0xD8-0xDB)
+// turn into when UTF-8 is wrongly decoded as windows-1256 or windows-1252
+var mojibakeLeads = []struct {
+	charset string
+	leads   map[rune]bool
+}{
+	{CharsetWindows1256, map[rune]bool{'ط': true, 'ظ': true, 'ع': true, 'غ': true}},
+	{CharsetWindows1252, map[rune]bool{'Ø': true, 'Ù': true, 'Ú': true, 'Û': true}},
+}
+
+// encodeSingleByte encodes r in a single-byte charset, ok is false if the charset has no such character
+func encodeSingleByte(r rune, table *[128]rune) (byte, bool) {
+	if r < 0x80 {
+		return byte(r), true
+	}
+	if table == &windows1252 && r <= 0x9F {
+		// Mojibake from a plain Latin-1 decoder keeps 0x80-0x9F as C1 controls
+		return byte(r), true
+	}
+	for i, candidate := range table {
+		if candidate == r {
+			return byte(0x80 + i), true
+		}
+	}
+	return 0, false
+}
+
+// HasMojibake reports whether text looks like UTF-8 Persian or Arabic that was decoded
+// as windows-1256 or windows-1252, e.g. "ط³ظ„ط§ظ…" or "Ø³Ù„Ø§Ù…" instead of "سلام"
+func HasMojibake(text string) bool {
+	return mojibakeCharset(text) != ""
+}
+
+// mojibakeCharset returns the charset text was wrongly decoded with, "" if it looks fine.
+// Most non-ASCII characters must pair up as a lead character followed by a UTF-8 continuation byte.
+func mojibakeCharset(text string) string {
+	runes := []rune(text)
+	nonASCII := 0
+	for _, r := range runes {
+		if r >= 0x80 {
+			nonASCII++
+		}
+	}
+	for _, candidate := range mojibakeLeads {
+		table := singleByteTables[candidate.charset]
+		pairs := 0
+		for i := 0; i+1 < len(runes); i++ {
+			if !candidate.leads[runes[i]] {
+				continue
+			}
+			if b, ok := encodeSingleByte(runes[i+1], table); ok && b >= 0x80 && b <= 0xBF {
+				pairs++
+				i++
+			}
+		}
+		if pairs >= 3 && pairs*3 >= nonASCII {
+			return candidate.charset
+		}
+	}
+	return ""
+}
+
+// RepairMojibake undoes a wrong windows-1256 or windows-1252 decoding of UTF-8 text.
+// It returns the text unchanged and false when it isn't mojibake or can't be repaired.
+func RepairMojibake(text string) (string, bool) {
+	charset := mojibakeCharset(text)
+	if charset == "" {
+		return text, false
+	}
+	table := singleByteTables[charset]
+	raw := make([]byte, 0, len(text))
+	for _, r := range text {
+		b, ok := encodeSingleByte(r, table)
+		if !ok {
+			return text, false
+		}
+		raw = append(raw, b)
+	}
+	if !utf8.Valid(raw) {
+		return text, false
+	}
+	return string(raw), true
+}
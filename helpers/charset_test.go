@@ -0,0 +1,117 @@
+package helpers
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+// encodeTest encodes text in a single-byte charset for the tests
+func encodeTest(t *testing.T, text, charset string) []byte {
+	t.Helper()
+	var raw []byte
+	for _, r := range text {
+		b, ok := encodeSingleByte(r, singleByteTables[charset])
+		if !ok {
+			t.Fatalf("%q has no %s encoding", r, charset)
+		}
+		raw = append(raw, b)
+	}
+	return raw
+}
+
+func TestDetectCharset(t *testing.T) {
+	arabic := "مرحبا بالعالم، هذا نص عربي"
+	tests := []struct {
+		name        string
+		raw         []byte
+		contentType string
+		want        string
+	}{
+		{"UTF-8 BOM beats the header", append([]byte{0xEF, 0xBB, 0xBF}, "<p>x</p>"...), "text/html; charset=windows-1256", CharsetUTF8},
+		{"UTF-16 BOM", []byte{0xFF, 0xFE, '<', 0}, "", CharsetUTF16LE},
+		{"header", []byte("<p>x</p>"), "text/html; charset=Windows-1256", CharsetWindows1256},
+		{"quoted header label", []byte("<p>x</p>"), `text/html; charset="cp1256"`, CharsetWindows1256},
+		{"latin-1 is read as windows-1252", []byte("<p>x</p>"), "text/html; charset=ISO-8859-1", CharsetWindows1252},
+		{"unsupported header falls through", []byte(`<meta charset="iso-8859-6">`), "text/html; charset=koi8-r", CharsetISO88596},
+		{"meta charset", []byte(`<html><head><meta charset="windows-1256"></head>`), "text/html", CharsetWindows1256},
+		{"meta http-equiv", []byte(`<meta http-equiv="Content-Type" content="text/html; charset=arabic">`), "", CharsetISO88596},
+		{"meta UTF-16 means UTF-8", []byte(`<meta charset="utf-16">`), "", CharsetUTF8},
+		{"XML declaration", []byte(`<?xml version="1.0" encoding="windows-1256"?><html/>`), "", CharsetWindows1256},
+		{"undeclared UTF-8", []byte("<p>" + arabic + "</p>"), "", CharsetUTF8},
+		{"undeclared windows-1256", append([]byte("<p>"), encodeTest(t, arabic, CharsetWindows1256)...), "", CharsetWindows1256},
+		{"undeclared latin", []byte("<p>na\x96ve \x93quotes\x94</p>"), "", CharsetWindows1252},
+	}
+	for _, test := range tests {
+		if got := DetectCharset(test.raw, test.contentType); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDecodeToUTF8(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     []byte
+		charset string
+		want    string
+	}{
+		{"UTF-8 BOM dropped", []byte("\xEF\xBB\xBFhi"), CharsetUTF8, "hi"},
+		{"invalid UTF-8", []byte("a\xFFb"), CharsetUTF8, "a�b"},
+		{"UTF-16LE", []byte{0xFF, 0xFE, 0x33, 0x06, 'a', 0}, CharsetUTF16LE, "سa"},
+		{"UTF-16BE", []byte{0x06, 0x33, 0, 'a'}, CharsetUTF16BE, "سa"},
+		{"windows-1256", []byte{0xD3, 0xE1, 0xC7, 0xE3, 0x8D}, CharsetWindows1256, "سلامچ"},
+		{"windows-1252", []byte{0x80, 0xE9, 0x81}, CharsetWindows1252, "€é\u0081"},
+		{"ISO-8859-6 unassigned", []byte{0xC7, 0xA1}, CharsetISO88596, "ا�"},
+		{"unsupported", []byte("ok\xFF"), "koi8-r", "ok�"},
+	}
+	for _, test := range tests {
+		if got := string(DecodeToUTF8(test.raw, test.charset)); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRepairMojibake(t *testing.T) {
+	texts := []string{
+		"سلام دنیا، این یک متن فارسی است",
+		"مرحبا بالعالم (2024): نص عربي",
+	}
+	for _, text := range texts {
+		for _, charset := range []string{CharsetWindows1256, CharsetWindows1252} {
+			broken := string(DecodeToUTF8([]byte(text), charset))
+			if !HasMojibake(broken) {
+				t.Errorf("%q decoded as %s (%q) isn't detected", text, charset, broken)
+				continue
+			}
+			if got, ok := RepairMojibake(broken); !ok || got != text {
+				t.Errorf("%q decoded as %s was repaired to %q, %v", text, charset, got, ok)
+			}
+		}
+		if got, ok := RepairMojibake(text); ok || got != text {
+			t.Errorf("correct text %q was changed to %q", text, got)
+		}
+	}
+	for _, text := range []string{"Café Ølberg — “quoted” text", "", "plain ascii"} {
+		if HasMojibake(text) {
+			t.Errorf("%q is taken for mojibake", text)
+		}
+	}
+}
+
+func FuzzCharset(f *testing.F) {
+	f.Add([]byte(`<meta charset="windows-1256"><p>`+"\xD3\xE1\xC7\xE3"), "text/html")
+	f.Add([]byte{0xFE, 0xFF, 0x06}, "")
+	f.Add([]byte("Ø³Ù„Ø§Ù… Ø¯Ù†ÛŒØ§ Ø®ÙˆØ´"), "text/plain; charset=")
+	f.Fuzz(func(t *testing.T, raw []byte, contentType string) {
+		decoded, charset := ToUTF8(raw, contentType)
+		if NormalizeCharset(charset) != charset {
+			t.Errorf("detected unsupported charset %q", charset)
+		}
+		if !utf8.Valid(decoded) {
+			t.Errorf("decoding as %s gave invalid UTF-8 %q", charset, decoded)
+		}
+		if repaired, ok := RepairMojibake(string(decoded)); ok && !utf8.ValidString(repaired) {
+			t.Errorf("repair gave invalid UTF-8 %q", repaired)
+		}
+	})
+}
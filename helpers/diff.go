@@ -0,0 +1,165 @@
+package helpers
+
+import (
+	"strings"
+)
+
+// maxDiffEdits caps the edit distance DiffWords searches for, texts that differ more are
+// reported as their changed middle part deleted and inserted as a whole
+const maxDiffEdits = 2000
+
+// Diff operations of a DiffChunk
+const (
+	DiffEqual  = "equal"
+	DiffDelete = "delete"
+	DiffInsert = "insert"
+)
+
+// DiffChunk is a run of words that is the same in both texts, or only in the old or the new one
+type DiffChunk struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// DiffWords compares two texts word by word with Myers' algorithm
+func DiffWords(old, new string) []DiffChunk {
+	a, b := strings.Fields(old), strings.Fields(new)
+	// The common prefix and suffix need no search
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var chunks []DiffChunk
+	add := func(op string, words []string) {
+		if len(words) == 0 {
+			return
+		}
+		if last := len(chunks) - 1; last >= 0 && chunks[last].Op == op {
+			chunks[last].Text += " " + strings.Join(words, " ")
+			return
+		}
+		chunks = append(chunks, DiffChunk{Op: op, Text: strings.Join(words, " ")})
+	}
+	add(DiffEqual, a[:prefix])
+	for _, edit := range myersEdits(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]) {
+		add(edit.op, edit.words)
+	}
+	add(DiffEqual, a[len(a)-suffix:])
+	return chunks
+}
+
+type wordEdit struct {
+	op    string
+	words []string
+}
+
+// myersEdits returns the shortest edit script turning a into b, see
+// E. Myers, "An O(ND) Difference Algorithm and Its Variations", 1986
+func myersEdits(a, b []string) []wordEdit {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return []wordEdit{{DiffDelete, a}, {DiffInsert, b}}
+	}
+	limit := min(n+m, maxDiffEdits)
+	offset := limit + 1
+	v := make([]int32, 2*offset+1)
+	// trace keeps v for every edit count, to walk the path back
+	var trace [][]int32
+	found := -1
+	for d := 0; d <= limit && found < 0; d++ {
+		trace = append(trace, append([]int32(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = int(v[offset+k+1])
+			} else {
+				x = int(v[offset+k-1]) + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[offset+k] = int32(x)
+			if x >= n && y >= m {
+				found = d
+				break
+			}
+		}
+	}
+	if found < 0 {
+		return []wordEdit{{DiffDelete, a}, {DiffInsert, b}}
+	}
+
+	// Walk back from the end, trace[d][k+d] holds the furthest x on diagonal k after d-1 edits
+	var edits []wordEdit
+	x, y := n, m
+	for d := found; d > 0; d-- {
+		prev := trace[d]
+		k := x - y
+		insert := k == -d || (k != d && prev[k-1+d] < prev[k+1+d])
+		prevK := k - 1
+		if insert {
+			prevK = k + 1
+		}
+		prevX := int(prev[prevK+d])
+		prevY := prevX - prevK
+		// The edit is followed by a run of equal words up to (x, y)
+		snakeStart := prevX + 1
+		if insert {
+			snakeStart = prevX
+		}
+		if x > snakeStart {
+			edits = append(edits, wordEdit{DiffEqual, a[snakeStart:x]})
+		}
+		if insert {
+			edits = append(edits, wordEdit{DiffInsert, b[prevY : prevY+1]})
+		} else {
+			edits = append(edits, wordEdit{DiffDelete, a[prevX : prevX+1]})
+		}
+		x, y = prevX, prevY
+	}
+	if x > 0 {
+		edits = append(edits, wordEdit{DiffEqual, a[:x]})
+	}
+	// Reverse into reading order
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
+
+// FormatWordDiff renders chunks like git's word diff, [-deleted-]{+inserted+}. Equal runs
+// longer than twice the context are shortened to their first and last context words.
+func FormatWordDiff(chunks []DiffChunk, context int) string {
+	var b strings.Builder
+	for i, chunk := range chunks {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		switch chunk.Op {
+		case DiffDelete:
+			b.WriteString("[-" + chunk.Text + "-]")
+		case DiffInsert:
+			b.WriteString("{+" + chunk.Text + "+}")
+		default:
+			words := strings.Fields(chunk.Text)
+			head, tail := context, context
+			if i == 0 {
+				head = 0
+			}
+			if i == len(chunks)-1 {
+				tail = 0
+			}
+			if context >= 0 && len(words) > head+tail {
+				words = append(append(words[:head:head], "…"), words[len(words)-tail:]...)
+			}
+			b.WriteString(strings.Join(words, " "))
+		}
+	}
+	return b.String()
+}
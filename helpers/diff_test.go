@@ -0,0 +1,152 @@
+package helpers
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// checkDiff verifies that chunks rebuild both texts and that no two neighbouring chunks share an op
+func checkDiff(t *testing.T, old, new string, chunks []DiffChunk) {
+	t.Helper()
+	var gotOld, gotNew []string
+	for i, chunk := range chunks {
+		if i > 0 && chunks[i-1].Op == chunk.Op {
+			t.Errorf("chunks %d and %d are both %s: %+v", i-1, i, chunk.Op, chunks)
+		}
+		if chunk.Text == "" {
+			t.Errorf("chunk %d is empty: %+v", i, chunks)
+		}
+		words := strings.Fields(chunk.Text)
+		if chunk.Op != DiffInsert {
+			gotOld = append(gotOld, words...)
+		}
+		if chunk.Op != DiffDelete {
+			gotNew = append(gotNew, words...)
+		}
+	}
+	if got, want := strings.Join(gotOld, " "), strings.Join(strings.Fields(old), " "); got != want {
+		t.Errorf("old text rebuilt as %q, want %q", got, want)
+	}
+	if got, want := strings.Join(gotNew, " "), strings.Join(strings.Fields(new), " "); got != want {
+		t.Errorf("new text rebuilt as %q, want %q", got, want)
+	}
+}
+
+// editCount is the number of deleted and inserted words of chunks
+func editCount(chunks []DiffChunk) int {
+	count := 0
+	for _, chunk := range chunks {
+		if chunk.Op != DiffEqual {
+			count += len(strings.Fields(chunk.Text))
+		}
+	}
+	return count
+}
+
+// lcsEdits is the length of the shortest edit script, from the longest common subsequence
+func lcsEdits(a, b []string) int {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	return len(a) + len(b) - 2*lcs[0][0]
+}
+
+func TestDiffWords(t *testing.T) {
+	tests := []struct {
+		old, new string
+		want     string
+	}{
+		{"", "", ""},
+		{"same  text\nhere", "same text here", "equal:same text here"},
+		{"", "all new", "insert:all new"},
+		{"all gone", "", "delete:all gone"},
+		{"the quick fox", "the quick brown fox", "equal:the quick|insert:brown|equal:fox"},
+		{"the quick brown fox", "the fox", "equal:the|delete:quick brown|equal:fox"},
+		{"price 10 euro", "price 12 euro", "equal:price|delete:10|insert:12|equal:euro"},
+		{"a b c", "x y z", "delete:a b c|insert:x y z"},
+		{"a b c a b b a", "c b a b a c", ""},
+	}
+	for _, test := range tests {
+		chunks := DiffWords(test.old, test.new)
+		checkDiff(t, test.old, test.new, chunks)
+		if got, want := editCount(chunks), lcsEdits(strings.Fields(test.old), strings.Fields(test.new)); got != want {
+			t.Errorf("DiffWords(%q, %q) takes %d edits, the shortest takes %d", test.old, test.new, got, want)
+		}
+		if test.want == "" {
+			continue
+		}
+		var got []string
+		for _, chunk := range chunks {
+			got = append(got, chunk.Op+":"+chunk.Text)
+		}
+		if strings.Join(got, "|") != test.want {
+			t.Errorf("DiffWords(%q, %q) = %s, want %s", test.old, test.new, strings.Join(got, "|"), test.want)
+		}
+	}
+}
+
+func TestDiffWordsEditCap(t *testing.T) {
+	var a, b []string
+	for i := 0; i < maxDiffEdits; i++ {
+		a = append(a, fmt.Sprintf("old%d", i))
+		b = append(b, fmt.Sprintf("new%d", i))
+	}
+	old := "start " + strings.Join(a, " ") + " end"
+	new := "start " + strings.Join(b, " ") + " end"
+	chunks := DiffWords(old, new)
+	checkDiff(t, old, new, chunks)
+	if len(chunks) != 4 {
+		t.Errorf("texts past the edit cap gave %d chunks, want the changed middle deleted and inserted whole", len(chunks))
+	}
+}
+
+func TestFormatWordDiff(t *testing.T) {
+	old := "one two three four five six seven eight nine ten"
+	new := "one two three four five 6 seven eight nine ten"
+	chunks := DiffWords(old, new)
+	tests := []struct {
+		context int
+		want    string
+	}{
+		{-1, "one two three four five [-six-] {+6+} seven eight nine ten"},
+		{2, "… four five [-six-] {+6+} seven eight …"},
+		{0, "… [-six-] {+6+} …"},
+		{10, "one two three four five [-six-] {+6+} seven eight nine ten"},
+	}
+	for _, test := range tests {
+		if got := FormatWordDiff(chunks, test.context); got != test.want {
+			t.Errorf("context %d: got %q, want %q", test.context, got, test.want)
+		}
+	}
+	// Without a change there is no context to keep
+	if got := FormatWordDiff(DiffWords("a b  c", "a b c"), 1); got != "…" {
+		t.Errorf("an unchanged text gave %q, want it shortened away", got)
+	}
+}
+
+func FuzzDiffWords(f *testing.F) {
+	f.Add("the quick brown fox", "the slow brown dog")
+	f.Add("a b c a b b a", "c b a b a c")
+	f.Add("", "x")
+	f.Fuzz(func(t *testing.T, old, new string) {
+		chunks := DiffWords(old, new)
+		checkDiff(t, old, new, chunks)
+		a, b := strings.Fields(old), strings.Fields(new)
+		if len(a) <= 200 && len(b) <= 200 {
+			if got, want := editCount(chunks), lcsEdits(a, b); got != want {
+				t.Errorf("takes %d edits, the shortest takes %d", got, want)
+			}
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package helpers
+
+import (
+	"strings"
+)
+
+// PageDirectives are the indexing and link-following instructions of a page,
+// taken from <meta name="robots">, <link rel="canonical"> and the X-Robots-Tag header
+type PageDirectives struct {
+	NoIndex  bool
+	NoFollow bool
+	// Canonical is the href of <link rel="canonical">, empty when there is none
+	Canonical string
+}
+
+// Merge adds the restrictions of other, a canonical URL already set is kept
+func (d *PageDirectives) Merge(other PageDirectives) {
+	d.NoIndex = d.NoIndex || other.NoIndex
+	d.NoFollow = d.NoFollow || other.NoFollow
+	if d.Canonical == "" {
+		d.Canonical = other.Canonical
+	}
+}
+
+// valuedDirectives are the robots directives that carry a value after a colon,
+// anything else in front of a colon in X-Robots-Tag names a user agent
+var valuedDirectives = map[string]bool{
+	"unavailable_after": true, "max-snippet": true, "max-image-preview": true, "max-video-preview": true,
+}
+
+// ParseRobotsDirectives parses a robots directive list such as "noindex, nofollow" or "none"
+func ParseRobotsDirectives(content string) PageDirectives {
+	var d PageDirectives
+	for _, token := range strings.Split(content, ",") {
+		switch strings.ToLower(strings.TrimSpace(token)) {
+		case "noindex":
+			d.NoIndex = true
+		case "nofollow":
+			d.NoFollow = true
+		case "none":
+			d.NoIndex, d.NoFollow = true, true
+		}
+	}
+	return d
+}
+
+// ParseXRobotsTag parses the X-Robots-Tag header values. Values prefixed with a user agent,
+// e.g. "otherbot: noindex", only apply when the agent matches agentToken.
+func ParseXRobotsTag(values []string, agentToken string) PageDirectives {
+	var d PageDirectives
+	for _, value := range values {
+		if agent, rest, found := strings.Cut(value, ":"); found {
+			agent = strings.ToLower(strings.TrimSpace(agent))
+			if !strings.ContainsAny(agent, ", ") && !valuedDirectives[agent] {
+				if agent != agentToken {
+					continue
+				}
+				value = rest
+			}
+		}
+		d.Merge(ParseRobotsDirectives(value))
+	}
+	return d
+}
+
+// IsNoFollowLink reports whether an anchor's rel attribute asks crawlers not to follow it
+func IsNoFollowLink(rel string) bool {
+	for _, token := range strings.Fields(strings.ToLower(rel)) {
+		if token == "nofollow" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package helpers
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+	"sync"
+
+	"crawler/models"
+)
+
+// ExtractorVersion is recorded with every extracted document in the crawl catalog. Bump it
+// whenever an extractor's output changes, so documents extracted by an older version can be found.
+const ExtractorVersion = 1
+
+// Extractor turns a stored file into a Document. contentType is the header
+// the file was served with, it may carry parameters such as the charset.
+type Extractor func(file io.ReadSeeker, url, contentType string) (models.Document, error)
+
+var extractors = struct {
+	lock   sync.RWMutex
+	byType map[string]Extractor
+	// parsed lists the types still extracted by ExtractDocument, which ExtractParsed stands in for
+	parsed map[string]bool
+}{byType: map[string]Extractor{
+	"text/html":             ExtractDocument,
+	"application/xhtml+xml": ExtractDocument,
+	"text/plain":            ExtractPlainText,
+	"application/pdf":       ExtractPDF,
+}, parsed: map[string]bool{"text/html": true, "application/xhtml+xml": true}}
+
+// RegisterExtractor adds or replaces the extractor of a MIME type such as "application/pdf"
+func RegisterExtractor(mimeType string, extractor Extractor) {
+	extractors.lock.Lock()
+	defer extractors.lock.Unlock()
+	extractors.byType[strings.ToLower(mimeType)] = extractor
+	delete(extractors.parsed, strings.ToLower(mimeType))
+}
+
+// ExtractParsed extracts an HTML page that was already parsed, like the extractor of its
+// Content-Type would. ok is false when page is nil or another extractor was registered for
+// the type, which then has to be given the file.
+func ExtractParsed(page *HTMLPage, url, contentType string) (doc models.Document, ok bool) {
+	extractors.lock.RLock()
+	parsed := extractors.parsed[MediaType(contentType)]
+	extractors.lock.RUnlock()
+	if page == nil || !parsed {
+		return models.Document{}, false
+	}
+	return page.Document(url), true
+}
+
+// ExtractorFor returns the extractor registered for a Content-Type header value.
+// A panic in the extractor on a malformed file is returned as its error.
+func ExtractorFor(contentType string) (Extractor, bool) {
+	extractors.lock.RLock()
+	defer extractors.lock.RUnlock()
+	extractor, ok := extractors.byType[MediaType(contentType)]
+	if !ok {
+		return nil, false
+	}
+	return recoverExtractor(extractor), true
+}
+
+// recoverExtractor turns a panic of extractor into an extraction error, so one broken file can't stop a crawl
+func recoverExtractor(extractor Extractor) Extractor {
+	return func(file io.ReadSeeker, url, contentType string) (doc models.Document, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				doc, err = models.Document{}, fmt.Errorf("extracting %s: %v", url, r)
+			}
+		}()
+		return extractor(file, url, contentType)
+	}
+}
+
+// MediaType returns the lowercase MIME type of a Content-Type header value, without parameters
+func MediaType(contentType string) string {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		return mediaType
+	}
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(mediaType))
+}
+
+// IsHTML reports whether a Content-Type is parsed as HTML, i.e. has links to follow
+func IsHTML(contentType string) bool {
+	switch MediaType(contentType) {
+	case "text/html", "application/xhtml+xml":
+		return true
+	}
+	return false
+}
+
+// maxTitleRunes caps titles taken from the first line of a document without a real title
+const maxTitleRunes = 120
+
+// ExtractPlainText extracts a text/plain file, its first non-empty line is the title
+func ExtractPlainText(file io.ReadSeeker, url, contentType string) (models.Document, error) {
+	file.Seek(0, 0)
+	raw, err := io.ReadAll(file)
+	if err != nil {
+		return models.Document{}, err
+	}
+	decoded, charset := ToUTF8(raw, contentType)
+	text := string(decoded)
+
+	doc := models.Document{
+		URL:     url,
+		Title:   NormalizePersian(firstLine(text)),
+		Body:    NormalizePersian(text),
+		Charset: charset,
+	}
+	doc.Mojibake = HasMojibake(doc.Body)
+	return doc, nil
+}
+
+// firstLine returns the first non-empty line of text, cut to maxTitleRunes
+func firstLine(text string) string {
+	for line := range strings.Lines(text) {
+		if line = strings.TrimSpace(line); line != "" {
+			if runes := []rune(line); len(runes) > maxTitleRunes {
+				line = string(runes[:maxTitleRunes])
+			}
+			return line
+		}
+	}
+	return ""
+}
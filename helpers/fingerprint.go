@@ -0,0 +1,86 @@
+package helpers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/fnv"
+	"math/bits"
+	"strings"
+	"unicode"
+)
+
+// shingleSize is the number of consecutive words hashed together for the SimHash
+const shingleSize = 3
+
+// Fingerprint identifies the content of a page for duplicate detection
+type Fingerprint struct {
+	// Exact is the sha256 of the normalized words, equal for pages with the same text
+	Exact string
+	// SimHash is close in Hamming distance for pages with mostly the same text
+	SimHash uint64
+	// Words is the number of words the fingerprint was built from
+	Words int
+}
+
+// fingerprintWords splits Persian-normalized text into lower-case words. Punctuation is
+// dropped, diacritics and tatweel are removed and Persian and Arabic digits become ASCII,
+// so copies that only differ in typing conventions get the same words.
+func fingerprintWords(text string) []string {
+	var b strings.Builder
+	b.Grow(len(text))
+	for _, r := range NormalizePersian(text) {
+		switch {
+		case r >= '۰' && r <= '۹':
+			b.WriteRune('0' + r - '۰')
+		case r >= '٠' && r <= '٩':
+			b.WriteRune('0' + r - '٠')
+		case r == 'ـ' || unicode.Is(unicode.Mn, r):
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(unicode.ToLower(r))
+		default:
+			b.WriteRune(' ')
+		}
+	}
+	return strings.Fields(b.String())
+}
+
+// ContentFingerprint builds the exact hash and the SimHash of the word shingles of text
+func ContentFingerprint(text string) Fingerprint {
+	words := fingerprintWords(text)
+	exact := sha256.Sum256([]byte(strings.Join(words, " ")))
+	return Fingerprint{
+		Exact:   hex.EncodeToString(exact[:]),
+		SimHash: simHash(words),
+		Words:   len(words),
+	}
+}
+
+// simHash sums the bits of every shingle hash, a bit of the result is set where most shingles had it set
+func simHash(words []string) uint64 {
+	var weights [64]int
+	size := min(shingleSize, len(words))
+	for i := 0; i+size <= len(words) && size > 0; i++ {
+		hasher := fnv.New64a()
+		hasher.Write([]byte(strings.Join(words[i:i+size], " ")))
+		sum := hasher.Sum64()
+		for bit := range weights {
+			if sum&(1<<bit) != 0 {
+				weights[bit]++
+			} else {
+				weights[bit]--
+			}
+		}
+	}
+	var hash uint64
+	for bit, weight := range weights {
+		if weight > 0 {
+			hash |= 1 << bit
+		}
+	}
+	return hash
+}
+
+// HammingDistance is the number of bits two SimHashes differ in
+func HammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
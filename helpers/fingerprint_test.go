@@ -0,0 +1,60 @@
+package helpers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFingerprintWords(t *testing.T) {
+	got := strings.Join(fingerprintWords("Hello, World! قیمت: ۱۲۳ و ٤٥ تومانـــ، كتابُ"), " ")
+	want := strings.Join(fingerprintWords("hello world قیمت 123 و 45 تومان، کتاب"), " ")
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if !strings.HasPrefix(got, "hello world") || !strings.Contains(got, " 123 ") {
+		t.Errorf("got %q, want lower-case words with ASCII digits", got)
+	}
+}
+
+func TestContentFingerprint(t *testing.T) {
+	base := strings.Repeat("the crawler fetches pages and stores their extracted text for the search index ", 20) +
+		"this page was last updated on monday"
+	tests := []struct {
+		name        string
+		text        string
+		sameExact   bool
+		maxDistance int
+	}{
+		{"only punctuation and spacing differ", strings.ReplaceAll(base, " ", " ,  "), true, 0},
+		{"one word changed", strings.Replace(base, "monday", "tuesday", 1), false, 10},
+		{"a sentence added", base + " and a short note at the end", false, 10},
+	}
+	fingerprint := ContentFingerprint(base)
+	if fingerprint.Words != len(strings.Fields(base)) {
+		t.Errorf("got %d words, want %d", fingerprint.Words, len(strings.Fields(base)))
+	}
+	for _, test := range tests {
+		other := ContentFingerprint(test.text)
+		if (other.Exact == fingerprint.Exact) != test.sameExact {
+			t.Errorf("%s: exact hashes equal is %v, want %v", test.name, other.Exact == fingerprint.Exact, test.sameExact)
+		}
+		if distance := HammingDistance(fingerprint.SimHash, other.SimHash); distance > test.maxDistance {
+			t.Errorf("%s: SimHash distance %d, want at most %d", test.name, distance, test.maxDistance)
+		}
+	}
+
+	unrelated := ContentFingerprint(strings.Repeat("completely different words about cooking rice with saffron and butter ", 20))
+	if distance := HammingDistance(fingerprint.SimHash, unrelated.SimHash); distance < 16 {
+		t.Errorf("unrelated texts have a SimHash distance of only %d", distance)
+	}
+}
+
+func TestSimHashShortTexts(t *testing.T) {
+	if got := simHash(nil); got != 0 {
+		t.Errorf("no words gave %x", got)
+	}
+	// Texts shorter than a shingle are hashed as a whole
+	if simHash([]string{"a", "b"}) == 0 || simHash([]string{"a"}) == simHash([]string{"b"}) {
+		t.Error("short texts should get distinct non-zero hashes")
+	}
+}
@@ -1,9 +1,9 @@
 package helpers
 
 import (
-	"bytes"
 	"crawler/models"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
 	"os"
 	"regexp"
@@ -53,20 +53,88 @@ func extractText(n *html.Node) string {
 	return strings.TrimSpace(buf.String())
 }
 
-// extractDocument extracts document data (Title, Body, H1-H6, URL) from an HTML file
-func ExtractDocument(file *os.File, url string) (models.Document, error) {
-	file.Seek(0, 0)
+// boilerplateTags never hold the main content of a page
+var boilerplateTags = map[string]bool{
+	"script": true, "style": true, "noscript": true, "nav": true, "header": true,
+	"footer": true, "aside": true, "form": true, "iframe": true, "svg": true,
+}
+
+// boilerplateNames matches id/class values of ads, banners and similar rotating blocks
+var boilerplateNames = regexp.MustCompile(`(?i)(^|[-_\s])(ad|ads|advert|advertisement|banner|promo|sponsor|slider|carousel|popup|cookie)([-_\s]|$)`)
 
-	raw, err := io.ReadAll(file)
+// HTMLPage is a parsed HTML page, so a page is parsed once for everything read from it
+type HTMLPage struct {
+	Root *html.Node
+	// Charset is the charset the page was decoded from
+	Charset string
+}
+
+// ParseHTMLPage transcodes an HTML page to UTF-8 and parses it, see ParseHTML
+func ParseHTMLPage(r io.Reader, contentType string) (*HTMLPage, error) {
+	root, charset, err := ParseHTML(r, contentType)
 	if err != nil {
-		return models.Document{}, err
+		return nil, err
 	}
+	return &HTMLPage{Root: root, Charset: charset}, nil
+}
 
-	root, err := html.Parse(bytes.NewReader(raw))
+// ExtractMainText returns the text of a page without navigation, ads and banners,
+// so rotating boilerplate doesn't count as a content change
+func ExtractMainText(r io.Reader, contentType string) (string, error) {
+	page, err := ParseHTMLPage(r, contentType)
+	if err != nil {
+		return "", err
+	}
+	return page.MainText(), nil
+}
+
+// MainText is the text of the page without navigation, ads and banners, see ExtractMainText
+func (page *HTMLPage) MainText() string {
+	var buf strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			if boilerplateTags[n.Data] {
+				return
+			}
+			for _, attr := range n.Attr {
+				if (attr.Key == "id" || attr.Key == "class") && boilerplateNames.MatchString(attr.Val) {
+					return
+				}
+			}
+		}
+		if n.Type == html.TextNode {
+			buf.WriteString(n.Data)
+			buf.WriteRune(' ')
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(page.Root)
+	return NormalizePersian(buf.String())
+}
+
+// TextHash hashes extracted text, used for documents that have no boilerplate to strip
+func TextHash(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// ExtractDocument extracts document data (Title, Body, H1-H6, URL) from an HTML file.
+// The file is transcoded to UTF-8 first, contentType is the response header it was served with, if known.
+func ExtractDocument(file io.ReadSeeker, url, contentType string) (models.Document, error) {
+	file.Seek(0, 0)
+
+	page, err := ParseHTMLPage(file, contentType)
 	if err != nil {
 		return models.Document{}, err
 	}
+	return page.Document(url), nil
+}
 
+// Document extracts the document data of the page, see ExtractDocument
+func (page *HTMLPage) Document(url string) models.Document {
 	var (
 		title                  string
 		body                   strings.Builder
@@ -108,32 +176,49 @@ func ExtractDocument(file *os.File, url string) (models.Document, error) {
 		}
 	}
 
-	walk(root)
-
-	return models.Document{
-		URL:   url,
-		Title: NormalizePersian(title),
-		Body:  NormalizePersian(body.String()),
-		H1:    NormalizePersian(strings.Join(h1, " ")),
-		H2:    NormalizePersian(strings.Join(h2, " ")),
-		H3:    NormalizePersian(strings.Join(h3, " ")),
-		H4:    NormalizePersian(strings.Join(h4, " ")),
-		H5:    NormalizePersian(strings.Join(h5, " ")),
-		H6:    NormalizePersian(strings.Join(h6, " ")),
-	}, nil
+	walk(page.Root)
+
+	doc := models.Document{
+		URL:     url,
+		Title:   NormalizePersian(title),
+		Body:    NormalizePersian(body.String()),
+		H1:      NormalizePersian(strings.Join(h1, " ")),
+		H2:      NormalizePersian(strings.Join(h2, " ")),
+		H3:      NormalizePersian(strings.Join(h3, " ")),
+		H4:      NormalizePersian(strings.Join(h4, " ")),
+		H5:      NormalizePersian(strings.Join(h5, " ")),
+		H6:      NormalizePersian(strings.Join(h6, " ")),
+		Charset: page.Charset,
+	}
+	doc.Mojibake = HasMojibake(doc.Title) || HasMojibake(doc.Body)
+	return doc
 }
 
-// saveDocumentJSON saves the extracted document as a JSON file alongside the HTML file
-func SaveDocumentJSON(doc models.Document, htmlFilePath string) error {
-	// Create JSON filename by replacing .html with .json
-	jsonFilePath := strings.TrimSuffix(htmlFilePath, ".html") + ".json"
+// RepairDocument undoes mojibake in every text field of doc, see RepairMojibake.
+// It reports whether anything was repaired.
+func RepairDocument(doc *models.Document) bool {
+	repaired := false
+	for _, field := range []*string{&doc.Title, &doc.Body, &doc.H1, &doc.H2, &doc.H3, &doc.H4, &doc.H5, &doc.H6} {
+		if fixed, ok := RepairMojibake(*field); ok {
+			*field = NormalizePersian(fixed)
+			repaired = true
+		}
+	}
+	doc.Mojibake = HasMojibake(doc.Title) || HasMojibake(doc.Body)
+	return repaired
+}
 
-	// Marshal document to JSON with indentation for readability
-	data, err := json.MarshalIndent(doc, "", "  ")
-	if err != nil {
+// WriteFileAtomic writes data to a temporary file next to path and renames it into place,
+// so an interrupted write never leaves a half-written file behind
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		os.Remove(tmp)
 		return err
 	}
-
-	// Write to file
-	return os.WriteFile(jsonFilePath, data, 0644)
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,845 @@
+package helpers
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"crawler/models"
+)
+
+// The PDF support is deliberately small: it reads the objects of unencrypted files
+// (object streams included), inflates FlateDecode streams and pulls the text out of the
+// page content streams, using the fonts' ToUnicode CMaps where there are any.
+
+type (
+	pdfName    string
+	pdfString  string
+	pdfKeyword string
+	pdfDict    map[pdfName]any
+	pdfRef     struct{ num, gen int }
+)
+
+// pdfObject is an indirect object, stream is the raw (still encoded) stream data if it has one
+type pdfObject struct {
+	value  any
+	stream []byte
+}
+
+type pdfFile struct {
+	objects map[int]*pdfObject
+	// decoded caches inflated streams by object number
+	decoded map[int][]byte
+	cmaps   map[int]*pdfCMap
+	trailer pdfDict
+}
+
+const (
+	// pdfMaxNesting bounds page tree, form XObject and array/dictionary recursion in malformed files
+	pdfMaxNesting = 32
+	// pdfMaxStream caps an inflated stream so a zip bomb can't exhaust memory
+	pdfMaxStream = 64 << 20
+)
+
+var (
+	errPDFEncrypted = errors.New("encrypted PDF")
+	errPDFNesting   = errors.New("PDF objects nested too deeply")
+	pdfObjHeader    = regexp.MustCompile(`(\d+)\s+(\d+)\s+obj\b`)
+	pdfTrailerRef   = regexp.MustCompile(`/(Root|Info|Encrypt)\s+(\d+)\s+(\d+)\s+R`)
+)
+
+// ExtractPDF extracts the text of a PDF file, its title and its document information
+func ExtractPDF(file io.ReadSeeker, url, contentType string) (models.Document, error) {
+	file.Seek(0, 0)
+	raw, err := io.ReadAll(file)
+	if err != nil {
+		return models.Document{}, err
+	}
+	if !bytes.HasPrefix(bytes.TrimLeft(raw, " \r\n\t"), []byte("%PDF-")) {
+		return models.Document{}, errors.New("not a PDF file")
+	}
+	pdf := parsePDF(raw)
+	if _, encrypted := pdf.trailer["Encrypt"]; encrypted {
+		return models.Document{}, errPDFEncrypted
+	}
+
+	pages := pdf.pages()
+	var text strings.Builder
+	for _, page := range pages {
+		pdf.pageText(&text, page)
+		text.WriteString("\n")
+	}
+
+	metadata := map[string]string{"pages": strconv.Itoa(len(pages))}
+	var title string
+	if info, ok := pdf.resolve(pdf.trailer["Info"]).(pdfDict); ok {
+		title = pdfTextString(pdf.resolve(info["Title"]))
+		for key, name := range map[pdfName]string{
+			"Author": "author", "Subject": "subject", "Keywords": "keywords",
+			"Creator": "creator", "Producer": "producer",
+		} {
+			if value := strings.TrimSpace(pdfTextString(pdf.resolve(info[key]))); value != "" {
+				metadata[name] = value
+			}
+		}
+		for key, name := range map[pdfName]string{"CreationDate": "created", "ModDate": "modified"} {
+			if value := pdfDate(pdfTextString(pdf.resolve(info[key]))); value != "" {
+				metadata[name] = value
+			}
+		}
+	}
+	body := text.String()
+	if strings.TrimSpace(title) == "" {
+		title = firstLine(body)
+	}
+
+	doc := models.Document{
+		URL:      url,
+		Title:    NormalizePersian(title),
+		Body:     NormalizePersian(body),
+		Metadata: metadata,
+	}
+	doc.Mojibake = HasMojibake(doc.Body)
+	return doc, nil
+}
+
+// parsePDF collects every object of the file. Objects are found by scanning for "N G obj"
+// rather than through the xref table, which also copes with broken offsets; later definitions
+// (incremental updates) win.
+func parsePDF(raw []byte) *pdfFile {
+	pdf := &pdfFile{
+		objects: make(map[int]*pdfObject),
+		decoded: make(map[int][]byte),
+		cmaps:   make(map[int]*pdfCMap),
+		trailer: make(pdfDict),
+	}
+	for _, match := range pdfObjHeader.FindAllSubmatchIndex(raw, -1) {
+		if match[0] > 0 && !isPDFSpace(raw[match[0]-1]) && !isPDFDelimiter(raw[match[0]-1]) {
+			continue
+		}
+		num, _ := strconv.Atoi(string(raw[match[2]:match[3]]))
+		lex := &pdfLexer{data: raw, pos: match[1]}
+		value, err := lex.value(0)
+		if err != nil {
+			continue
+		}
+		object := &pdfObject{value: value}
+		if dict, ok := value.(pdfDict); ok {
+			if keyword, ok := lex.next().(pdfKeyword); ok && keyword == "stream" {
+				object.stream = streamData(raw, lex.pos, dict)
+			}
+		}
+		pdf.objects[num] = object
+	}
+
+	// Trailer references, from a classic trailer or an xref stream dictionary
+	for _, match := range pdfTrailerRef.FindAllSubmatch(raw, -1) {
+		num, _ := strconv.Atoi(string(match[2]))
+		gen, _ := strconv.Atoi(string(match[3]))
+		pdf.trailer[pdfName(match[1])] = pdfRef{num, gen}
+	}
+
+	// Objects packed into object streams
+	for num, object := range pdf.objects {
+		dict, ok := object.value.(pdfDict)
+		if !ok || dict["Type"] != pdfName("ObjStm") {
+			continue
+		}
+		data := pdf.streamOf(num)
+		first, ok1 := pdfOffset(dict["First"], len(data))
+		// Every entry of the header takes at least two bytes, which bounds a bogus /N
+		count, ok2 := pdfOffset(dict["N"], len(data))
+		if data == nil || !ok1 || !ok2 {
+			continue
+		}
+		header := &pdfLexer{data: data[:first]}
+		for range count {
+			objNum, ok1 := pdfOffset(header.next(), math.MaxInt32)
+			offset, ok2 := pdfOffset(header.next(), len(data)-first)
+			if !ok1 || !ok2 {
+				break
+			}
+			if _, defined := pdf.objects[objNum]; defined {
+				continue
+			}
+			lex := &pdfLexer{data: data, pos: first + offset}
+			if value, err := lex.value(0); err == nil {
+				pdf.objects[objNum] = &pdfObject{value: value}
+			}
+		}
+	}
+	return pdf
+}
+
+// pdfOffset converts a number read from the file to a length or offset in 0..limit. Numbers
+// from untrusted files may be negative, fractional beyond int range, NaN or infinite.
+func pdfOffset(value any, limit int) (int, bool) {
+	number, ok := value.(float64)
+	if !ok || math.IsNaN(number) || number < 0 || number > float64(limit) {
+		return 0, false
+	}
+	return int(number), true
+}
+
+// streamData returns the bytes between "stream" and "endstream"
+func streamData(raw []byte, pos int, dict pdfDict) []byte {
+	if pos < len(raw) && raw[pos] == '\r' {
+		pos++
+	}
+	if pos < len(raw) && raw[pos] == '\n' {
+		pos++
+	}
+	if length, ok := pdfOffset(dict["Length"], len(raw)-pos); ok {
+		end := pos + length
+		if bytes.HasPrefix(bytes.TrimLeft(raw[end:min(end+20, len(raw))], " \r\n\t"), []byte("endstream")) {
+			return raw[pos:end]
+		}
+	}
+	// Indirect or wrong /Length: look for the end marker instead
+	end := bytes.Index(raw[pos:], []byte("endstream"))
+	if end < 0 {
+		return nil
+	}
+	return bytes.TrimRight(raw[pos:pos+end], "\r\n")
+}
+
+// resolve follows indirect references
+func (pdf *pdfFile) resolve(value any) any {
+	for range pdfMaxNesting {
+		ref, ok := value.(pdfRef)
+		if !ok {
+			return value
+		}
+		object, ok := pdf.objects[ref.num]
+		if !ok {
+			return nil
+		}
+		value = object.value
+	}
+	return nil
+}
+
+// streamOf returns the decoded stream of an object, nil if it has none or uses an unsupported filter
+func (pdf *pdfFile) streamOf(num int) []byte {
+	if data, ok := pdf.decoded[num]; ok {
+		return data
+	}
+	object, ok := pdf.objects[num]
+	if !ok || object.stream == nil {
+		return nil
+	}
+	dict, _ := object.value.(pdfDict)
+	data := object.stream
+	filters := pdf.resolve(dict["Filter"])
+	if name, ok := filters.(pdfName); ok {
+		filters = []any{name}
+	}
+	list, _ := filters.([]any)
+	for _, filter := range list {
+		if filter != pdfName("FlateDecode") && filter != pdfName("Fl") {
+			data = nil
+			break
+		}
+		reader, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			data = nil
+			break
+		}
+		// Keep whatever inflated before a truncated or corrupt stream ended
+		data, _ = io.ReadAll(io.LimitReader(reader, pdfMaxStream))
+		reader.Close()
+	}
+	pdf.decoded[num] = data
+	return data
+}
+
+// pdfPage is a page dictionary with its inherited resources
+type pdfPage struct {
+	dict      pdfDict
+	resources pdfDict
+}
+
+// pages lists the pages in document order by walking the page tree
+func (pdf *pdfFile) pages() []pdfPage {
+	var pages []pdfPage
+	var walk func(node any, resources pdfDict, depth int)
+	walk = func(node any, resources pdfDict, depth int) {
+		dict, ok := pdf.resolve(node).(pdfDict)
+		if !ok || depth > pdfMaxNesting {
+			return
+		}
+		if own, ok := pdf.resolve(dict["Resources"]).(pdfDict); ok {
+			resources = own
+		}
+		if dict["Type"] == pdfName("Page") {
+			pages = append(pages, pdfPage{dict: dict, resources: resources})
+			return
+		}
+		kids, _ := pdf.resolve(dict["Kids"]).([]any)
+		for _, kid := range kids {
+			walk(kid, resources, depth+1)
+		}
+	}
+	if catalog, ok := pdf.resolve(pdf.trailer["Root"]).(pdfDict); ok {
+		walk(catalog["Pages"], nil, 0)
+	}
+	if len(pages) == 0 {
+		// No usable page tree: take the page objects in object number order
+		nums := make([]int, 0, len(pdf.objects))
+		for num := range pdf.objects {
+			nums = append(nums, num)
+		}
+		slices.Sort(nums)
+		for _, num := range nums {
+			if dict, ok := pdf.objects[num].value.(pdfDict); ok && dict["Type"] == pdfName("Page") {
+				resources, _ := pdf.resolve(dict["Resources"]).(pdfDict)
+				pages = append(pages, pdfPage{dict: dict, resources: resources})
+			}
+		}
+	}
+	return pages
+}
+
+// pageText appends the text of one page
+func (pdf *pdfFile) pageText(out *strings.Builder, page pdfPage) {
+	contents := pdf.resolveContents(page.dict["Contents"])
+	pdf.contentText(out, contents, page.resources, 0)
+}
+
+// resolveContents concatenates a content stream or an array of them
+func (pdf *pdfFile) resolveContents(value any) []byte {
+	switch v := value.(type) {
+	case pdfRef:
+		if array, ok := pdf.resolve(v).([]any); ok {
+			return pdf.resolveContents(array)
+		}
+		return pdf.streamOf(v.num)
+	case []any:
+		var data []byte
+		for _, part := range v {
+			if ref, ok := part.(pdfRef); ok {
+				data = append(data, pdf.streamOf(ref.num)...)
+				data = append(data, '\n')
+			}
+		}
+		return data
+	}
+	return nil
+}
+
+// contentText runs the text operators of a content stream
+func (pdf *pdfFile) contentText(out *strings.Builder, content []byte, resources pdfDict, depth int) {
+	if depth > pdfMaxNesting {
+		return
+	}
+	fonts, _ := pdf.resolve(resources["Font"]).(pdfDict)
+	xobjects, _ := pdf.resolve(resources["XObject"]).(pdfDict)
+	var font *pdfCMap
+	var fontRef pdfRef
+	var operands []any
+	space := func() {
+		if out.Len() > 0 && !strings.HasSuffix(out.String(), " ") && !strings.HasSuffix(out.String(), "\n") {
+			out.WriteByte(' ')
+		}
+	}
+	show := func(value any) {
+		if s, ok := value.(pdfString); ok {
+			out.WriteString(pdf.decodeText(string(s), font, fontRef))
+		}
+	}
+
+	lex := &pdfLexer{data: content}
+	for {
+		token, err := lex.operand()
+		if err != nil {
+			return
+		}
+		operator, ok := token.(pdfKeyword)
+		if !ok {
+			operands = append(operands, token)
+			continue
+		}
+		switch operator {
+		case "Tf":
+			if len(operands) >= 2 {
+				if name, ok := operands[len(operands)-2].(pdfName); ok {
+					fontRef, _ = fonts[name].(pdfRef)
+					font = pdf.cmapOf(fontRef)
+				}
+			}
+		case "Tj":
+			if len(operands) > 0 {
+				show(operands[len(operands)-1])
+			}
+		case "'", "\"":
+			out.WriteByte('\n')
+			if len(operands) > 0 {
+				show(operands[len(operands)-1])
+			}
+		case "TJ":
+			if len(operands) > 0 {
+				items, _ := operands[len(operands)-1].([]any)
+				for _, item := range items {
+					// A large negative adjustment is how many PDFs encode a word gap
+					if kerning, ok := item.(float64); ok && kerning < -180 {
+						space()
+					}
+					show(item)
+				}
+			}
+		case "Td", "TD":
+			if len(operands) >= 2 {
+				if ty, ok := operands[len(operands)-1].(float64); ok && ty != 0 {
+					out.WriteByte('\n')
+				} else {
+					space()
+				}
+			}
+		case "T*", "Tm", "ET":
+			space()
+		case "Do":
+			if len(operands) > 0 {
+				name, _ := operands[len(operands)-1].(pdfName)
+				ref, ok := xobjects[name].(pdfRef)
+				form, isDict := pdf.resolve(ref).(pdfDict)
+				if ok && isDict && form["Subtype"] == pdfName("Form") {
+					formResources, ok := pdf.resolve(form["Resources"]).(pdfDict)
+					if !ok {
+						formResources = resources
+					}
+					pdf.contentText(out, pdf.streamOf(ref.num), formResources, depth+1)
+				}
+			}
+		case "BI":
+			lex.skipInlineImage()
+		}
+		operands = operands[:0]
+	}
+}
+
+// decodeText turns a shown string into text: through the font's ToUnicode CMap when it has one,
+// otherwise as a simple font in WinAnsi-like encoding. Two-byte fonts without a CMap give nothing.
+func (pdf *pdfFile) decodeText(s string, cmap *pdfCMap, fontRef pdfRef) string {
+	if cmap != nil {
+		return cmap.decode([]byte(s))
+	}
+	if font, ok := pdf.resolve(fontRef).(pdfDict); ok && font["Subtype"] == pdfName("Type0") {
+		return ""
+	}
+	return string(DecodeToUTF8([]byte(s), CharsetWindows1252))
+}
+
+// pdfCMap maps character codes to Unicode text
+type pdfCMap struct {
+	codeLen int
+	chars   map[uint32]string
+}
+
+var (
+	pdfCMapChars  = regexp.MustCompile(`(?s)beginbfchar(.*?)endbfchar`)
+	pdfCMapRanges = regexp.MustCompile(`(?s)beginbfrange(.*?)endbfrange`)
+)
+
+// cmapOf parses the ToUnicode CMap of a font, nil if it has none
+func (pdf *pdfFile) cmapOf(fontRef pdfRef) *pdfCMap {
+	if cmap, ok := pdf.cmaps[fontRef.num]; ok {
+		return cmap
+	}
+	var cmap *pdfCMap
+	if font, ok := pdf.resolve(fontRef).(pdfDict); ok {
+		if ref, ok := font["ToUnicode"].(pdfRef); ok {
+			if data := pdf.streamOf(ref.num); data != nil {
+				cmap = parseCMap(data)
+			}
+		}
+	}
+	pdf.cmaps[fontRef.num] = cmap
+	return cmap
+}
+
+func parseCMap(data []byte) *pdfCMap {
+	cmap := &pdfCMap{codeLen: 1, chars: make(map[uint32]string)}
+	code := func(s pdfString) uint32 {
+		if len(s) > cmap.codeLen {
+			cmap.codeLen = min(len(s), 4)
+		}
+		var value uint32
+		for i := 0; i < len(s); i++ {
+			value = value<<8 | uint32(s[i])
+		}
+		return value
+	}
+	for _, block := range pdfCMapChars.FindAllSubmatch(data, -1) {
+		lex := &pdfLexer{data: block[1]}
+		for {
+			srcValue, err1 := lex.value(0)
+			dstValue, err2 := lex.value(0)
+			src, ok1 := srcValue.(pdfString)
+			dst, ok2 := dstValue.(pdfString)
+			if !ok1 || !ok2 || err1 != nil || err2 != nil {
+				break
+			}
+			cmap.chars[code(src)] = utf16BEString(string(dst))
+		}
+	}
+	for _, block := range pdfCMapRanges.FindAllSubmatch(data, -1) {
+		lex := &pdfLexer{data: block[1]}
+		for {
+			loValue, err1 := lex.value(0)
+			hiValue, err2 := lex.value(0)
+			dst, err3 := lex.value(0)
+			lo, ok1 := loValue.(pdfString)
+			hi, ok2 := hiValue.(pdfString)
+			if !ok1 || !ok2 || dst == nil || err1 != nil || err2 != nil || err3 != nil {
+				break
+			}
+			first, last := code(lo), code(hi)
+			if last < first || last-first > 0xFFFF {
+				continue
+			}
+			switch d := dst.(type) {
+			case pdfString:
+				// Consecutive codes map to consecutive values of the last byte
+				base := []rune(utf16BEString(string(d)))
+				if len(base) == 0 {
+					continue
+				}
+				for c := first; c <= last; c++ {
+					runes := append([]rune(nil), base...)
+					runes[len(runes)-1] += rune(c - first)
+					cmap.chars[c] = string(runes)
+				}
+			case []any:
+				for i, item := range d {
+					if s, ok := item.(pdfString); ok && first+uint32(i) <= last {
+						cmap.chars[first+uint32(i)] = utf16BEString(string(s))
+					}
+				}
+			}
+		}
+	}
+	return cmap
+}
+
+func (cmap *pdfCMap) decode(data []byte) string {
+	var out strings.Builder
+	for i := 0; i+cmap.codeLen <= len(data); i += cmap.codeLen {
+		var code uint32
+		for _, b := range data[i : i+cmap.codeLen] {
+			code = code<<8 | uint32(b)
+		}
+		out.WriteString(cmap.chars[code])
+	}
+	return out.String()
+}
+
+func utf16BEString(s string) string {
+	units := make([]uint16, len(s)/2)
+	for i := range units {
+		units[i] = uint16(s[2*i])<<8 | uint16(s[2*i+1])
+	}
+	return string(utf16.Decode(units))
+}
+
+// pdfTextString decodes a text string of the document information: UTF-16BE with a BOM,
+// UTF-8 with a BOM (PDF 2.0) or PDFDocEncoding, which is close enough to windows-1252
+func pdfTextString(value any) string {
+	s, ok := value.(pdfString)
+	if !ok {
+		return ""
+	}
+	switch {
+	case strings.HasPrefix(string(s), "\xFE\xFF"):
+		return utf16BEString(string(s[2:]))
+	case strings.HasPrefix(string(s), "\xEF\xBB\xBF"):
+		return string(s[3:])
+	}
+	return string(DecodeToUTF8([]byte(s), CharsetWindows1252))
+}
+
+// pdfDate turns "D:20240131120000+03'30'" into "2024-01-31T12:00:00", dropping the time zone
+func pdfDate(value string) string {
+	digits := strings.TrimPrefix(strings.TrimSpace(value), "D:")
+	end := 0
+	for end < len(digits) && end < 14 && digits[end] >= '0' && digits[end] <= '9' {
+		end++
+	}
+	if end < 4 {
+		return ""
+	}
+	// Missing parts default to January 1st, midnight
+	digits = digits[:end] + "0101000000"[end-4:]
+	return fmt.Sprintf("%s-%s-%sT%s:%s:%s", digits[0:4], digits[4:6], digits[6:8], digits[8:10], digits[10:12], digits[12:14])
+}
+
+// pdfLexer tokenizes PDF objects and content streams
+type pdfLexer struct {
+	data []byte
+	pos  int
+}
+
+func isPDFSpace(b byte) bool {
+	return b == ' ' || b == '\n' || b == '\r' || b == '\t' || b == '\f' || b == 0
+}
+
+func isPDFDelimiter(b byte) bool {
+	return strings.IndexByte("()<>[]{}/%", b) >= 0
+}
+
+// next returns the next token: float64, pdfName, pdfString or pdfKeyword (operators,
+// keywords and the delimiters "[", "]", "<<", ">>"), nil at the end of the data
+func (lex *pdfLexer) next() any {
+	for lex.pos < len(lex.data) {
+		b := lex.data[lex.pos]
+		if isPDFSpace(b) {
+			lex.pos++
+			continue
+		}
+		if b == '%' {
+			for lex.pos < len(lex.data) && lex.data[lex.pos] != '\n' && lex.data[lex.pos] != '\r' {
+				lex.pos++
+			}
+			continue
+		}
+		break
+	}
+	if lex.pos >= len(lex.data) {
+		return nil
+	}
+	data, start := lex.data, lex.pos
+	switch b := data[start]; {
+	case b == '(':
+		return lex.literalString()
+	case b == '<' && start+1 < len(data) && data[start+1] == '<':
+		lex.pos += 2
+		return pdfKeyword("<<")
+	case b == '>' && start+1 < len(data) && data[start+1] == '>':
+		lex.pos += 2
+		return pdfKeyword(">>")
+	case b == '<':
+		return lex.hexString()
+	case b == '[' || b == ']' || b == '{' || b == '}':
+		lex.pos++
+		return pdfKeyword(b)
+	case b == '/':
+		lex.pos++
+		var name strings.Builder
+		for lex.pos < len(data) && !isPDFSpace(data[lex.pos]) && !isPDFDelimiter(data[lex.pos]) {
+			if data[lex.pos] == '#' && lex.pos+2 < len(data) {
+				if value, err := strconv.ParseUint(string(data[lex.pos+1:lex.pos+3]), 16, 8); err == nil {
+					name.WriteByte(byte(value))
+					lex.pos += 3
+					continue
+				}
+			}
+			name.WriteByte(data[lex.pos])
+			lex.pos++
+		}
+		return pdfName(name.String())
+	}
+	for lex.pos < len(data) && !isPDFSpace(data[lex.pos]) && !isPDFDelimiter(data[lex.pos]) {
+		lex.pos++
+	}
+	if lex.pos == start {
+		// A stray delimiter such as ')' or '>'
+		lex.pos++
+	}
+	word := string(data[start:lex.pos])
+	if number, err := strconv.ParseFloat(word, 64); err == nil {
+		return number
+	}
+	return pdfKeyword(word)
+}
+
+func (lex *pdfLexer) literalString() pdfString {
+	data := lex.data
+	lex.pos++
+	var out []byte
+	for depth := 1; lex.pos < len(data); lex.pos++ {
+		b := data[lex.pos]
+		switch {
+		case b == '(':
+			depth++
+		case b == ')':
+			if depth--; depth == 0 {
+				lex.pos++
+				return pdfString(out)
+			}
+		case b == '\\' && lex.pos+1 < len(data):
+			lex.pos++
+			escaped := data[lex.pos]
+			switch escaped {
+			case 'n':
+				b = '\n'
+			case 'r':
+				b = '\r'
+			case 't':
+				b = '\t'
+			case 'b':
+				b = '\b'
+			case 'f':
+				b = '\f'
+			case '\r', '\n':
+				// Line continuation
+				if escaped == '\r' && lex.pos+1 < len(data) && data[lex.pos+1] == '\n' {
+					lex.pos++
+				}
+				continue
+			default:
+				if escaped >= '0' && escaped <= '7' {
+					value := 0
+					for i := 0; i < 3 && lex.pos < len(data) && data[lex.pos] >= '0' && data[lex.pos] <= '7'; i++ {
+						value = value*8 + int(data[lex.pos]-'0')
+						lex.pos++
+					}
+					lex.pos--
+					b = byte(value)
+				} else {
+					b = escaped
+				}
+			}
+		}
+		out = append(out, b)
+	}
+	return pdfString(out)
+}
+
+func (lex *pdfLexer) hexString() pdfString {
+	lex.pos++
+	var digits []byte
+	for ; lex.pos < len(lex.data) && lex.data[lex.pos] != '>'; lex.pos++ {
+		if b := lex.data[lex.pos]; !isPDFSpace(b) {
+			digits = append(digits, b)
+		}
+	}
+	lex.pos++
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	out := make([]byte, 0, len(digits)/2)
+	for i := 0; i+1 < len(digits); i += 2 {
+		value, err := strconv.ParseUint(string(digits[i:i+2]), 16, 8)
+		if err != nil {
+			break
+		}
+		out = append(out, byte(value))
+	}
+	return pdfString(out)
+}
+
+// value parses a complete object: arrays, dictionaries and "N G R" references included.
+// Unexpected keywords come back as pdfKeyword and null as nil; the end of the data is io.EOF,
+// which an unterminated array or dictionary takes as its end. depth is the number of
+// enclosing arrays and dictionaries; past pdfMaxNesting the object is rejected with errPDFNesting
+// rather than recursing until the stack runs out.
+func (lex *pdfLexer) value(depth int) (any, error) {
+	token := lex.next()
+	if token == nil {
+		return nil, io.EOF
+	}
+	switch t := token.(type) {
+	case pdfKeyword:
+		switch t {
+		case "[", "<<":
+			if depth >= pdfMaxNesting {
+				return nil, errPDFNesting
+			}
+		}
+		switch t {
+		case "[":
+			array := []any{}
+			for {
+				item, err := lex.value(depth + 1)
+				if err == io.EOF || item == pdfKeyword("]") {
+					return array, nil
+				}
+				if err != nil {
+					return nil, err
+				}
+				array = append(array, item)
+			}
+		case "<<":
+			dict := pdfDict{}
+			for {
+				key, err := lex.value(depth + 1)
+				if err == io.EOF {
+					return dict, nil
+				}
+				if err != nil {
+					return nil, err
+				}
+				name, ok := key.(pdfName)
+				if !ok {
+					return dict, nil
+				}
+				if dict[name], err = lex.value(depth + 1); err == io.EOF {
+					return dict, nil
+				} else if err != nil {
+					return nil, err
+				}
+			}
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+	case float64:
+		// Look ahead for "gen R"
+		saved := lex.pos
+		if gen, ok := lex.next().(float64); ok {
+			if keyword, ok := lex.next().(pdfKeyword); ok && keyword == "R" {
+				return pdfRef{int(t), int(gen)}, nil
+			}
+		}
+		lex.pos = saved
+	}
+	return token, nil
+}
+
+// operand parses the next content stream token, arrays and dictionaries as a whole.
+// Operators come back as pdfKeyword, the end of the stream as io.EOF. No references exist
+// in content streams.
+func (lex *pdfLexer) operand() (any, error) {
+	saved := lex.pos
+	token := lex.next()
+	if token == nil {
+		return nil, io.EOF
+	}
+	if keyword, ok := token.(pdfKeyword); ok && (keyword == "[" || keyword == "<<") {
+		lex.pos = saved
+		return lex.value(0)
+	}
+	return token, nil
+}
+
+// skipInlineImage moves past the binary data of an inline image, "BI ... ID <data> EI"
+func (lex *pdfLexer) skipInlineImage() {
+	id := bytes.Index(lex.data[lex.pos:], []byte("ID"))
+	if id < 0 {
+		lex.pos = len(lex.data)
+		return
+	}
+	lex.pos += id + 2
+	for {
+		ei := bytes.Index(lex.data[lex.pos:], []byte("EI"))
+		if ei < 0 {
+			lex.pos = len(lex.data)
+			return
+		}
+		at := lex.pos + ei
+		lex.pos = at + 2
+		if at > 0 && isPDFSpace(lex.data[at-1]) && (lex.pos >= len(lex.data) || isPDFSpace(lex.data[lex.pos])) {
+			return
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package helpers
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// pdfWithContent wraps a page content stream into a minimal single page PDF
+func pdfWithContent(content string) []byte {
+	return []byte("%PDF-1.4\n" +
+		"1 0 obj << /Type /Catalog /Pages 2 0 R >> endobj\n" +
+		"2 0 obj << /Type /Pages /Kids [3 0 R] /Count 1 >> endobj\n" +
+		"3 0 obj << /Type /Page /Parent 2 0 R /Contents 4 0 R >> endobj\n" +
+		"4 0 obj << /Length " + strconv.Itoa(len(content)) + " >>\nstream\n" + content + "\nendstream\nendobj\n" +
+		"trailer << /Root 1 0 R >>\n%%EOF\n")
+}
+
+func TestExtractPDFText(t *testing.T) {
+	tests := []struct {
+		name, content, want string
+	}{
+		{"Tj", "BT /F1 12 Tf (Hello World) Tj ET", "Hello World"},
+		{"TJ", "BT [(Hel) 10 (lo)] TJ ET", "Hello"},
+		{"TJ word gap", "BT [(Hello) -250 (World)] TJ ET", "Hello World"},
+		{"escapes", `BT (a\(b\)c\101) Tj ET`, "a(b)cA"},
+		{"hex string", "BT <48656C6C6F> Tj ET", "Hello"},
+		{"TJ with null", "BT [(Hello) null (World)] TJ ET", "HelloWorld"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			doc, err := ExtractPDF(bytes.NewReader(pdfWithContent(test.content)), "http://example.com/a.pdf", "application/pdf")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(doc.Body); got != test.want {
+				t.Errorf("body = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPDFLexerNesting(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{"flat array", "[1 2 3]", false},
+		{"nested within limit", strings.Repeat("[", pdfMaxNesting) + strings.Repeat("]", pdfMaxNesting), false},
+		{"arrays too deep", strings.Repeat("[", pdfMaxNesting+1), true},
+		{"dictionaries too deep", strings.Repeat("<< /A ", pdfMaxNesting+1), true},
+		{"hostile file", strings.Repeat("[", 5_000_000), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lex := &pdfLexer{data: []byte(test.data)}
+			if _, err := lex.value(0); (err != nil) != test.wantErr {
+				t.Errorf("err = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestExtractPDFDeepNesting(t *testing.T) {
+	raw := append([]byte("%PDF-1.4\n1 0 obj\n"), bytes.Repeat([]byte("["), 5_000_000)...)
+	if _, err := ExtractPDF(bytes.NewReader(raw), "http://example.com/a.pdf", "application/pdf"); err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Repeat("[", 5_000_000) + " TJ"
+	if _, err := ExtractPDF(bytes.NewReader(pdfWithContent(content)), "http://example.com/a.pdf", "application/pdf"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func FuzzExtractPDF(f *testing.F) {
+	f.Add(pdfWithContent("BT /F1 12 Tf [(Hello) -250 (World)] TJ ET"))
+	f.Add(pdfWithContent("BT <</A [1 2 <</B null>>]>> (x) Tj ET"))
+	f.Add([]byte("%PDF-1.7\n1 0 obj << /Type /ObjStm /N 1 /First 4 >> stream\n2 0 [(a)]\nendstream endobj"))
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		// Malformed files may fail to extract, but must not panic or hang
+		ExtractPDF(bytes.NewReader(raw), "http://example.com/a.pdf", "application/pdf")
+	})
+}
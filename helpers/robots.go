@@ -0,0 +1,188 @@
+package helpers
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RobotsRules holds the robots.txt group that applies to a single user agent.
+// A nil *RobotsRules allows everything.
+type RobotsRules struct {
+	rules      []robotsRule
+	CrawlDelay time.Duration
+	// Sitemaps lists the Sitemap: lines, which apply to every user agent
+	Sitemaps []string
+}
+
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+type robotsGroup struct {
+	agents     []string
+	rules      []robotsRule
+	crawlDelay time.Duration
+}
+
+// RobotsAgentToken returns the product token robots.txt groups are matched against,
+// e.g. "GolandCrawler" for "GolandCrawler/1.0 (+https://...)".
+func RobotsAgentToken(userAgent string) string {
+	token := strings.TrimSpace(userAgent)
+	if i := strings.IndexAny(token, "/ "); i >= 0 {
+		token = token[:i]
+	}
+	return strings.ToLower(token)
+}
+
+// ParseRobots parses a robots.txt body and keeps only the rules meant for userAgent.
+// The groups naming the product token of userAgent win, "*" is used as a fallback.
+func ParseRobots(r io.Reader, userAgent string) *RobotsRules {
+	var (
+		groups   []*robotsGroup
+		current  *robotsGroup
+		sitemaps []string
+		// Consecutive User-agent lines share the same group
+		inAgents bool
+	)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 512*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "user-agent":
+			if !inAgents || current == nil {
+				current = &robotsGroup{}
+				groups = append(groups, current)
+			}
+			current.agents = append(current.agents, RobotsAgentToken(value))
+			inAgents = true
+		case "allow", "disallow":
+			inAgents = false
+			if current == nil || value == "" {
+				// An empty Disallow means "allow everything", which is the default anyway
+				continue
+			}
+			current.rules = append(current.rules, robotsRule{allow: key == "allow", pattern: value})
+		case "crawl-delay":
+			inAgents = false
+			if current == nil {
+				continue
+			}
+			if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds >= 0 {
+				current.crawlDelay = time.Duration(seconds * float64(time.Second))
+			}
+		case "sitemap":
+			if value != "" {
+				sitemaps = append(sitemaps, value)
+			}
+		default:
+			inAgents = false
+		}
+	}
+
+	token := RobotsAgentToken(userAgent)
+	var (
+		matched   []*robotsGroup
+		bestScore = -1
+	)
+	for _, g := range groups {
+		for _, agent := range g.agents {
+			score := -1
+			// Product tokens match exactly, ignoring case, so a "googlebot-news" group is not ours
+			switch {
+			case agent == "*":
+				score = 0
+			case token != "" && agent == token:
+				score = 1
+			}
+			if score < 0 {
+				continue
+			}
+			if score > bestScore {
+				bestScore = score
+				matched = matched[:0]
+			}
+			if score == bestScore {
+				matched = append(matched, g)
+			}
+			break
+		}
+	}
+
+	rules := &RobotsRules{Sitemaps: sitemaps}
+	for _, g := range matched {
+		rules.rules = append(rules.rules, g.rules...)
+		if g.crawlDelay > rules.CrawlDelay {
+			rules.CrawlDelay = g.crawlDelay
+		}
+	}
+	return rules
+}
+
+// Allowed reports whether path (path plus optional query) may be fetched.
+// The longest matching rule wins; on a tie Allow beats Disallow.
+func (rr *RobotsRules) Allowed(path string) bool {
+	if rr == nil {
+		return true
+	}
+	if path == "" {
+		path = "/"
+	}
+	allowed := true
+	bestLen := -1
+	for _, rule := range rr.rules {
+		if !robotsMatch(rule.pattern, path) {
+			continue
+		}
+		if len(rule.pattern) > bestLen || (len(rule.pattern) == bestLen && rule.allow) {
+			bestLen = len(rule.pattern)
+			allowed = rule.allow
+		}
+	}
+	return allowed
+}
+
+// robotsMatch matches a robots.txt path pattern supporting '*' wildcards and a '$' end anchor
+func robotsMatch(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	if anchored {
+		pattern = pattern[:len(pattern)-1]
+	}
+	parts := strings.Split(pattern, "*")
+
+	// The first part must be a prefix of the path
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	rest := path[len(parts[0]):]
+	if len(parts) == 1 {
+		return !anchored || rest == ""
+	}
+	for i, part := range parts[1:] {
+		last := i == len(parts)-2
+		if last && anchored {
+			return strings.HasSuffix(rest, part)
+		}
+		idx := strings.Index(rest, part)
+		if idx < 0 {
+			return false
+		}
+		rest = rest[idx+len(part):]
+	}
+	return true
+}
@@ -0,0 +1,151 @@
+package helpers
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const testRobots = `# comment
+User-agent: *
+Disallow: /private/
+Allow: /private/public
+Disallow: /*.pdf$
+Crawl-delay: 2
+
+User-agent: GolandCrawler
+User-agent: other
+Disallow: /only-us
+Allow: /only-us/ok
+Crawl-delay: 0.5
+
+User-agent: GolandCrawler-news
+Disallow: /
+
+Sitemap: https://example.com/sitemap.xml
+`
+
+func TestParseRobotsGroups(t *testing.T) {
+	tests := []struct {
+		name, userAgent string
+		allowed         map[string]bool
+		delay           time.Duration
+	}{
+		{
+			name:      "fallback group",
+			userAgent: "SomeBot/2.0",
+			allowed: map[string]bool{
+				"/":                   true,
+				"/private/x":          false,
+				"/private/public/x":   true,
+				"/doc.pdf":            false,
+				"/doc.pdf?download=1": true,
+				"/only-us":            true,
+			},
+			delay: 2 * time.Second,
+		},
+		{
+			// Our own group replaces "*", and a longer token like GolandCrawler-news is not ours
+			name:      "own group",
+			userAgent: "GolandCrawler/1.0 (+https://example.com/bot)",
+			allowed: map[string]bool{
+				"/":            true,
+				"/private/x":   true,
+				"/only-us":     false,
+				"/only-us/ok":  true,
+				"/only-usable": false,
+			},
+			delay: 500 * time.Millisecond,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rules := ParseRobots(strings.NewReader(testRobots), test.userAgent)
+			for path, want := range test.allowed {
+				if got := rules.Allowed(path); got != want {
+					t.Errorf("Allowed(%q) = %v, want %v", path, got, want)
+				}
+			}
+			if rules.CrawlDelay != test.delay {
+				t.Errorf("CrawlDelay = %s, want %s", rules.CrawlDelay, test.delay)
+			}
+			if len(rules.Sitemaps) != 1 || rules.Sitemaps[0] != "https://example.com/sitemap.xml" {
+				t.Errorf("Sitemaps = %v", rules.Sitemaps)
+			}
+		})
+	}
+}
+
+func TestParseRobotsEdgeCases(t *testing.T) {
+	tests := []struct {
+		name, robots, path string
+		want               bool
+	}{
+		{"empty file", "", "/x", true},
+		{"empty disallow", "User-agent: *\nDisallow:\n", "/x", true},
+		{"rules before any group", "Disallow: /\n", "/x", true},
+		{"no matching group", "User-agent: other\nDisallow: /\n", "/x", true},
+		{"tie goes to allow", "User-agent: *\nDisallow: /a\nAllow: /a\n", "/a", true},
+		{"case insensitive keys", "USER-AGENT: *\nDISALLOW: /a\n", "/a", false},
+		{"no colon", "User-agent *\nDisallow /\n", "/x", true},
+		{"binary garbage", "\x00\xff\xfe:\x01\nUser-agent: *\nDisallow: /x\n", "/x", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := ParseRobots(strings.NewReader(test.robots), "GolandCrawler").Allowed(test.path); got != test.want {
+				t.Errorf("Allowed(%q) = %v, want %v", test.path, got, test.want)
+			}
+		})
+	}
+	var none *RobotsRules
+	if !none.Allowed("/x") {
+		t.Error("nil rules disallow")
+	}
+}
+
+func TestRobotsMatch(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"/", "/anything", true},
+		{"/fish", "/fish.html", true},
+		{"/fish", "/Fish", false},
+		{"/fish/", "/fish", false},
+		{"/*.php", "/index.php", true},
+		{"/*.php", "/a/b.php?x=1", true},
+		{"/*.php$", "/a.php", true},
+		{"/*.php$", "/a.php5", false},
+		{"/fish*", "/fishheads", true},
+		{"/a*b*c", "/axxbyyc", true},
+		{"/a*b*c", "/axxcyyb", false},
+		{"/$", "/", true},
+		{"/$", "/a", false},
+		{"*", "/x", true},
+	}
+	for _, test := range tests {
+		if got := robotsMatch(test.pattern, test.path); got != test.want {
+			t.Errorf("robotsMatch(%q, %q) = %v, want %v", test.pattern, test.path, got, test.want)
+		}
+	}
+}
+
+func TestRobotsAgentToken(t *testing.T) {
+	for userAgent, want := range map[string]string{
+		"GolandCrawler/1.0 (+https://x)": "golandcrawler",
+		" Googlebot ":                    "googlebot",
+		"*":                              "*",
+	} {
+		if got := RobotsAgentToken(userAgent); got != want {
+			t.Errorf("RobotsAgentToken(%q) = %q, want %q", userAgent, got, want)
+		}
+	}
+}
+
+func FuzzParseRobots(f *testing.F) {
+	f.Add(testRobots, "/private/x")
+	f.Add("User-agent: *\nDisallow: /*$*$\n", "/a$")
+	f.Fuzz(func(t *testing.T, robots, path string) {
+		ParseRobots(strings.NewReader(robots), "GolandCrawler/1.0").Allowed(path)
+	})
+}
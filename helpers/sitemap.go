@@ -0,0 +1,134 @@
+package helpers
+
+import (
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SitemapURL is one <url> entry of a sitemap <urlset>
+type SitemapURL struct {
+	Loc     string
+	LastMod string
+	// Priority is 0.5 unless the entry says otherwise, as the sitemap protocol defines
+	Priority float64
+}
+
+// sitemapDefaultPriority is the priority of entries without a <priority>
+const sitemapDefaultPriority = 0.5
+
+// lastModLayouts are the W3C Datetime forms a <lastmod> may take
+var lastModLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04Z07:00", "2006-01-02", "2006-01", "2006"}
+
+// ParseLastMod parses the value of a <lastmod>, ok is false for a missing or malformed one
+func ParseLastMod(value string) (at time.Time, ok bool) {
+	value = strings.TrimSpace(value)
+	for _, layout := range lastModLayouts {
+		if at, err := time.Parse(layout, value); err == nil {
+			return at, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// sitemapNamespace is the namespace of the sitemaps.org 0.9 protocol
+const sitemapNamespace = "http://www.sitemaps.org/schemas/sitemap/0.9"
+
+// isSitemapElement reports whether name is a sitemap protocol element. Sitemaps without an
+// xmlns declaration are common, so no namespace counts too, extensions like image: don't.
+func isSitemapElement(name xml.Name) bool {
+	return name.Space == "" || name.Space == sitemapNamespace
+}
+
+// ParseSitemap reads either a <urlset> or a <sitemapindex> document.
+// Page entries are returned in urls, nested sitemap locations in children.
+// Only the direct children of <url> and <sitemap> are read, so the <image:loc> of an image
+// sitemap or the <video:content_loc> of a video sitemap don't replace the page's <loc>.
+func ParseSitemap(r io.Reader) (urls []SitemapURL, children []string, err error) {
+	decoder := xml.NewDecoder(r)
+	// Sitemaps are UTF-8 by spec, but don't fail hard on a wrong declaration
+	decoder.CharsetReader = func(_ string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	decoder.Strict = false
+
+	var (
+		current *SitemapURL
+		field   string
+		text    strings.Builder
+		// depth is the element nesting, entryDepth the depth of the current <url> or <sitemap>
+		depth, entryDepth int
+	)
+	for {
+		token, tokenErr := decoder.Token()
+		if tokenErr == io.EOF {
+			break
+		}
+		if tokenErr != nil {
+			return urls, children, tokenErr
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			if !isSitemapElement(t.Name) {
+				continue
+			}
+			switch t.Name.Local {
+			case "url", "sitemap":
+				if current == nil {
+					current = &SitemapURL{Priority: sitemapDefaultPriority}
+					entryDepth = depth
+				}
+			case "loc", "lastmod", "priority":
+				if current != nil && depth == entryDepth+1 {
+					field = t.Name.Local
+					text.Reset()
+				}
+			}
+		case xml.CharData:
+			if field != "" {
+				text.Write(t)
+			}
+		case xml.EndElement:
+			depth--
+			if current == nil || !isSitemapElement(t.Name) {
+				continue
+			}
+			switch t.Name.Local {
+			case "loc", "lastmod", "priority":
+				if field == t.Name.Local && depth == entryDepth {
+					value := strings.TrimSpace(text.String())
+					switch field {
+					case "loc":
+						current.Loc = value
+					case "lastmod":
+						current.LastMod = value
+					case "priority":
+						if p, err := strconv.ParseFloat(value, 64); err == nil {
+							current.Priority = p
+						}
+					}
+					field = ""
+				}
+			case "url":
+				if depth == entryDepth-1 {
+					if current.Loc != "" {
+						urls = append(urls, *current)
+					}
+					current = nil
+				}
+			case "sitemap":
+				if depth == entryDepth-1 {
+					if current.Loc != "" {
+						children = append(children, current.Loc)
+					}
+					current = nil
+				}
+			}
+		}
+	}
+	return urls, children, nil
+}
@@ -0,0 +1,121 @@
+package helpers
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSitemap(t *testing.T) {
+	urlset := `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc> https://example.com/a </loc><lastmod>2024-01-31</lastmod><priority>0.8</priority></url>
+  <url><loc>https://example.com/b</loc></url>
+  <url><priority>1.0</priority></url>
+</urlset>`
+	urls, children, err := ParseSitemap(strings.NewReader(urlset))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SitemapURL{
+		{Loc: "https://example.com/a", LastMod: "2024-01-31", Priority: 0.8},
+		{Loc: "https://example.com/b", Priority: 0.5},
+	}
+	if len(children) != 0 || len(urls) != len(want) {
+		t.Fatalf("got %v and children %v, want %v", urls, children, want)
+	}
+	for i := range want {
+		if urls[i] != want[i] {
+			t.Errorf("url %d = %+v, want %+v", i, urls[i], want[i])
+		}
+	}
+
+	index := `<sitemapindex><sitemap><loc>https://example.com/s1.xml.gz</loc></sitemap></sitemapindex>`
+	urls, children, err = ParseSitemap(strings.NewReader(index))
+	if err != nil || len(urls) != 0 || len(children) != 1 || children[0] != "https://example.com/s1.xml.gz" {
+		t.Errorf("index gave %v, %v, %v", urls, children, err)
+	}
+
+	// A broken document keeps what was read before the error
+	urls, _, err = ParseSitemap(strings.NewReader(`<urlset><url><loc>https://example.com/c</loc></url><url><loc>`))
+	if err == nil || len(urls) != 1 {
+		t.Errorf("truncated sitemap gave %v, %v", urls, err)
+	}
+}
+
+func TestParseSitemapExtensions(t *testing.T) {
+	tests := []struct {
+		name, sitemap string
+		want          []SitemapURL
+	}{
+		{"image", `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9" xmlns:image="http://www.google.com/schemas/sitemap-image/1.1">
+  <url>
+    <loc>https://shop.example.com/product/1</loc>
+    <lastmod>2024-02-01</lastmod>
+    <image:image><image:loc>https://shop.example.com/img/1.jpg</image:loc></image:image>
+    <image:image><image:loc>https://shop.example.com/img/2.jpg</image:loc></image:image>
+  </url>
+  <url>
+    <image:image><image:loc>https://shop.example.com/img/3.jpg</image:loc></image:image>
+    <loc>https://shop.example.com/product/2</loc>
+  </url>
+</urlset>`, []SitemapURL{
+			{Loc: "https://shop.example.com/product/1", LastMod: "2024-02-01", Priority: 0.5},
+			{Loc: "https://shop.example.com/product/2", Priority: 0.5},
+		}},
+		{"video", `<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9" xmlns:video="http://www.google.com/schemas/sitemap-video/1.1">
+  <url>
+    <loc>https://example.com/videos/intro</loc>
+    <video:video>
+      <video:thumbnail_loc>https://example.com/thumbs/intro.jpg</video:thumbnail_loc>
+      <video:content_loc>https://example.com/media/intro.mp4</video:content_loc>
+      <video:player_loc>https://example.com/player?video=intro</video:player_loc>
+      <video:publication_date>2020-01-01T00:00:00+00:00</video:publication_date>
+      <video:priority>1.0</video:priority>
+    </video:video>
+    <priority>0.7</priority>
+  </url>
+</urlset>`, []SitemapURL{
+			{Loc: "https://example.com/videos/intro", Priority: 0.7},
+		}},
+		{"undeclared prefix", `<urlset><url><loc>https://example.com/a</loc><image:image><image:loc>https://example.com/a.png</image:loc></image:image></url></urlset>`, []SitemapURL{
+			{Loc: "https://example.com/a", Priority: 0.5},
+		}},
+	}
+	for _, test := range tests {
+		urls, children, err := ParseSitemap(strings.NewReader(test.sitemap))
+		if err != nil || len(children) != 0 || len(urls) != len(test.want) {
+			t.Errorf("%s: got %+v, %v, %v, want %+v", test.name, urls, children, err, test.want)
+			continue
+		}
+		for i := range test.want {
+			if urls[i] != test.want[i] {
+				t.Errorf("%s: url %d = %+v, want %+v", test.name, i, urls[i], test.want[i])
+			}
+		}
+	}
+}
+
+func TestParseLastMod(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Time
+		ok    bool
+	}{
+		{"2024-01-31", time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC), true},
+		{"2024-01", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), true},
+		{"2024-01-31T12:30:00Z", time.Date(2024, 1, 31, 12, 30, 0, 0, time.UTC), true},
+		{"2024-01-31T12:30:00.5+03:30", time.Date(2024, 1, 31, 9, 0, 0, 500_000_000, time.UTC), true},
+		{"2024-01-31T12:30+00:00", time.Date(2024, 1, 31, 12, 30, 0, 0, time.UTC), true},
+		{" 2024-01-31 ", time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC), true},
+		{"", time.Time{}, false},
+		{"yesterday", time.Time{}, false},
+	}
+	for _, test := range tests {
+		got, ok := ParseLastMod(test.value)
+		if ok != test.ok || !got.Equal(test.want) {
+			t.Errorf("ParseLastMod(%q) = %v, %v, want %v, %v", test.value, got, ok, test.want, test.ok)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package helpers
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// DefaultStripParams are tracking parameters removed before URLs are deduplicated.
+// A trailing '*' matches every parameter with that prefix.
+var DefaultStripParams = []string{"utm_*", "fbclid", "gclid", "msclkid", "yclid", "_ga", "mc_cid", "mc_eid"}
+
+var errUnsupportedScheme = errors.New("unsupported URL scheme")
+
+// URLNormalizer turns the many spellings of a URL into one canonical string,
+// so one page is only fetched and stored once.
+type URLNormalizer struct {
+	stripExact  map[string]struct{}
+	stripPrefix []string
+}
+
+func NewURLNormalizer(stripParams []string) *URLNormalizer {
+	n := &URLNormalizer{stripExact: make(map[string]struct{}, len(stripParams))}
+	for _, param := range stripParams {
+		param = strings.ToLower(strings.TrimSpace(param))
+		if prefix, ok := strings.CutSuffix(param, "*"); ok {
+			n.stripPrefix = append(n.stripPrefix, prefix)
+		} else if param != "" {
+			n.stripExact[param] = struct{}{}
+		}
+	}
+	return n
+}
+
+// Normalize canonicalizes an absolute http(s) URL
+func (n *URLNormalizer) Normalize(raw string) (string, error) {
+	return n.Resolve(nil, raw)
+}
+
+// Resolve resolves href against base (the page URL or its <base href>) and canonicalizes the result
+func (n *URLNormalizer) Resolve(base *url.URL, href string) (string, error) {
+	ref, err := url.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return "", err
+	}
+	if base == nil {
+		base = ref
+	}
+	// ResolveReference also removes "." and ".." segments, even for absolute references
+	u := base.ResolveReference(ref)
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", errUnsupportedScheme
+	}
+	if u.Host == "" {
+		return "", errors.New("URL has no host")
+	}
+	u.Fragment, u.RawFragment = "", ""
+
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if strings.Contains(host, ":") {
+		// IPv6 literal
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	u.Host = host
+
+	// "/%D9%BE" and "/پ" end up identical, while "/a%3Fb" stays apart from "/a?b"
+	path := canonicalPath(u.EscapedPath())
+	if len(path) > 1 {
+		path = strings.TrimRight(path, "/")
+	}
+	if path == "" {
+		path = "/"
+	}
+	u.RawPath = path
+	u.Path, _ = url.PathUnescape(path)
+
+	u.ForceQuery = false
+	if u.RawQuery != "" {
+		if values, err := url.ParseQuery(u.RawQuery); err == nil {
+			for key := range values {
+				if n.stripped(key) {
+					delete(values, key)
+				}
+			}
+			// Encode sorts the parameters by key
+			u.RawQuery = values.Encode()
+		}
+	}
+	return u.String(), nil
+}
+
+func (n *URLNormalizer) stripped(param string) bool {
+	param = strings.ToLower(param)
+	if _, ok := n.stripExact[param]; ok {
+		return true
+	}
+	for _, prefix := range n.stripPrefix {
+		if strings.HasPrefix(param, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalPath normalizes the percent-encoding of an escaped path (RFC 3986 section 6.2.2).
+// Escapes of unreserved characters are decoded, the others are kept with upper-case hex
+// digits, since decoding e.g. %2F or %3F would change what the path means. Characters
+// that need escaping in a path are escaped.
+func canonicalPath(escaped string) string {
+	var b strings.Builder
+	b.Grow(len(escaped))
+	for i := 0; i < len(escaped); i++ {
+		c := escaped[i]
+		if c == '%' && i+2 < len(escaped) && isHex(escaped[i+1]) && isHex(escaped[i+2]) {
+			decoded := unhex(escaped[i+1])<<4 | unhex(escaped[i+2])
+			if isUnreserved(decoded) {
+				b.WriteByte(decoded)
+			} else {
+				b.WriteByte('%')
+				b.WriteByte(toUpperHex(escaped[i+1]))
+				b.WriteByte(toUpperHex(escaped[i+2]))
+			}
+			i += 2
+			continue
+		}
+		if isUnreserved(c) || strings.IndexByte("$&+,/:;=@", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// isUnreserved reports whether c is an unreserved character of RFC 3986, the same escaped or not
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c <= '9':
+		return c - '0'
+	case c <= 'F':
+		return c - 'A' + 10
+	}
+	return c - 'a' + 10
+}
+
+func toUpperHex(c byte) byte {
+	if c >= 'a' && c <= 'f' {
+		return c - 'a' + 'A'
+	}
+	return c
+}
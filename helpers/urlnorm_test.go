@@ -0,0 +1,93 @@
+package helpers
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	n := NewURLNormalizer(DefaultStripParams)
+	tests := []struct {
+		raw, want string
+	}{
+		// Scheme, host and port
+		{"HTTPS://Example.COM./a", "https://example.com/a"},
+		{"http://example.com:80/a", "http://example.com/a"},
+		{"https://example.com:443/a", "https://example.com/a"},
+		{"https://example.com:8443/a", "https://example.com:8443/a"},
+		{"http://[::1]:8080/a", "http://[::1]:8080/a"},
+		{"https://example.com/a#section", "https://example.com/a"},
+
+		// Percent-encoding: unreserved characters are decoded, everything else stays encoded
+		{"https://example.com/%7Euser/%41%62c", "https://example.com/~user/Abc"},
+		{"https://example.com/%d9%be", "https://example.com/%D9%BE"},
+		{"https://example.com/پ", "https://example.com/%D9%BE"},
+		{"https://example.com/a%2fb", "https://example.com/a%2Fb"},
+		{"https://example.com/a%3Bb", "https://example.com/a%3Bb"},
+		{"https://example.com/a;b", "https://example.com/a;b"},
+		{"https://example.com/a%3db", "https://example.com/a%3Db"},
+		{"https://example.com/a%3Fb", "https://example.com/a%3Fb"},
+		{"https://example.com/a%23b", "https://example.com/a%23b"},
+		{"https://example.com/a%20b", "https://example.com/a%20b"},
+		{"https://example.com/a b", "https://example.com/a%20b"},
+		{"https://example.com/a%21b", "https://example.com/a%21b"},
+		{"https://example.com/a!b", "https://example.com/a%21b"},
+
+		// Paths: dot segments, empty paths and trailing slashes
+		{"https://example.com", "https://example.com/"},
+		{"https://example.com/", "https://example.com/"},
+		{"https://example.com/a/b/", "https://example.com/a/b"},
+		{"https://example.com/a//", "https://example.com/a"},
+		{"https://example.com/a/./b/../c", "https://example.com/a/c"},
+		{"https://example.com/a%2F", "https://example.com/a%2F"},
+
+		// Queries are sorted and tracking parameters dropped
+		{"https://example.com/a?b=2&a=1", "https://example.com/a?a=1&b=2"},
+		{"https://example.com/a?utm_source=x&id=3&UTM_Medium=y&fbclid=z", "https://example.com/a?id=3"},
+		{"https://example.com/a?utm_source=x", "https://example.com/a"},
+		{"https://example.com/a?", "https://example.com/a"},
+		{"https://example.com/a?q=a%26b&q=c", "https://example.com/a?q=a%26b&q=c"},
+	}
+	for _, test := range tests {
+		got, err := n.Normalize(test.raw)
+		if err != nil {
+			t.Errorf("Normalize(%q): %s", test.raw, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("Normalize(%q) = %q, want %q", test.raw, got, test.want)
+		}
+		// Normalizing is idempotent
+		if again, err := n.Normalize(got); err != nil || again != got {
+			t.Errorf("Normalize(%q) = %q, %v, not idempotent", got, again, err)
+		}
+	}
+
+	for _, raw := range []string{"ftp://example.com/a", "mailto:a@example.com", "https:///a", "https://example.com/%zz"} {
+		if got, err := n.Normalize(raw); err == nil {
+			t.Errorf("Normalize(%q) = %q, want an error", raw, got)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	n := NewURLNormalizer(nil)
+	base, _ := url.Parse("https://example.com/dir/page.html?x=1")
+	tests := []struct {
+		href, want string
+	}{
+		{"other.html", "https://example.com/dir/other.html"},
+		{"../up/", "https://example.com/up"},
+		{"/abs?utm_source=x", "https://example.com/abs?utm_source=x"},
+		{"?y=2", "https://example.com/dir/page.html?y=2"},
+		{"#top", "https://example.com/dir/page.html?x=1"},
+		{"//cdn.example.com/a%3fb", "https://cdn.example.com/a%3Fb"},
+		{"  sub/%7efile  ", "https://example.com/dir/sub/~file"},
+	}
+	for _, test := range tests {
+		got, err := n.Resolve(base, test.href)
+		if err != nil || got != test.want {
+			t.Errorf("Resolve(%q) = %q, %v, want %q", test.href, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// storedBody describes a response body written to storage
+type storedBody struct {
+	size int64
+	// hash is the sha256 of the stored bytes
+	hash      string
+	truncated bool
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// storeBody streams a response body into the page store under key, hashing it on the way. It stops after
+// MaxBodySize bytes and marks the body truncated if there was more, leaving the rest unread
+// so the connection is dropped. The stored body is only replaced once it was read completely.
+func storeBody(body io.Reader, key string) (storedBody, error) {
+	hasher := sha256.New()
+	reader := body
+	if crawlConfig.MaxBodySize > 0 {
+		reader = io.LimitReader(body, crawlConfig.MaxBodySize)
+	}
+	counter := &countingReader{Reader: io.TeeReader(reader, hasher)}
+	if err := pageStore.Put(key, PartBody, counter); err != nil {
+		return storedBody{}, err
+	}
+	stored := storedBody{size: counter.n, hash: hex.EncodeToString(hasher.Sum(nil))}
+	if crawlConfig.MaxBodySize > 0 && stored.size == crawlConfig.MaxBodySize {
+		// Probe for one more byte to tell a body of exactly the limit from a longer one
+		var probe [1]byte
+		n, _ := io.ReadFull(body, probe[:])
+		stored.truncated = n > 0
+	}
+	return stored, nil
+}
+
+// bodyStats sums up the bytes stored by the crawl
+var bodyStats = struct {
+	lock      sync.Mutex
+	bytes     int64
+	pages     int
+	truncated int
+	largest   int64
+	// largestURL is the page with the largest stored body
+	largestURL string
+}{}
+
+// recordBody adds a stored body to the totals, hostName is the host the request was sent to,
+// like for the other per-host metrics of the fetch
+func recordBody(hostName, url string, body storedBody) {
+	hostBodyBytes.With(hostName).Add(uint64(body.size))
+	bodyStats.lock.Lock()
+	defer bodyStats.lock.Unlock()
+	bodyStats.bytes += body.size
+	bodyStats.pages++
+	if body.truncated {
+		bodyStats.truncated++
+	}
+	if body.size > bodyStats.largest {
+		bodyStats.largest, bodyStats.largestURL = body.size, url
+	}
+}
+
+// bodyReport summarizes the stored bytes, e.g. "12.5 MB in 340 pages (avg 37.6 kB, 2 truncated, largest 3.1 MB: https://...)"
+func bodyReport() string {
+	bodyStats.lock.Lock()
+	defer bodyStats.lock.Unlock()
+	if bodyStats.pages == 0 {
+		return "no pages downloaded"
+	}
+	return fmt.Sprintf("%s in %d pages (avg %s, %d truncated, largest %s: %s)",
+		formatBytes(bodyStats.bytes), bodyStats.pages, formatBytes(bodyStats.bytes/int64(bodyStats.pages)),
+		bodyStats.truncated, formatBytes(bodyStats.largest), bodyStats.largestURL)
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f kB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
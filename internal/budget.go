@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// crawlBudget counts the pages processed so far, globally and per host
+var crawlBudget = struct {
+	lock    sync.Mutex
+	pages   int
+	perHost map[string]int
+	// overHost counts pages skipped because their host ran out of budget
+	overHost int
+}{perHost: make(map[string]int)}
+
+// crawlStop is closed once the crawl has to end, stopReason says why.
+// crawlCtx is cancelled when the process is interrupted, it aborts the downloads in progress.
+var (
+	crawlCtx      = context.Background()
+	crawlStop     = make(chan struct{})
+	crawlStopOnce sync.Once
+	stopReason    string
+)
+
+// stopCrawl ends the crawl, only the first reason is kept
+func stopCrawl(reason string) {
+	crawlStopOnce.Do(func() {
+		stopReason = reason
+		close(crawlStop)
+	})
+}
+
+// crawlStopped reports whether stopCrawl was called
+func crawlStopped() bool {
+	select {
+	case <-crawlStop:
+		return true
+	default:
+		return false
+	}
+}
+
+// reservePage takes one page from the global and the per-host budget.
+// It returns false if the page must not be processed.
+func reservePage(u *url.URL) bool {
+	crawlBudget.lock.Lock()
+	defer crawlBudget.lock.Unlock()
+
+	if crawlConfig.MaxPages > 0 && crawlBudget.pages >= crawlConfig.MaxPages {
+		stopCrawl(fmt.Sprintf("page budget of %d pages reached", crawlConfig.MaxPages))
+		return false
+	}
+	host := strings.ToLower(u.Host)
+	if crawlConfig.MaxPagesPerHost > 0 && crawlBudget.perHost[host] >= crawlConfig.MaxPagesPerHost {
+		crawlBudget.overHost++
+		return false
+	}
+	crawlBudget.pages++
+	crawlBudget.perHost[host]++
+	return true
+}
+
+// depthAllowed reports whether an entry at depth may still be queued
+func depthAllowed(depth int) bool {
+	return crawlConfig.MaxDepth <= 0 || depth <= crawlConfig.MaxDepth
+}
+
+// budgetReport summarizes how much of the budgets the crawl used
+func budgetReport() string {
+	crawlBudget.lock.Lock()
+	defer crawlBudget.lock.Unlock()
+	report := fmt.Sprintf("%d pages processed on %d hosts", crawlBudget.pages, len(crawlBudget.perHost))
+	if crawlBudget.overHost > 0 {
+		report += fmt.Sprintf(", %d pages skipped by the per-host budget", crawlBudget.overHost)
+	}
+	return report
+}
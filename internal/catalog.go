@@ -0,0 +1,416 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"crawler/helpers"
+	"crawler/models"
+)
+
+// catalogFile is the crawl catalog in crawlStateDir
+const catalogFile = "catalog.jsonl"
+
+// Index states of a catalog record
+const (
+	// IndexPending pages changed since they were last sent to the index
+	IndexPending = "pending"
+	IndexIndexed = "indexed"
+	// IndexExcluded pages are kept out of the index: noindex, a canonical variant or a duplicate
+	IndexExcluded = "excluded"
+)
+
+// CatalogRecord maps a storage key back to its page
+type CatalogRecord struct {
+	URL           string    `json:"url"`
+	NormalizedURL string    `json:"normalized_url"`
+	Key           string    `json:"key"`
+	FetchedAt     time.Time `json:"fetched_at"`
+	Status        int       `json:"status"`
+	// ContentHash is the hash of the main text, BodyHash the sha256 of the stored body
+	ContentHash string `json:"content_hash,omitempty"`
+	BodyHash    string `json:"body_hash,omitempty"`
+	Charset     string `json:"charset,omitempty"`
+	// ExtractorVersion is the helpers.ExtractorVersion the document was extracted with, 0 if unknown
+	ExtractorVersion int       `json:"extractor_version"`
+	IndexStatus      string    `json:"index_status,omitempty"`
+	UpdatedAt        time.Time `json:"updated_at"`
+	// Deleted drops the record of Key, whose page is no longer stored
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// catalog is the catalog of the running crawl or import, set from CrawlConfig.Catalog
+var catalog *Catalog
+
+// Catalog is the durable map from storage keys to URLs and their metadata. Every change is
+// appended to a JSONL file, later records replace earlier ones and Close compacts the file
+// once most of it is outdated. A nil *Catalog ignores updates.
+//
+// Only one process writes the catalog, the one running the crawl or another mode that changes
+// pages. Readers such as the server follow its appends and compactions on every lookup.
+type Catalog struct {
+	lock    sync.Mutex
+	path    string
+	file    *os.File
+	records map[string]CatalogRecord
+	// lines is the number of records in the file, including replaced ones
+	lines int
+	// offset is where the last complete line read from the file ends, loaded the file it was read from
+	offset int64
+	loaded os.FileInfo
+}
+
+// OpenCatalog opens the catalog of the crawl in ./site for writing. Stored pages the
+// catalog doesn't know yet, e.g. stored while no catalog was kept, are added to it.
+func OpenCatalog(store PageStore) (*Catalog, error) {
+	if err := os.MkdirAll(crawlStateDir, 0755); err != nil {
+		return nil, err
+	}
+	c := &Catalog{path: filepath.Join(crawlStateDir, catalogFile), records: make(map[string]CatalogRecord)}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(c.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// Cut off a torn last line from a crash, so the next record starts on a line of its own
+	if err := file.Truncate(c.offset); err != nil {
+		file.Close()
+		return nil, err
+	}
+	c.file = file
+	if store != nil {
+		added, err := c.backfill(store)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		if added > 0 {
+			fmt.Printf("Added %d stored pages to the catalog\n", added)
+		}
+	}
+	return c, nil
+}
+
+// OpenCatalogReader opens the catalog of the crawl in ./site for lookups only, next to a
+// process that may be writing it. A missing catalog is empty until a writer creates it.
+func OpenCatalogReader() (*Catalog, error) {
+	c := &Catalog{path: filepath.Join(crawlStateDir, catalogFile), records: make(map[string]CatalogRecord)}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load reads the lines appended to the catalog file since the last call. A line still being
+// written, or torn by a crash, is left for later. When the writer compacted the file in the
+// meantime it is read again from the start.
+func (c *Catalog) load() error {
+	file, err := os.Open(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if c.loaded != nil && (!os.SameFile(c.loaded, info) || info.Size() < c.offset) {
+		c.records = make(map[string]CatalogRecord)
+		c.lines, c.offset = 0, 0
+	}
+	c.loaded = info
+	if _, err := file.Seek(c.offset, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		c.offset += int64(len(line))
+		var record CatalogRecord
+		if err := json.Unmarshal(line, &record); err != nil || record.Key == "" {
+			continue
+		}
+		if record.Deleted {
+			delete(c.records, record.Key)
+		} else {
+			c.records[record.Key] = record
+		}
+		c.lines++
+	}
+}
+
+// backfill adds a record for every stored page the catalog doesn't know yet
+func (c *Catalog) backfill(store PageStore) (int, error) {
+	added := 0
+	err := store.Iterate(func(key string) error {
+		c.lock.Lock()
+		_, known := c.records[key]
+		c.lock.Unlock()
+		if known {
+			return nil
+		}
+		var doc models.Document
+		hasDocument := store.Exists(key, PartDocument)
+		if hasDocument {
+			doc, _ = loadDocument(store, key)
+		}
+		meta, err := loadPageMeta(store, key)
+		if err != nil {
+			// Pages stored before their fetch state was kept only have the document to name their URL
+			meta = models.PageMeta{URL: doc.URL}
+		}
+		if meta.URL == "" {
+			// Without a URL there is nothing to map the key to
+			return nil
+		}
+		added++
+		return c.Update(key, func(record *CatalogRecord) {
+			setCatalogPage(record, "", meta)
+			record.Charset = doc.Charset
+			if record.IndexStatus == "" && hasDocument {
+				// Flags are cleared once a page is indexed
+				record.IndexStatus = IndexIndexed
+			}
+		})
+	})
+	return added, err
+}
+
+// Update changes the record of key, creating it if needed, and appends it to the catalog file
+func (c *Catalog) Update(key string, change func(record *CatalogRecord)) error {
+	if c == nil {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.file == nil {
+		return errors.New("the catalog is open for reading only")
+	}
+	record := c.records[key]
+	record.Key = key
+	change(&record)
+	if err := c.append(&record); err != nil {
+		return err
+	}
+	c.records[key] = record
+	return nil
+}
+
+// append stamps a record and writes it to the catalog file, c.lock must be held
+func (c *Catalog) append(record *CatalogRecord) error {
+	record.UpdatedAt = time.Now()
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	// One write per line, so a crash tears at most the last record
+	if _, err := c.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	c.lines++
+	return nil
+}
+
+// Move hands the record of a page that moved from one key to another to the new key,
+// unless that has a record of its own, and drops the old one
+func (c *Catalog) Move(from, to string) error {
+	if c == nil {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.file == nil {
+		return errors.New("the catalog is open for reading only")
+	}
+	record, ok := c.records[from]
+	if !ok {
+		return nil
+	}
+	if _, taken := c.records[to]; !taken {
+		record.Key = to
+		if err := c.append(&record); err != nil {
+			return err
+		}
+		c.records[to] = record
+	}
+	if err := c.append(&CatalogRecord{Key: from, Deleted: true}); err != nil {
+		return err
+	}
+	delete(c.records, from)
+	return nil
+}
+
+// Lookup finds a record by storage key, stored filename or URL
+func (c *Catalog) Lookup(query string) (CatalogRecord, bool) {
+	if c == nil {
+		return CatalogRecord{}, false
+	}
+	query = strings.TrimSpace(query)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.file == nil {
+		// A reader picks up what the writer added since
+		if err := c.load(); err != nil {
+			fmt.Println("Could not read the catalog:", err)
+		}
+	}
+	// A stored filename is the key with the part as extension
+	name := filepath.Base(query)
+	if key, ext, ok := strings.Cut(name, "."); ok && slices.Contains(pageParts, PagePart(ext)) {
+		name = key
+	}
+	if record, ok := c.records[name]; ok {
+		return record, true
+	}
+	record, ok := c.records[PageKey(query)]
+	return record, ok
+}
+
+// Close compacts the catalog file when more than half of it is replaced records, and closes it
+func (c *Catalog) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.file == nil {
+		return nil
+	}
+	if c.lines > 2*len(c.records) {
+		if err := c.compact(); err != nil {
+			fmt.Println("Could not compact the catalog:", err)
+		}
+	}
+	syncErr := c.file.Sync()
+	if err := c.file.Close(); err != nil {
+		return err
+	}
+	c.file = nil
+	return syncErr
+}
+
+// compact rewrites the catalog with only the current records
+func (c *Catalog) compact() error {
+	tmp := c.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, record := range c.records {
+		if err := encoder.Encode(record); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return err
+	}
+	c.file.Close()
+	c.file, err = os.OpenFile(c.path, os.O_WRONLY|os.O_APPEND, 0644)
+	c.lines = len(c.records)
+	return err
+}
+
+// setCatalogPage copies the fetch state of a page into its record. requested is the URL the page
+// was asked for, before redirects; empty keeps the recorded one.
+func setCatalogPage(record *CatalogRecord, requested string, meta models.PageMeta) {
+	switch {
+	case requested != "":
+		record.URL = requested
+	case record.URL == "":
+		record.URL = meta.URL
+	}
+	record.NormalizedURL = meta.URL
+	if normalized, err := urlNormalizer.Normalize(meta.URL); err == nil {
+		record.NormalizedURL = normalized
+	}
+	record.FetchedAt = meta.FetchedAt
+	record.Status = meta.Status
+	record.ContentHash = meta.ContentHash
+	record.BodyHash = meta.BodyHash
+	switch {
+	case meta.NoIndex || meta.Canonical != "" || meta.DuplicateOf != "":
+		record.IndexStatus = IndexExcluded
+	case meta.NeedsReindex, record.IndexStatus == IndexExcluded:
+		// A page that is no longer excluded waits for the next indexing run
+		record.IndexStatus = IndexPending
+	}
+}
+
+// catalogPage records a stored page in the catalog. requested is the URL it was fetched by,
+// empty if it wasn't just fetched, and doc the document if it was just extracted.
+func catalogPage(c *Catalog, key, requested string, meta models.PageMeta, doc *models.Document) {
+	err := c.Update(key, func(record *CatalogRecord) {
+		setCatalogPage(record, requested, meta)
+		if doc != nil {
+			record.Charset = doc.Charset
+			record.ExtractorVersion = helpers.ExtractorVersion
+		}
+	})
+	if err != nil {
+		fmt.Printf("Could not update the catalog for %s: %s\n", meta.URL, err)
+	}
+}
+
+// catalogIndexed records that the pages of a bulk request made it into the index, or out of it
+func catalogIndexed(c *Catalog, store PageStore, keys []string) {
+	for _, key := range keys {
+		meta, err := loadPageMeta(store, key)
+		if err != nil {
+			continue
+		}
+		status := IndexIndexed
+		if meta.NoIndex || meta.Canonical != "" || meta.DuplicateOf != "" {
+			status = IndexExcluded
+		}
+		c.Update(key, func(record *CatalogRecord) {
+			if record.URL == "" {
+				setCatalogPage(record, "", meta)
+			}
+			record.IndexStatus = status
+		})
+	}
+}
+
+// CatalogLookupHandler responds with the catalog record of a URL, storage key or stored filename
+func CatalogLookupHandler(c *Catalog, w http.ResponseWriter, query string) {
+	record, ok := c.Lookup(query)
+	if !ok {
+		http.Error(w, fmt.Sprintf("%s is not in the crawl catalog", query), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, record)
+}
@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"net/http"
+	"time"
+
+	"crawler/helpers"
+)
+
+// DefaultUserAgent is sent with every crawler request unless overridden with -user-agent
+const DefaultUserAgent = "GolandCrawler/1.0 (+https://github.com/Ilygm/goland-crawler)"
+
+// CrawlConfig holds the tunables of a crawl run, main fills it from the command line flags
+type CrawlConfig struct {
+	// UserAgent is sent with every request and decides which robots.txt group applies to us
+	UserAgent string
+	// Headers are added to every request, e.g. Accept-Language
+	Headers http.Header
+	// Proxy is the proxy URL, empty to use HTTP_PROXY/HTTPS_PROXY/NO_PROXY, "direct" for none
+	Proxy string
+	// ConnectTimeout, TLSTimeout and ReadTimeout bound establishing the connection, the TLS handshake
+	// and waiting for response headers or the next chunk of the body. RequestTimeout bounds the whole request.
+	ConnectTimeout time.Duration
+	TLSTimeout     time.Duration
+	ReadTimeout    time.Duration
+	RequestTimeout time.Duration
+	// Store keeps the crawled pages, main opens it with -store
+	Store PageStore
+	// Catalog maps the storage keys back to their URLs, nil to keep none
+	Catalog *Catalog
+	// Snapshots keeps the old versions of the pages, nil to keep none
+	Snapshots PageStore
+	// SnapshotRetention is the number of snapshots kept per page, 0 turns snapshots off
+	SnapshotRetention int
+	// Scope holds the seeds and decides which discovered URLs are followed
+	Scope *CrawlScope
+	// StripParams are query parameters removed before URLs are deduplicated, "utm_*" matches a prefix
+	StripParams []string
+	// Resume continues the crawl recorded in the frontier log instead of starting over
+	Resume bool
+	// MinHostDelay is the smallest pause between two requests to the same host,
+	// a larger robots.txt Crawl-delay takes precedence
+	MinHostDelay time.Duration
+	// MaxHostDelay caps how far the scheduler backs off a slow or overloaded host
+	MaxHostDelay time.Duration
+	// MaxHostConns is the number of concurrent requests allowed per host
+	MaxHostConns int
+	// MaxPages stops the crawl after that many pages, 0 means no limit
+	MaxPages int
+	// MaxPagesPerHost stops fetching from a host after that many pages, 0 means no limit
+	MaxPagesPerHost int
+	// MaxDepth is the number of links followed from a seed, 0 means no limit
+	MaxDepth int
+	// Refresh revalidates already stored pages with If-None-Match/If-Modified-Since
+	// instead of reusing the stored copy
+	Refresh bool
+	// FollowLinks queues the links of fetched pages, recrawl rounds turn it off
+	FollowLinks bool
+	// RecrawlBudget caps how many pages one recrawl round fetches
+	RecrawlBudget int
+	// MinRecrawlInterval and MaxRecrawlInterval bound the planned time between two visits of a page
+	MinRecrawlInterval time.Duration
+	MaxRecrawlInterval time.Duration
+	// MaxRetries is how often a transient fetch failure (timeout, reset, 5xx, 429) is retried
+	MaxRetries int
+	// RetryBaseDelay doubles with every retry up to MaxRetryDelay, with random jitter
+	RetryBaseDelay time.Duration
+	MaxRetryDelay  time.Duration
+	// MaxRedirects is the number of redirect hops followed before a fetch fails
+	MaxRedirects int
+	// CrawlLogMaxSize is the size in bytes at which the crawl log is rotated (0 = never)
+	CrawlLogMaxSize int64
+	// CrawlLogFiles is the number of rotated crawl logs kept
+	CrawlLogFiles int
+	// ControlAddr is the address of the control API and the Prometheus /metrics endpoint during a crawl, empty to disable them
+	ControlAddr string
+	// Workers is the number of workers the crawl starts with, the control API can change it
+	Workers int
+	// Wait keeps the crawl running once its frontier is exhausted, until it is stopped through the control API
+	Wait bool
+	// StartPaused starts the workers paused, the crawl begins when resumed through the control API
+	StartPaused bool
+	// WARCDir is the directory the fetched pages are archived to as WARC files, empty to disable archiving
+	WARCDir string
+	// WARCMaxSize is the compressed size in bytes after which a new WARC file is started (0 = never)
+	WARCMaxSize int64
+	// MaxBodySize is the number of bytes stored per page, longer bodies are cut off
+	// and flagged as truncated. 0 means no limit.
+	MaxBodySize int64
+}
+
+func DefaultCrawlConfig() CrawlConfig {
+	scope, _ := BuildCrawlScope("", CrawlScope{})
+	return CrawlConfig{
+		UserAgent: DefaultUserAgent,
+		Headers: http.Header{
+			"Accept":          {"text/html,application/xhtml+xml,text/plain;q=0.9,application/pdf;q=0.8,*/*;q=0.5"},
+			"Accept-Language": {"fa,en;q=0.8"},
+		},
+		ConnectTimeout: 5 * time.Second,
+		TLSTimeout:     5 * time.Second,
+		ReadTimeout:    15 * time.Second,
+		RequestTimeout: 2 * time.Minute,
+
+		Scope:        scope,
+		StripParams:  helpers.DefaultStripParams,
+		MinHostDelay: time.Second,
+		MaxHostDelay: time.Minute,
+		MaxHostConns: 2,
+		MaxPages:     MaxUrlCrawl,
+		FollowLinks:  true,
+
+		RecrawlBudget:      500,
+		MinRecrawlInterval: time.Hour,
+		MaxRecrawlInterval: 30 * 24 * time.Hour,
+		SnapshotRetention:  10,
+
+		MaxRetries:      3,
+		RetryBaseDelay:  2 * time.Second,
+		MaxRetryDelay:   time.Minute,
+		MaxRedirects:    10,
+		MaxBodySize:     10 << 20,
+		ControlAddr:     "localhost:9464",
+		CrawlLogMaxSize: 64 << 20,
+		CrawlLogFiles:   5,
+		WARCMaxSize:     1 << 30,
+		Workers:         CrawlerCount,
+	}
+}
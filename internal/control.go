@@ -0,0 +1,395 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"crawler/models"
+)
+
+// MaxWorkers caps the worker count that can be set through the control API
+const MaxWorkers = 1_000
+
+// pendingWork counts the entries sitting in the queue or being processed, plus the running producers
+// (seed, sitemap and resume feeders). The crawl has run out of work once it drops to zero.
+var pendingWork atomic.Int64
+
+// crawlControl is the state the control API changes while the crawl runs
+var crawlControl = struct {
+	lock sync.Mutex
+	// resumed is closed when a paused crawl continues, nil while running
+	resumed chan struct{}
+	// workers holds a quit channel per running worker
+	workers []chan struct{}
+	// lastWorkerID numbers the workers for the crawl log
+	lastWorkerID int
+	// waiter tracks the workers and producers. Goroutines are only added to it while holding
+	// lock and before draining is set, which runCrawl does before it waits for them.
+	waiter   *sync.WaitGroup
+	draining bool
+	// changed is closed and replaced whenever the state changes, for the event stream
+	changed   chan struct{}
+	startedAt time.Time
+}{changed: make(chan struct{})}
+
+// startWork registers one more entry or producer
+func startWork() {
+	pendingWork.Add(1)
+}
+
+// finishWork marks an entry or producer as done. When nothing is left the crawl ends,
+// unless it was told to wait for more seeds.
+func finishWork() {
+	if pendingWork.Add(-1) == 0 {
+		if !crawlConfig.Wait {
+			stopCrawl("frontier exhausted")
+		}
+		notifyChange()
+	}
+}
+
+// queueEntry hands an entry to the workers without blocking, it returns false if the crawl stopped first
+func queueEntry(entry models.FrontierEntry) bool {
+	if crawlStopped() {
+		return false
+	}
+	startWork()
+	queue.push(entry)
+	return true
+}
+
+func notifyChange() {
+	crawlControl.lock.Lock()
+	close(crawlControl.changed)
+	crawlControl.changed = make(chan struct{})
+	crawlControl.lock.Unlock()
+}
+
+func stateChanged() <-chan struct{} {
+	crawlControl.lock.Lock()
+	defer crawlControl.lock.Unlock()
+	return crawlControl.changed
+}
+
+// pauseCrawl stops the workers from taking new entries, the ones being processed are finished
+func pauseCrawl() {
+	crawlControl.lock.Lock()
+	if crawlControl.resumed == nil {
+		crawlControl.resumed = make(chan struct{})
+	}
+	crawlControl.lock.Unlock()
+	notifyChange()
+}
+
+func resumeCrawl() {
+	crawlControl.lock.Lock()
+	if crawlControl.resumed != nil {
+		close(crawlControl.resumed)
+		crawlControl.resumed = nil
+	}
+	crawlControl.lock.Unlock()
+	notifyChange()
+}
+
+// waitWhilePaused blocks while the crawl is paused. It returns false if the worker has to quit instead.
+func waitWhilePaused(quit <-chan struct{}) bool {
+	crawlControl.lock.Lock()
+	resumed := crawlControl.resumed
+	crawlControl.lock.Unlock()
+	if resumed == nil {
+		return true
+	}
+	select {
+	case <-resumed:
+		return true
+	case <-quit:
+		return false
+	case <-crawlStop:
+		return false
+	}
+}
+
+// setWorkers starts or retires workers until count of them run. Retired workers finish their current entry first.
+func setWorkers(count int) error {
+	if count < 1 || count > MaxWorkers {
+		return fmt.Errorf("worker count must be between 1 and %d", MaxWorkers)
+	}
+	crawlControl.lock.Lock()
+	defer crawlControl.lock.Unlock()
+	if crawlStopped() || crawlControl.draining {
+		return fmt.Errorf("the crawl is stopping")
+	}
+	for len(crawlControl.workers) < count {
+		quit := make(chan struct{})
+		crawlControl.workers = append(crawlControl.workers, quit)
+		crawlControl.lastWorkerID++
+		id := crawlControl.lastWorkerID
+		crawlControl.waiter.Go(func() { runWorker(id, quit) })
+	}
+	for len(crawlControl.workers) > count {
+		last := len(crawlControl.workers) - 1
+		close(crawlControl.workers[last])
+		crawlControl.workers = crawlControl.workers[:last]
+	}
+	return nil
+}
+
+func workerCount() int {
+	crawlControl.lock.Lock()
+	defer crawlControl.lock.Unlock()
+	return len(crawlControl.workers)
+}
+
+// runWorker processes queued entries until the crawl stops or the worker is retired
+func runWorker(id int, quit <-chan struct{}) {
+	// Stagger the start so new workers don't all hit the hosts at once
+	select {
+	case <-time.After(time.Duration(rand.IntN(3000)) * time.Millisecond):
+	case <-quit:
+		return
+	case <-crawlStop:
+		return
+	}
+	for waitWhilePaused(quit) {
+		entry, ok := queue.pop(quit)
+		if !ok {
+			return
+		}
+		busyWorkers.Inc()
+		if processEntry(entry, id) {
+			frontier.markDone(entry.URL)
+		}
+		busyWorkers.Dec()
+		finishWork()
+	}
+}
+
+// crawlStatus is the progress reported by the status endpoint and the event stream
+type crawlStatus struct {
+	// State is running, paused, idle (waiting for seeds) or stopped
+	State       string    `json:"state"`
+	StopReason  string    `json:"stop_reason,omitempty"`
+	StartedAt   time.Time `json:"started_at"`
+	Uptime      float64   `json:"uptime_seconds"`
+	Workers     int       `json:"workers"`
+	BusyWorkers int64     `json:"busy_workers"`
+	Queued      int       `json:"queued"`
+	PendingWork int64     `json:"pending_work"`
+	Pages       int       `json:"pages"`
+	Total       uint64    `json:"total"`
+	OK          uint64    `json:"ok"`
+	Failed      uint64    `json:"failed"`
+	Garbage     uint64    `json:"garbage"`
+	Blocked     uint64    `json:"blocked"`
+	Unchanged   uint64    `json:"unchanged"`
+	Truncated   uint64    `json:"truncated"`
+}
+
+func currentStatus() crawlStatus {
+	crawlControl.lock.Lock()
+	paused := crawlControl.resumed != nil
+	startedAt := crawlControl.startedAt
+	crawlControl.lock.Unlock()
+	crawlBudget.lock.Lock()
+	pages := crawlBudget.pages
+	crawlBudget.lock.Unlock()
+
+	status := crawlStatus{
+		State:       "running",
+		StartedAt:   startedAt,
+		Uptime:      time.Since(startedAt).Seconds(),
+		Workers:     workerCount(),
+		BusyWorkers: busyWorkers.Load(),
+		Queued:      queue.len(),
+		PendingWork: pendingWork.Load(),
+		Pages:       pages,
+		Total:       totalCounter.Load(),
+		OK:          okCounter.Load(),
+		Failed:      failCounter.Load(),
+		Garbage:     garbageCounter.Load(),
+		Blocked:     blockedCounter.Load(),
+		Unchanged:   unchangedCounter.Load(),
+		Truncated:   truncatedCounter.Load(),
+	}
+	switch {
+	case crawlStopped():
+		status.State, status.StopReason = "stopped", stopReason
+	case paused:
+		status.State = "paused"
+	case status.PendingWork == 0:
+		status.State = "idle"
+	}
+	return status
+}
+
+// serveControl serves the control API and the metrics on addr until the returned function is called.
+// An empty addr disables both.
+//
+//	GET  /crawl/status   progress as JSON
+//	GET  /crawl/events   progress as server-sent events, on every change and at least once a second
+//	POST /crawl/pause    stop taking new entries from the queue
+//	POST /crawl/resume   continue a paused crawl, /crawl/start does the same for a crawl started with -paused
+//	POST /crawl/stop     end the crawl gracefully, the frontier stays resumable
+//	POST /crawl/seeds    {"urls": [...]} adds seeds, their hosts join the scope
+//	POST /crawl/workers  {"count": n} changes the number of workers
+//	GET  /metrics        Prometheus metrics
+func serveControl(addr string) (stop func()) {
+	if addr == "" {
+		return func() {}
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		fmt.Println("Could not start the control API:", err)
+		return func() {}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", handleMetrics)
+	mux.HandleFunc("GET /crawl/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, currentStatus())
+	})
+	mux.HandleFunc("GET /crawl/events", handleEvents)
+	mux.HandleFunc("POST /crawl/pause", func(w http.ResponseWriter, r *http.Request) {
+		pauseCrawl()
+		writeJSON(w, currentStatus())
+	})
+	resume := func(w http.ResponseWriter, r *http.Request) {
+		resumeCrawl()
+		writeJSON(w, currentStatus())
+	}
+	mux.HandleFunc("POST /crawl/resume", resume)
+	mux.HandleFunc("POST /crawl/start", resume)
+	mux.HandleFunc("POST /crawl/stop", func(w http.ResponseWriter, r *http.Request) {
+		stopCrawl("stopped through the control API")
+		notifyChange()
+		writeJSON(w, currentStatus())
+	})
+	mux.HandleFunc("POST /crawl/seeds", handleSeeds)
+	mux.HandleFunc("POST /crawl/workers", func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Count int `json:"count"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := setWorkers(request.Count); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		notifyChange()
+		writeJSON(w, currentStatus())
+	})
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go server.Serve(listener)
+	fmt.Printf("Control API and metrics are served on http://%s/\n", listener.Addr())
+	return func() {
+		// Event streams end with the crawl, so shutting down does not wait long
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}
+}
+
+// goWhileCrawling runs producer as pending work of the crawl, it returns false if the crawl
+// is stopping and producer was not started
+func goWhileCrawling(producer func()) bool {
+	crawlControl.lock.Lock()
+	defer crawlControl.lock.Unlock()
+	if crawlStopped() || crawlControl.draining {
+		return false
+	}
+	startWork()
+	crawlControl.waiter.Go(func() {
+		defer finishWork()
+		producer()
+	})
+	return true
+}
+
+// drainWorkers waits until the crawl stopped and every worker and producer is done
+func drainWorkers() {
+	<-crawlStop
+	crawlControl.lock.Lock()
+	crawlControl.draining = true
+	waiter := crawlControl.waiter
+	crawlControl.lock.Unlock()
+	waiter.Wait()
+}
+
+// handleSeeds queues the posted seeds and reports which were accepted
+func handleSeeds(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		URLs []string `json:"urls"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if crawlStopped() {
+		http.Error(w, "the crawl is stopping", http.StatusConflict)
+		return
+	}
+	response := struct {
+		Queued   []string          `json:"queued"`
+		Rejected map[string]string `json:"rejected,omitempty"`
+	}{Queued: []string{}, Rejected: map[string]string{}}
+	for _, rawURL := range request.URLs {
+		seed, err := addSeed(rawURL)
+		if err != nil {
+			response.Rejected[rawURL] = err.Error()
+			continue
+		}
+		// robots.txt and the sitemaps are fetched next to the workers, not while the client waits
+		if !goWhileCrawling(func() {
+			if enqueue(models.FrontierEntry{URL: seed}, nil) {
+				seedFromSitemaps(seed)
+			}
+		}) {
+			response.Rejected[rawURL] = "the crawl is stopping"
+			continue
+		}
+		response.Queued = append(response.Queued, seed)
+	}
+	writeJSON(w, response)
+}
+
+// handleEvents streams the crawl status as server-sent events until the crawl stops or the client leaves
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		changed := stateChanged()
+		status := currentStatus()
+		data, err := json.Marshal(status)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "event: status\ndata: %s\n\n", data)
+		flusher.Flush()
+		if status.State == "stopped" {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		case <-changed:
+		case <-crawlStop:
+		}
+	}
+}
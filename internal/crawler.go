@@ -1,18 +1,21 @@
 package internal
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/base32"
 	"fmt"
 	"io"
-	"math/rand/v2"
 	"net/http"
-	"os"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"crawler/helpers"
+	"crawler/models"
 
 	"golang.org/x/net/html"
 )
@@ -25,132 +28,619 @@ const (
 
 var (
 	URLtoFilename  func(string) string
-	totalCounter   uint32 = 0
-	okCounter      uint32 = 0
-	failCounter    uint32 = 0
-	garbageCounter uint32 = 0
-	client         *http.Client
-	safeSet        *helpers.SafeSet
-	queue          chan string
+	totalCounter   = newCounter("crawler_urls_total", "URLs added to the frontier")
+	okCounter      = newCounter("crawler_pages_ok_total", "Pages fetched or read from storage")
+	failCounter    = newCounter("crawler_pages_failed_total", "Pages that could not be fetched or parsed")
+	garbageCounter = newCounter("crawler_pages_garbage_total", "Pages skipped for their content type")
+	blockedCounter = newCounter("crawler_urls_blocked_total", "URLs disallowed by robots.txt")
+	// unchangedCounter counts refreshed pages the server answered with 304 Not Modified
+	unchangedCounter = newCounter("crawler_pages_unchanged_total", "Refreshed pages that did not change")
+	// truncatedCounter counts pages whose body was cut off at MaxBodySize
+	truncatedCounter = newCounter("crawler_pages_truncated_total", "Pages cut off at the maximum body size")
+	crawlConfig      CrawlConfig
+	fetcher          *Fetcher
+	pageStore        PageStore
+	urlNormalizer    *helpers.URLNormalizer
+	safeSet          *helpers.SafeSet
+	queue            *entryQueue
 )
 
 func init() {
 	// Internal Data structures
-	queue = make(chan string, 11_000)
+	crawlConfig = DefaultCrawlConfig()
+	urlNormalizer = helpers.NewURLNormalizer(helpers.DefaultStripParams)
+	queue = newEntryQueue()
 	safeSet = helpers.NewSafeSet(11_000)
 	// Internal helper functions
-	base32Encoder := *base32.StdEncoding.WithPadding(base32.NoPadding)
 	URLtoFilename = func(url string) string {
-		hashed := sha256.Sum256([]byte(url))
-		return base32Encoder.EncodeToString(hashed[:]) + ".html"
+		return PageKey(url) + ".html"
 	}
 	// Internal global objects
-	client = &http.Client{
-		Transport: &http.Transport{
-			DisableKeepAlives: true,
-		},
-		Timeout: 5 * time.Second,
+	fetcher, _ = NewFetcher(crawlConfig)
+}
+
+// SetStripParams sets the query parameters removed when URLs are normalized. Storage keys
+// depend on them, so every mode working with stored pages must use the crawl's setting.
+func SetStripParams(params []string) {
+	urlNormalizer = helpers.NewURLNormalizer(params)
+}
+
+// PageKey is the key a URL's page is stored under: the base32 SHA-256 of the normalized URL,
+// so one page never ends up under several keys
+func PageKey(url string) string {
+	if normalized, err := urlNormalizer.Normalize(url); err == nil {
+		url = normalized
 	}
+	hashed := sha256.Sum256([]byte(url))
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(hashed[:])
 }
 
-func StartDownloader() {
-	if _, err := os.Stat("./site"); os.IsNotExist(err) {
-		os.Mkdir("./site", 0755)
-	}
-	queue <- "https://barbadpiano.com/"
-	waiter := sync.WaitGroup{}
-	for range CrawlerCount {
-		time.Sleep(time.Duration(rand.IntN(4)) * time.Second)
-		waiter.Go(func() {
-		startLabel:
-			for url := range queue {
-				filename := "./site/" + URLtoFilename(url)
-				if _, err := os.Stat(filename); os.IsNotExist(err) {
-					resp, err := client.Get(url)
-					startTIme := time.Now()
-					if err != nil || !strings.Contains(resp.Header.Get("Content-Type"), "text/html") {
-						garbageCounter++
-						continue
-					} else {
-						okCounter++
-					}
-					file, fileErr := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0755)
-					if fileErr != nil {
-						fmt.Println("Could not open file for storing", url)
-						continue
-					}
-					data, _ := io.ReadAll(resp.Body)
-					file.Write(data)
-					file.Seek(0, 0)
-					resp.Body.Close()
-
-					// Extract document data from the HTML
-					doc, extractErr := helpers.ExtractDocument(file, url)
-					if extractErr != nil {
-						fmt.Printf("Error extracting document from %s: %s\n", url, extractErr)
-					} else {
-						// Save extracted document as JSON file for later indexing
-						if saveErr := helpers.SaveDocumentJSON(doc, filename); saveErr != nil {
-							fmt.Printf("Error saving document JSON for %s: %s\n", url, saveErr)
-						}
-					}
-
-					file.Seek(0, 0)
-					StartParser(file)
-					file.Close()
-					time.Sleep(5 - time.Duration(time.Since(startTIme).Seconds()))
-				} else {
-					file, _ := os.OpenFile(filename, os.O_RDONLY, 0755)
-					okCounter++
-					StartParser(file)
-					file.Close()
-				}
-				if len(queue) == 0 {
-					time.Sleep(time.Second * 3)
-					if len(queue) != 0 {
-						goto startLabel
-					}
+// StartDownloader crawls until the frontier is exhausted, a budget is used up or ctx is cancelled.
+// On cancellation the pages being processed are finished or rolled back and the frontier is checkpointed.
+func StartDownloader(ctx context.Context, cfg CrawlConfig) {
+	runCrawl(ctx, cfg, nil)
+}
+
+// runCrawl crawls from the configured seeds, or only revisits the given entries when revisit is set
+func runCrawl(ctx context.Context, cfg CrawlConfig, revisit []models.FrontierEntry) {
+	crawlConfig = cfg
+	crawlCtx = ctx
+	pageStore = cfg.Store
+	snapshotStore = cfg.Snapshots
+	catalog = cfg.Catalog
+	stopOnCancel := context.AfterFunc(ctx, func() {
+		fmt.Println("Interrupted, finishing the pages in progress")
+		stopCrawl("interrupted")
+		notifyChange()
+	})
+	defer stopOnCancel()
+	SetStripParams(cfg.StripParams)
+	var err error
+	if fetcher, err = NewFetcher(cfg); err != nil {
+		fmt.Println("Could not set up the fetcher:", err)
+		return
+	}
+	if err := loadAliases(); err != nil {
+		fmt.Println("Could not open the aliases log:", err)
+	}
+	var pending []models.FrontierEntry
+	switch {
+	case revisit != nil:
+		// Revisits are not logged, the frontier log belongs to the regular crawl
+		pending = revisit
+	case crawlConfig.Resume:
+		var err error
+		pending, err = resumeFrontier()
+		if err != nil {
+			fmt.Println("Could not resume the crawl:", err)
+			return
+		}
+		fmt.Printf("Resuming crawl with %d pending URLs (%d already seen)\n", len(pending), totalCounter.Load())
+	default:
+		if err := startFrontier(); err != nil {
+			fmt.Println("Could not create the crawl frontier log:", err)
+			return
+		}
+	}
+	crawlControl.lock.Lock()
+	crawlControl.waiter, crawlControl.draining = &sync.WaitGroup{}, false
+	crawlControl.lock.Unlock()
+	crawlControl.startedAt = time.Now()
+	if crawlConfig.StartPaused {
+		pauseCrawl()
+	}
+	// Seeds added through the control API append to the scope, so work on a copy
+	var seeds []string
+	if revisit == nil {
+		seeds = slices.Clone(crawlConfig.Scope.Seeds)
+	}
+	stopControl := serveControl(cfg.ControlAddr)
+	defer stopControl()
+
+	// Setting up holds a unit of work itself, so the crawl can't run out of work before it started
+	startWork()
+	for _, entry := range pending {
+		if !queueEntry(entry) {
+			break
+		}
+	}
+	if revisit == nil {
+		for _, seed := range seeds {
+			if !enqueue(models.FrontierEntry{URL: seed}, nil) && !crawlConfig.Resume {
+				fmt.Println("Seed is out of scope or disallowed by robots.txt:", seed)
+			}
+		}
+		// Sitemaps are read next to the workers so a slow sitemap host doesn't hold up the crawl
+		goWhileCrawling(func() {
+			for _, seed := range seeds {
+				if crawlStopped() {
 					break
 				}
+				seedFromSitemaps(seed)
 			}
 		})
 	}
+	setWorkers(min(max(crawlConfig.Workers, 1), MaxWorkers))
+	finishWork()
 	fmt.Println("NOW WAITING")
+	ticker := time.NewTicker(time.Second * 3)
 	go func() {
-		ticker := time.NewTicker(time.Second * 3)
 		for range ticker.C {
-			fmt.Printf("TOTAL PARSED URLS: %6d | TOTAL OK URLs: %6d | TOTAL FAILED URLS: %6d | TOTAL GARBAGE URLS: %6d \n", totalCounter, okCounter, failCounter, garbageCounter)
+			frontier.checkpoint()
+			flushCrawlLog()
+			fmt.Printf("TOTAL PARSED URLS: %6d | TOTAL OK URLs: %6d | TOTAL FAILED URLS: %6d | TOTAL GARBAGE URLS: %6d | TOTAL BLOCKED URLS: %6d | TOTAL UNCHANGED URLS: %6d | TOTAL TRUNCATED URLS: %6d \n", totalCounter.Load(), okCounter.Load(), failCounter.Load(), garbageCounter.Load(), blockedCounter.Load(), unchangedCounter.Load(), truncatedCounter.Load())
 		}
 	}()
-	waiter.Wait()
+	drainWorkers()
+	ticker.Stop()
+	frontier.checkpoint()
+	frontier.close()
+	closeAliases()
+	closeCrawlLog()
+	closeWARCFile()
+	fmt.Printf("Crawl stopped: %s (%s)\n", stopReason, budgetReport())
+	fmt.Println("Fetch failures:", failureReport())
+	fmt.Println("Downloaded:", bodyReport())
 	fmt.Println("ALL DONE")
 }
 
-func StartParser(file *os.File) {
-	rootNode, err := html.Parse(file)
+// processEntry fetches one queued URL (or reuses the stored copy), extracts it and queues its links.
+// Every fetch is written to the crawl log under the given worker ID.
+// It returns false if the entry stays pending: the crawl stopped before it could be handled,
+// or it was put back to wait for robots.txt.
+func processEntry(entry models.FrontierEntry, worker int) bool {
+	if crawlStopped() {
+		return false
+	}
+	// robots.txt may have changed since the entry was queued, and revisited pages were never checked
+	if allowed, retryAt := robotsCheck(entry.URL); !allowed {
+		if !retryAt.IsZero() && entry.RobotsRetries < robotsMaxRetries {
+			// robots.txt could not be fetched, ask again once the failure expired
+			entry.RobotsRetries++
+			requeueAfter(entry, retryAt)
+			return false
+		}
+		if !retryAt.IsZero() {
+			// robots.txt stayed unreachable, give up on the entry like on a failed fetch
+			failCounter.Inc()
+			recordFailure(entry.URL, entry.Referrer, &fetchFailure{Kind: FailureRobots, Err: errRobotsUnavailable}, entry.RobotsRetries)
+			return true
+		}
+		blockedCounter.Inc()
+		return true
+	}
+	if parsed, err := url.Parse(entry.URL); err != nil || !reservePage(parsed) {
+		return !crawlStopped()
+	}
+	url := entry.URL
+	key := PageKey(url)
+	stored := pageStore.Exists(key, PartBody)
+	if stored && !crawlConfig.Refresh && !sitemapChangedSince(entry, key) {
+		if file, err := pageStore.Get(key, PartBody); err == nil {
+			okCounter.Inc()
+			meta, _ := loadPageMeta(pageStore, key)
+			tree := parseStoredPage(file, meta.ContentType)
+			directives := readDirectives(tree, url, nil)
+			// meta.NoFollow also covers the X-Robots-Tag of the original response
+			if tree != nil && !directives.NoFollow && !meta.NoFollow {
+				queuePageLinks(tree, url, entry.Depth)
+			}
+			file.Close()
+			return true
+		}
+	}
+
+	// A refresh crawl revalidates stored pages instead of downloading them again
+	meta, metaErr := loadPageMeta(pageStore, key)
+	var validators *models.PageMeta
+	if stored && metaErr == nil {
+		validators = &meta
+	}
+	meta.URL = url
+
+	record := crawlLogRecord{
+		At:       time.Now(),
+		URL:      url,
+		Referrer: entry.Referrer,
+		Depth:    entry.Depth,
+		Worker:   worker,
+		Filename: URLtoFilename(url),
+	}
+	var page *fetchedPage
+	defer func() {
+		if page != nil {
+			record.LatencyMs = float64(page.latency.Microseconds()) / 1000
+		}
+		logFetch(&record)
+	}()
+
+	page, failure, attempts := fetchPage(url, validators)
+	record.Attempts = attempts
+	if failure != nil {
+		record.Status, record.Failure = failure.Status, failure.Kind
+		if failure.Err != nil {
+			record.Error = failure.Err.Error()
+		}
+		if crawlStopped() && (failure.Transient || crawlCtx.Err() != nil) {
+			// Interrupted while waiting for a retry or during the request, leave the entry pending
+			return false
+		}
+		if failure.Kind == FailureContentType {
+			garbageCounter.Inc()
+		} else {
+			failCounter.Inc()
+		}
+		recordFailure(url, entry.Referrer, failure, attempts)
+		return true
+	}
+	resp := page.resp
+	record.Status = resp.StatusCode
+	record.ContentType = resp.Header.Get("Content-Type")
+
+	// A redirected page is stored once under its final URL, the URLs on the way become its aliases
+	if chain, final := redirectChain(resp); len(chain) > 0 {
+		recordAliases(aliasRedirect, chain, final)
+		if final != url {
+			record.FinalURL = final
+			finalKey := PageKey(final)
+			if !safeSet.AddIfNotExists(final) {
+				// The final URL is crawled on its own, only its aliases change
+				page.done()
+				okCounter.Inc()
+				addAliasesToStoredDocument(finalKey, chain)
+				return true
+			}
+			frontier.markDone(final)
+			url, key = final, finalKey
+			record.Filename = URLtoFilename(url)
+			stored = pageStore.Exists(key, PartBody)
+			meta, _ = loadPageMeta(pageStore, key)
+			meta.URL = url
+		}
+	}
+
+	if resp.StatusCode == http.StatusNotModified {
+		page.done()
+		if !stored {
+			recordFailure(url, entry.Referrer, &fetchFailure{Kind: FailureOther, Status: resp.StatusCode}, attempts)
+			failCounter.Inc()
+			return true
+		}
+		okCounter.Inc()
+		unchangedCounter.Inc()
+		meta.FetchedAt = time.Now()
+		meta.Status = resp.StatusCode
+		if etag := resp.Header.Get("ETag"); etag != "" {
+			meta.ETag = etag
+		}
+		recordVisit(&meta, "", meta.FetchedAt)
+		unlock := lockPage(key)
+		if saveErr := saveFetchedMeta(key, &meta); saveErr != nil {
+			fmt.Printf("Error saving page meta for %s: %s\n", url, saveErr)
+		}
+		unlock()
+		catalogPage(catalog, key, entry.URL, meta, nil)
+		// Unchanged: skip extraction, only follow the links of the stored copy
+		if crawlConfig.FollowLinks && hasLinks(meta.ContentType) && !meta.NoFollow {
+			if file, err := pageStore.Get(key, PartBody); err == nil {
+				record.NewLinks = StartParser(file, url, meta.ContentType, entry.Depth)
+				file.Close()
+			}
+		}
+		return true
+	}
+
+	body, bodyErr := storeBody(resp.Body, key)
+	page.done()
+	record.Bytes = body.size
+	if bodyErr != nil {
+		record.Error = bodyErr.Error()
+	}
+	if bodyErr != nil && crawlCtx.Err() != nil {
+		// Interrupted during the download: the partial body is gone, the entry stays pending
+		return false
+	}
+	if bodyErr != nil {
+		// The body broke off halfway, a previously stored copy stays as it was
+		failCounter.Inc()
+		recordFailure(url, entry.Referrer, classifyError(bodyErr), attempts)
+		return true
+	}
+	okCounter.Inc()
+	recordBody(page.hostName, url, body)
+	if body.truncated {
+		truncatedCounter.Inc()
+	}
+	if warcErr := archiveFetch(resp, key, body, record.At); warcErr != nil {
+		fmt.Printf("Error archiving %s: %s\n", url, warcErr)
+	}
+	file, fileErr := pageStore.Get(key, PartBody)
+	if fileErr != nil {
+		fmt.Println("Could not open stored file", url)
+		return true
+	}
+	// Same bytes as last time: nothing to extract again
+	sameBody := stored && meta.BodyHash == body.hash
+
+	contentType := resp.Header.Get("Content-Type")
+	// HTML is parsed once here, for the directives, the document, the main text and the links
+	tree := parseStoredPage(file, contentType)
+	directives := readDirectives(tree, url, resp.Header.Values("X-Robots-Tag"))
+	if directives.Canonical != "" {
+		// Merge this variant into the canonical document, which is crawled in its own right
+		recordAliases(aliasCanonical, []string{url}, directives.Canonical)
+		addAliasesToStoredDocument(PageKey(directives.Canonical), []string{url})
+		if crawlConfig.FollowLinks && enqueue(models.FrontierEntry{URL: directives.Canonical, Depth: entry.Depth, Referrer: url}, nil) {
+			record.NewLinks++
+		}
+	} else {
+		forgetAlias(url)
+	}
+
+	// Extract document data with the extractor of the content type, fetchPage made sure there is one
+	var doc models.Document
+	var extractErr error
+	if !sameBody {
+		var ok bool
+		if doc, ok = helpers.ExtractParsed(tree, url, contentType); !ok {
+			extract, _ := helpers.ExtractorFor(contentType)
+			file.Seek(0, 0)
+			doc, extractErr = extract(file, url, contentType)
+		}
+	}
+	record.Extracted = !sameBody && extractErr == nil
+	if extractErr != nil {
+		record.Error = extractErr.Error()
+		fmt.Printf("Error extracting document from %s: %s\n", url, extractErr)
+	}
+
+	meta.ETag = resp.Header.Get("ETag")
+	meta.LastModified = resp.Header.Get("Last-Modified")
+	meta.FetchedAt = time.Now()
+	meta.Status = resp.StatusCode
+	meta.ContentType = contentType
+	meta.BodyHash = body.hash
+	meta.Size = body.size
+	meta.Truncated = body.truncated
+	if !sameBody {
+		meta.NeedsReindex = extractErr == nil
+	}
+	meta.NoIndex = directives.NoIndex
+	meta.NoFollow = directives.NoFollow
+	meta.Canonical = directives.Canonical
+	text, textErr := doc.Body, extractErr
+	if sameBody {
+		unchangedCounter.Inc()
+	} else if tree != nil {
+		text, textErr = tree.MainText(), nil
+	}
+	if textErr == nil {
+		hash := ""
+		if !sameBody {
+			hash = helpers.TextHash(text)
+			if stored && hash == meta.ContentHash {
+				// Different bytes, e.g. a rotating ad, but the same main text
+				unchangedCounter.Inc()
+			}
+			// The page stays in its duplicate cluster as long as its fingerprint is the same
+			if !setFingerprint(&meta, text) {
+				doc.ClusterID = meta.ClusterID
+			}
+		}
+		recordVisit(&meta, hash, meta.FetchedAt)
+	}
+	unlock := lockPage(key)
+	if extractErr == nil && !sameBody {
+		// Save extracted document for later indexing, with every alias known by now
+		doc.Aliases = aliasesOf(url)
+		if saveErr := saveDocument(pageStore, key, doc); saveErr != nil {
+			fmt.Printf("Error saving document JSON for %s: %s\n", url, saveErr)
+		}
+		if snapErr := takeSnapshot(key, &meta, doc, meta.FetchedAt); snapErr != nil {
+			fmt.Printf("Error keeping a snapshot of %s: %s\n", url, snapErr)
+		}
+	}
+	if saveErr := saveFetchedMeta(key, &meta); saveErr != nil {
+		fmt.Printf("Error saving page meta for %s: %s\n", url, saveErr)
+	}
+	unlock()
+	if record.Extracted {
+		catalogPage(catalog, key, entry.URL, meta, &doc)
+	} else {
+		catalogPage(catalog, key, entry.URL, meta, nil)
+	}
+
+	if crawlConfig.FollowLinks && tree != nil && !directives.NoFollow {
+		record.NewLinks += queuePageLinks(tree, url, entry.Depth)
+	}
+	file.Close()
+	return true
+}
+
+// hasLinks reports whether pages of a content type are HTML whose links are followed.
+// Pages stored before the content type was recorded are HTML.
+func hasLinks(contentType string) bool {
+	return contentType == "" || helpers.IsHTML(contentType)
+}
+
+// fetchedPage is a successful response whose body is still to be read,
+// done must be called afterwards to free the host's connection slot
+type fetchedPage struct {
+	resp *http.Response
+	host *hostSchedule
+	// hostName is the lowercase host the request was sent to, before any redirects,
+	// the host its in-flight gauge was raised for and its latency is charged to
+	hostName string
+	started  time.Time
+	// latency is the time from sending the request until done was called
+	latency time.Duration
+}
+
+func (p *fetchedPage) done() {
+	p.resp.Body.Close()
+	latency := time.Since(p.started)
+	p.latency = latency
+	p.host.release(p.resp.StatusCode, latency, p.resp.Header.Get("Retry-After"))
+	hostInFlight.With(p.hostName).Dec()
+	hostFetchDuration.With(p.hostName).Observe(latency.Seconds())
+	hostResponses.With(p.hostName, strconv.Itoa(p.resp.StatusCode)).Inc()
+}
+
+// fetchPage GETs a page of a type there is an extractor for, retrying transient failures with exponential backoff.
+// With validators set the request is conditional and may come back as 304 Not Modified.
+// It returns the page or the last failure, and the number of attempts made.
+func fetchPage(url string, validators *models.PageMeta) (*fetchedPage, *fetchFailure, int) {
+	var failure *fetchFailure
+	attempt := 0
+	for ; attempt <= crawlConfig.MaxRetries; attempt++ {
+		if attempt > 0 {
+			recordRetry()
+			select {
+			case <-time.After(retryDelay(attempt - 1)):
+			case <-crawlStop:
+				return nil, failure, attempt
+			}
+		}
+
+		req, err := fetcher.NewRequest(url)
+		if err != nil {
+			return nil, &fetchFailure{Kind: FailureOther, Err: err}, attempt + 1
+		}
+		req = withPageFetch(req.WithContext(crawlCtx))
+		if validators != nil {
+			if validators.ETag != "" {
+				req.Header.Set("If-None-Match", validators.ETag)
+			}
+			if validators.LastModified != "" {
+				req.Header.Set("If-Modified-Since", validators.LastModified)
+			}
+		}
+
+		host := hostScheduleFor(req.URL)
+		if err := host.acquire(crawlCtx); err != nil {
+			// Stopped while waiting for the host, processEntry leaves the entry pending
+			return nil, &fetchFailure{Kind: FailureOther, Err: err, Transient: true}, attempt
+		}
+		hostName := strings.ToLower(req.URL.Host)
+		hostInFlight.With(hostName).Inc()
+		started := time.Now()
+		resp, err := fetcher.Do(req)
+		if err != nil {
+			host.release(0, time.Since(started), "")
+			hostInFlight.With(hostName).Dec()
+			failure = classifyError(err)
+			hostFetchErrors.With(hostName, string(failure.Kind)).Inc()
+			if failure.Transient || (failure.Kind == FailureTruncated && attempt == 0) {
+				continue
+			}
+			return nil, failure, attempt + 1
+		}
+
+		page := &fetchedPage{resp: resp, host: host, hostName: hostName, started: started}
+		if failure = classifyStatus(resp.StatusCode); failure != nil {
+			page.done()
+			if failure.Transient {
+				continue
+			}
+			return nil, failure, attempt + 1
+		}
+		contentType := resp.Header.Get("Content-Type")
+		if _, ok := helpers.ExtractorFor(contentType); resp.StatusCode != http.StatusNotModified && !ok {
+			page.done()
+			return nil, &fetchFailure{Kind: FailureContentType, Status: resp.StatusCode, Err: fmt.Errorf("unsupported content type %q", contentType)}, attempt + 1
+		}
+		return page, nil, attempt + 1
+	}
+	return nil, failure, attempt
+}
+
+// StartParser queues the links of a stored page, resolving them against pageURL.
+// contentType is the header the page was served with, it may name the page's charset.
+// depth is the depth of the page itself, its links end up one level deeper.
+// It returns the number of links that were new to the crawl.
+func StartParser(r io.Reader, pageURL, contentType string, depth int) int {
+	page, err := helpers.ParseHTMLPage(r, contentType)
 	if err != nil {
-		fmt.Printf("BIG ERROR: %s\nFilename: %s\n", err.Error(), file.Name())
-		file.Close()
-		failCounter++
+		fmt.Printf("BIG ERROR: %s\nURL: %s\n", err.Error(), pageURL)
+		failCounter.Inc()
+		return 0
 	}
-	chainParser(rootNode)
+	return queuePageLinks(page, pageURL, depth)
 }
 
-func chainParser(node *html.Node) {
-	if node.Type == html.ElementNode && node.Data == "a" {
+// queuePageLinks queues the links of a parsed page, see StartParser
+func queuePageLinks(page *helpers.HTMLPage, pageURL string, depth int) int {
+	rootNode := page.Root
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return 0
+	}
+	if href := findBaseHref(rootNode); href != "" {
+		if resolved, err := base.Parse(href); err == nil {
+			base = resolved
+		}
+	}
+	return chainParser(rootNode, base, pageURL, depth+1)
+}
+
+// findBaseHref returns the href of the first <base> element, if any
+func findBaseHref(node *html.Node) string {
+	if node.Type == html.ElementNode && node.Data == "base" {
 		for _, attr := range node.Attr {
 			if attr.Key == "href" {
-				data := strings.Split(strings.TrimSpace(attr.Val), "#")[0]
-				if strings.HasPrefix(data, "https://") && strings.Contains(data, "barbadpiano.com") {
-					if ok := safeSet.AddIfNotExists(data); ok {
-						totalCounter++
-						queue <- data
-					}
-				}
+				return strings.TrimSpace(attr.Val)
 			}
 		}
 	}
 	for c := node.FirstChild; c != nil; c = c.NextSibling {
-		chainParser(c)
+		if href := findBaseHref(c); href != "" {
+			return href
+		}
+	}
+	return ""
+}
+
+// chainParser queues the links below node and returns how many of them were new
+func chainParser(node *html.Node, base *url.URL, referrer string, depth int) int {
+	queued := 0
+	if node.Type == html.ElementNode && node.Data == "a" && !helpers.IsNoFollowLink(attribute(node, "rel")) {
+		for _, attr := range node.Attr {
+			if attr.Key == "href" && strings.TrimSpace(attr.Val) != "" &&
+				enqueue(models.FrontierEntry{URL: attr.Val, Depth: depth, Referrer: referrer}, base) {
+				queued++
+			}
+		}
+	}
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		queued += chainParser(c, base, referrer, depth)
+	}
+	return queued
+}
+
+// enqueue normalizes the entry's URL (resolving it against base when given) and adds it to the queue
+// unless it is out of scope, was seen before or robots.txt disallows it. It returns true if the entry was queued.
+func enqueue(entry models.FrontierEntry, base *url.URL) bool {
+	normalized, err := urlNormalizer.Resolve(base, entry.URL)
+	if err != nil {
+		return false
+	}
+	entry.URL = normalized
+	if !depthAllowed(entry.Depth) || !inScope(entry.URL) || safeSet.Exists(entry.URL) {
+		return false
+	}
+	// An entry whose robots.txt could not be fetched is queued all the same, processEntry waits for a verdict
+	if allowed, retryAt := robotsCheck(entry.URL); !allowed && retryAt.IsZero() {
+		// Remember blocked URLs so they are only counted once
+		safeSet.Add(entry.URL)
+		blockedCounter.Inc()
+		return false
+	}
+	if ok := safeSet.AddIfNotExists(entry.URL); !ok {
+		return false
 	}
+	totalCounter.Inc()
+	frontier.add(entry)
+	// If the crawl stops first the entry is still recorded in the frontier log, a resumed crawl picks it up
+	queueEntry(entry)
+	return true
 }
@@ -0,0 +1,248 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// crawlLogFile is the current crawl log in crawlStateDir, rotated files get a .1, .2, ... suffix (.1 is the newest)
+const crawlLogFile = "crawl.jsonl"
+
+// crawlLogRecord is one line of the crawl log, written for every page fetch
+type crawlLogRecord struct {
+	At       time.Time `json:"at"`
+	URL      string    `json:"url"`
+	FinalURL string    `json:"final_url,omitempty"`
+	Referrer string    `json:"referrer,omitempty"`
+	Depth    int       `json:"depth"`
+	// Status is 0 when no response arrived
+	Status      int     `json:"status"`
+	ContentType string  `json:"content_type,omitempty"`
+	Bytes       int64   `json:"bytes"`
+	LatencyMs   float64 `json:"latency_ms"`
+	Attempts    int     `json:"attempts"`
+	Worker      int     `json:"worker"`
+	// Filename is the storage name from URLtoFilename
+	Filename  string      `json:"filename"`
+	Extracted bool        `json:"extracted"`
+	NewLinks  int         `json:"new_links"`
+	Failure   FailureKind `json:"failure,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+var crawlLog = struct {
+	lock   sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	size   int64
+}{}
+
+// logFetch appends a record to the crawl log, rotating it once it grows past CrawlLogMaxSize
+func logFetch(record *crawlLogRecord) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+
+	crawlLog.lock.Lock()
+	defer crawlLog.lock.Unlock()
+	if crawlLog.file == nil {
+		if err := openCrawlLog(); err != nil {
+			fmt.Println("Could not open the crawl log:", err)
+			return
+		}
+	}
+	if max := crawlConfig.CrawlLogMaxSize; max > 0 && crawlLog.size > 0 && crawlLog.size+int64(len(data)) > max {
+		if err := rotateCrawlLog(); err != nil {
+			fmt.Println("Could not rotate the crawl log:", err)
+			return
+		}
+	}
+	n, _ := crawlLog.writer.Write(data)
+	crawlLog.size += int64(n)
+}
+
+func openCrawlLog() error {
+	os.MkdirAll(crawlStateDir, 0755)
+	file, err := os.OpenFile(filepath.Join(crawlStateDir, crawlLogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	crawlLog.file, crawlLog.writer, crawlLog.size = file, bufio.NewWriter(file), info.Size()
+	return nil
+}
+
+// rotateCrawlLog shifts the rotated files up by one, dropping the oldest beyond CrawlLogFiles, and starts a new log
+func rotateCrawlLog() error {
+	crawlLog.writer.Flush()
+	crawlLog.file.Close()
+	crawlLog.file = nil
+	path := filepath.Join(crawlStateDir, crawlLogFile)
+	keep := crawlConfig.CrawlLogFiles
+	os.Remove(fmt.Sprintf("%s.%d", path, keep))
+	for i := keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+	}
+	if keep > 0 {
+		if err := os.Rename(path, path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(path); err != nil {
+		return err
+	}
+	return openCrawlLog()
+}
+
+func flushCrawlLog() {
+	crawlLog.lock.Lock()
+	defer crawlLog.lock.Unlock()
+	if crawlLog.writer != nil {
+		crawlLog.writer.Flush()
+	}
+}
+
+func closeCrawlLog() {
+	crawlLog.lock.Lock()
+	defer crawlLog.lock.Unlock()
+	if crawlLog.file != nil {
+		crawlLog.writer.Flush()
+		crawlLog.file.Close()
+		crawlLog.file, crawlLog.writer = nil, nil
+	}
+}
+
+// CrawlLogQuery filters the crawl log, zero fields match everything
+type CrawlLogQuery struct {
+	// Statuses are status codes ("404"), classes ("5xx") or "error" for fetches without a response
+	Statuses []string
+	// Host matches the host of the URL or the final URL
+	Host  string
+	Since time.Time
+	// Until is exclusive, fetches at or after it are left out
+	Until time.Time
+}
+
+func (q CrawlLogQuery) matches(record crawlLogRecord) bool {
+	if !q.Since.IsZero() && record.At.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !record.At.Before(q.Until) {
+		return false
+	}
+	if q.Host != "" && !strings.EqualFold(hostLabel(record.URL), q.Host) &&
+		(record.FinalURL == "" || !strings.EqualFold(hostLabel(record.FinalURL), q.Host)) {
+		return false
+	}
+	if len(q.Statuses) == 0 {
+		return true
+	}
+	code := strconv.Itoa(record.Status)
+	for _, status := range q.Statuses {
+		switch status = strings.ToLower(status); {
+		case status == "error" && record.Status == 0,
+			status == code,
+			len(status) == 3 && strings.HasSuffix(status, "xx") && record.Status != 0 && status[0] == code[0]:
+			return true
+		}
+	}
+	return false
+}
+
+// QueryCrawlLog writes the records of the crawl log that match the query to w, oldest first.
+// It returns the number of matching and of scanned records.
+func QueryCrawlLog(query CrawlLogQuery, w io.Writer) (matched, scanned int, err error) {
+	path := filepath.Join(crawlStateDir, crawlLogFile)
+	rotated, _ := filepath.Glob(path + ".*")
+	// The highest suffix is the oldest file
+	numbered := make(map[int]string)
+	oldest := 0
+	for _, file := range rotated {
+		if n, err := strconv.Atoi(strings.TrimPrefix(file, path+".")); err == nil && n > 0 {
+			numbered[n] = file
+			oldest = max(oldest, n)
+		}
+	}
+	var files []string
+	for n := oldest; n >= 1; n-- {
+		if file, ok := numbered[n]; ok {
+			files = append(files, file)
+		}
+	}
+	files = append(files, path)
+
+	for _, name := range files {
+		file, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return matched, scanned, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var record crawlLogRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				continue
+			}
+			scanned++
+			if query.matches(record) {
+				matched++
+				w.Write(scanner.Bytes())
+				io.WriteString(w, "\n")
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return matched, scanned, err
+		}
+	}
+	return matched, scanned, nil
+}
+
+// ParseLogTime reads a point in time for a crawl log query: an RFC 3339 timestamp, a date
+// or a duration before now such as "2h". A date is the midnight it starts with.
+func ParseLogTime(value string, now time.Time) (time.Time, error) {
+	at, _, err := parseLogTime(value, now)
+	return at, err
+}
+
+// ParseLogUntil reads the end of a crawl log query like ParseLogTime, but a date covers
+// that whole day, so it ends at the midnight the next day starts with
+func ParseLogUntil(value string, now time.Time) (time.Time, error) {
+	at, dateOnly, err := parseLogTime(value, now)
+	if dateOnly {
+		at = at.AddDate(0, 0, 1)
+	}
+	return at, err
+}
+
+func parseLogTime(value string, now time.Time) (at time.Time, dateOnly bool, err error) {
+	if value == "" {
+		return time.Time{}, false, nil
+	}
+	if ago, err := time.ParseDuration(value); err == nil {
+		return now.Add(-ago), false, nil
+	}
+	if at, err := time.Parse(time.RFC3339, value); err == nil {
+		return at, false, nil
+	}
+	if at, err := time.ParseInLocation(time.DateOnly, value, time.Local); err == nil {
+		return at, true, nil
+	}
+	return time.Time{}, false, fmt.Errorf("invalid time %q, expected RFC 3339, YYYY-MM-DD or a duration like 2h", value)
+}
@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCrawlLogTimeRange(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.Local)
+	since, err := ParseLogTime("2026-10-15", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	until, err := ParseLogUntil("2026-10-15", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := CrawlLogQuery{Since: since, Until: until}
+	tests := []struct {
+		at   time.Time
+		want bool
+	}{
+		{time.Date(2026, 10, 14, 23, 59, 59, 0, time.Local), false},
+		{time.Date(2026, 10, 15, 0, 0, 0, 0, time.Local), true},
+		{time.Date(2026, 10, 15, 23, 59, 59, 999, time.Local), true},
+		{time.Date(2026, 10, 16, 0, 0, 0, 0, time.Local), false},
+	}
+	for _, test := range tests {
+		if got := query.matches(crawlLogRecord{At: test.at}); got != test.want {
+			t.Errorf("matches(%s) = %v, want %v", test.at, got, test.want)
+		}
+	}
+
+	// Timestamps and durations are taken as they are
+	if at, _ := ParseLogUntil("2026-10-15T10:00:00Z", now); !at.Equal(time.Date(2026, 10, 15, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("timestamp until = %s", at)
+	}
+	if at, _ := ParseLogUntil("2h", now); !at.Equal(now.Add(-2 * time.Hour)) {
+		t.Errorf("duration until = %s", at)
+	}
+	if _, err := ParseLogUntil("yesterday", now); err == nil {
+		t.Error("no error for an invalid time")
+	}
+}
@@ -0,0 +1,305 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"crawler/helpers"
+	"crawler/models"
+)
+
+// minSimHashWords is the number of words below which pages are only compared by their exact hash,
+// the SimHashes of short texts are too coarse to tell real near-duplicates from chance
+const minSimHashWords = 20
+
+// setFingerprint stores the fingerprint of a page's text in its meta. It reports whether the
+// fingerprint changed, in which case the cluster of the page is out of date and is dropped.
+func setFingerprint(meta *models.PageMeta, text string) bool {
+	fingerprint := helpers.ContentFingerprint(text)
+	simHash := ""
+	if fingerprint.Words >= minSimHashWords {
+		simHash = fmt.Sprintf("%016x", fingerprint.SimHash)
+	}
+	if fingerprint.Words == 0 {
+		// Nothing to compare, an empty page is no duplicate of other empty pages
+		fingerprint.Exact = ""
+	}
+	if meta.ExactHash == fingerprint.Exact && meta.SimHash == simHash {
+		return false
+	}
+	meta.ExactHash, meta.SimHash = fingerprint.Exact, simHash
+	meta.ClusterID, meta.DuplicateOf = "", ""
+	return true
+}
+
+// fingerprintText is the text a page is fingerprinted by: the main text of HTML pages,
+// so shared navigation doesn't make every page of a site look alike, and the body of other documents
+func fingerprintText(store PageStore, key string, meta models.PageMeta) (string, error) {
+	if hasLinks(meta.ContentType) {
+		file, err := store.Get(key, PartBody)
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+		return helpers.ExtractMainText(file, meta.ContentType)
+	}
+	doc, err := loadDocument(store, key)
+	return doc.Body, err
+}
+
+// DuplicateCluster is a group of pages with the same or nearly the same text
+type DuplicateCluster struct {
+	ID string
+	// Canonical is the URL of the representative that stays in the index
+	Canonical string
+	// URLs lists all pages of the cluster, the representative first
+	URLs []string
+	// Exact is set when all pages have exactly the same text
+	Exact bool
+}
+
+// dedupPage is a fingerprinted page taking part in the clustering
+type dedupPage struct {
+	key     string
+	meta    models.PageMeta
+	simHash uint64
+	hasSim  bool
+}
+
+// ClusterDuplicates groups the stored pages by their fingerprints: the same exact hash, or SimHashes
+// at most maxDistance bits apart. Every cluster gets a representative, the other pages are flagged
+// as its duplicates and flagged for reindexing when that changed. Pages fetched before fingerprints
+// were recorded are fingerprinted first. The clusters are returned largest first.
+func ClusterDuplicates(ctx context.Context, store PageStore, catalog *Catalog, maxDistance int) ([]DuplicateCluster, error) {
+	var pages []dedupPage
+	err := store.Iterate(func(key string) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		meta, err := loadPageMeta(store, key)
+		if err != nil || meta.URL == "" || !store.Exists(key, PartDocument) {
+			return nil
+		}
+		if meta.ExactHash == "" {
+			text, err := fingerprintText(store, key, meta)
+			if err != nil {
+				return nil
+			}
+			if setFingerprint(&meta, text) {
+				if err := savePageMeta(store, key, meta); err != nil {
+					return err
+				}
+			}
+		}
+		if meta.ExactHash == "" {
+			return nil
+		}
+		page := dedupPage{key: key, meta: meta}
+		if meta.SimHash != "" {
+			if simHash, err := strconv.ParseUint(meta.SimHash, 16, 64); err == nil {
+				page.simHash, page.hasSim = simHash, true
+			}
+		}
+		pages = append(pages, page)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	groups := groupDuplicates(pages, maxDistance)
+	var clusters []DuplicateCluster
+	for _, members := range groups {
+		if len(members) < 2 {
+			continue
+		}
+		sort.Slice(members, func(i, j int) bool {
+			return betterRepresentative(pages[members[i]].meta, pages[members[j]].meta)
+		})
+		cluster := DuplicateCluster{ID: pages[members[0]].key, Canonical: pages[members[0]].meta.URL, Exact: true}
+		for _, member := range members {
+			cluster.URLs = append(cluster.URLs, pages[member].meta.URL)
+			if pages[member].meta.ExactHash != pages[members[0]].meta.ExactHash {
+				cluster.Exact = false
+			}
+		}
+		clusters = append(clusters, cluster)
+		for i, member := range members {
+			duplicateOf := ""
+			if i > 0 {
+				duplicateOf = cluster.Canonical
+			}
+			if err := assignCluster(store, catalog, &pages[member], cluster.ID, duplicateOf); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// Pages that left their cluster go back to being on their own
+	for _, members := range groups {
+		if len(members) == 1 {
+			if err := assignCluster(store, catalog, &pages[members[0]], "", ""); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sort.SliceStable(clusters, func(i, j int) bool {
+		return len(clusters[i].URLs) > len(clusters[j].URLs)
+	})
+	return clusters, nil
+}
+
+// groupDuplicates joins pages with the same exact hash or close SimHashes and returns the groups
+// as indexes into pages. Two SimHashes at most maxDistance bits apart agree completely in at least
+// one of maxDistance+1 bit blocks, so only pages sharing a block are compared.
+func groupDuplicates(pages []dedupPage, maxDistance int) [][]int {
+	parent := make([]int, len(pages))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	union := func(a, b int) {
+		if ra, rb := find(a), find(b); ra != rb {
+			parent[max(ra, rb)] = min(ra, rb)
+		}
+	}
+
+	exact := make(map[string]int)
+	for i, page := range pages {
+		if first, ok := exact[page.meta.ExactHash]; ok {
+			union(first, i)
+		} else {
+			exact[page.meta.ExactHash] = i
+		}
+	}
+
+	if maxDistance >= 0 {
+		blocks := min(maxDistance+1, 64)
+		width := 64 / blocks
+		type bucket struct {
+			block int
+			value uint64
+		}
+		buckets := make(map[bucket][]int)
+		for i, page := range pages {
+			if !page.hasSim {
+				continue
+			}
+			for block := range blocks {
+				shift := block * width
+				bitsInBlock := width
+				if block == blocks-1 {
+					bitsInBlock = 64 - shift
+				}
+				value := page.simHash >> shift & (1<<bitsInBlock - 1)
+				key := bucket{block, value}
+				for _, other := range buckets[key] {
+					if helpers.HammingDistance(page.simHash, pages[other].simHash) <= maxDistance {
+						union(other, i)
+					}
+				}
+				buckets[key] = append(buckets[key], i)
+			}
+		}
+	}
+
+	byRoot := make(map[int][]int)
+	var roots []int
+	for i := range pages {
+		root := find(i)
+		if _, ok := byRoot[root]; !ok {
+			roots = append(roots, root)
+		}
+		byRoot[root] = append(byRoot[root], i)
+	}
+	groups := make([][]int, len(roots))
+	for i, root := range roots {
+		groups[i] = byRoot[root]
+	}
+	return groups
+}
+
+// betterRepresentative reports whether page a makes a better representative of its cluster than b:
+// an indexable page over a noindex one or one naming another canonical URL, then the URL with
+// the fewest query parameters, then the shorter URL
+func betterRepresentative(a, b models.PageMeta) bool {
+	if aOK, bOK := !a.NoIndex && a.Canonical == "", !b.NoIndex && b.Canonical == ""; aOK != bOK {
+		return aOK
+	}
+	if aParams, bParams := queryParamCount(a.URL), queryParamCount(b.URL); aParams != bParams {
+		return aParams < bParams
+	}
+	if len(a.URL) != len(b.URL) {
+		return len(a.URL) < len(b.URL)
+	}
+	return a.URL < b.URL
+}
+
+func queryParamCount(rawURL string) int {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return 0
+	}
+	return len(parsed.Query())
+}
+
+// assignCluster records the cluster of a page in its meta and document, flagging it for reindexing on a change
+func assignCluster(store PageStore, catalog *Catalog, page *dedupPage, clusterID, duplicateOf string) error {
+	meta := &page.meta
+	if meta.ClusterID == clusterID && meta.DuplicateOf == duplicateOf {
+		return nil
+	}
+	if meta.ClusterID != clusterID {
+		doc, err := loadDocument(store, page.key)
+		if err != nil {
+			return err
+		}
+		doc.ClusterID = clusterID
+		if err := saveDocument(store, page.key, doc); err != nil {
+			return err
+		}
+	}
+	meta.ClusterID, meta.DuplicateOf = clusterID, duplicateOf
+	meta.NeedsReindex = true
+	if err := savePageMeta(store, page.key, *meta); err != nil {
+		return err
+	}
+	catalogPage(catalog, page.key, "", *meta, nil)
+	return nil
+}
+
+// WriteDuplicateReport lists the largest clusters, at most limit of them (0 = all), with their pages
+func WriteDuplicateReport(w io.Writer, clusters []DuplicateCluster, limit int) {
+	duplicates := 0
+	for _, cluster := range clusters {
+		duplicates += len(cluster.URLs) - 1
+	}
+	fmt.Fprintf(w, "%d duplicate clusters, %d pages are duplicates of another\n", len(clusters), duplicates)
+	if limit > 0 && len(clusters) > limit {
+		clusters = clusters[:limit]
+	}
+	for _, cluster := range clusters {
+		kind := "near-duplicates"
+		if cluster.Exact {
+			kind = "exact duplicates"
+		}
+		fmt.Fprintf(w, "\nCluster %s: %d pages, %s\n", cluster.ID, len(cluster.URLs), kind)
+		for i, pageURL := range cluster.URLs {
+			marker := " "
+			if i == 0 {
+				marker = "*"
+			}
+			fmt.Fprintf(w, "  %s %s\n", marker, pageURL)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"io"
+	"net/url"
+	"strings"
+
+	"crawler/helpers"
+
+	"golang.org/x/net/html"
+)
+
+// parseStoredPage parses a stored HTML page once for its directives, document, main text and links.
+// It returns nil for other documents and for HTML that could not be read.
+func parseStoredPage(file io.ReadSeeker, contentType string) *helpers.HTMLPage {
+	if !hasLinks(contentType) {
+		return nil
+	}
+	file.Seek(0, 0)
+	page, err := helpers.ParseHTMLPage(file, contentType)
+	if err != nil {
+		return nil
+	}
+	return page
+}
+
+// readDirectives collects the robots directives of a stored page from the meta tags of its parsed
+// HTML, nil for other documents, and the X-Robots-Tag response header values, if any. The canonical
+// URL is resolved and normalized, and left empty when it points at the page itself or out of the crawl scope.
+func readDirectives(page *helpers.HTMLPage, pageURL string, xRobotsTag []string) helpers.PageDirectives {
+	agent := helpers.RobotsAgentToken(crawlConfig.UserAgent)
+	directives := helpers.ParseXRobotsTag(xRobotsTag, agent)
+	if page == nil {
+		// Only HTML has meta tags, other documents rely on the header
+		return directives
+	}
+	root := page.Root
+	directives.Merge(findMetaDirectives(root, agent))
+
+	if directives.Canonical != "" {
+		base, err := url.Parse(pageURL)
+		if err != nil {
+			directives.Canonical = ""
+			return directives
+		}
+		if href := findBaseHref(root); href != "" {
+			if resolved, err := base.Parse(href); err == nil {
+				base = resolved
+			}
+		}
+		canonical, err := urlNormalizer.Resolve(base, directives.Canonical)
+		if err != nil || canonical == pageURL || !inScope(canonical) {
+			canonical = ""
+		}
+		directives.Canonical = canonical
+	}
+	return directives
+}
+
+// findMetaDirectives reads <meta name="robots">, <meta name="agent"> and the first <link rel="canonical">
+func findMetaDirectives(node *html.Node, agent string) helpers.PageDirectives {
+	var directives helpers.PageDirectives
+	if node.Type == html.ElementNode {
+		switch node.Data {
+		case "meta":
+			name := strings.ToLower(strings.TrimSpace(attribute(node, "name")))
+			if name == "robots" || name == agent {
+				directives = helpers.ParseRobotsDirectives(attribute(node, "content"))
+			}
+		case "link":
+			for _, rel := range strings.Fields(strings.ToLower(attribute(node, "rel"))) {
+				if rel == "canonical" {
+					directives.Canonical = strings.TrimSpace(attribute(node, "href"))
+				}
+			}
+		}
+	}
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		directives.Merge(findMetaDirectives(c, agent))
+	}
+	return directives
+}
+
+func attribute(node *html.Node, key string) string {
+	for _, attr := range node.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
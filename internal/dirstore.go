@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// dirStore keeps every part in its own file named <key>.<part>. The flat layout puts all files
+// in one directory, the sharded one spreads them over dir/AB/CD/ by the first characters of the key.
+type dirStore struct {
+	dir string
+	// shardLevels is the number of two-character directory levels, 0 for the flat layout
+	shardLevels int
+}
+
+func newFlatStore(dir string) (*dirStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &dirStore{dir: dir}, nil
+}
+
+func newShardedStore(dir string) (*dirStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &dirStore{dir: dir, shardLevels: 2}, nil
+}
+
+func (s *dirStore) path(key string, part PagePart) string {
+	parts := []string{s.dir}
+	for level := range s.shardLevels {
+		if len(key) >= 2*level+2 {
+			parts = append(parts, key[2*level:2*level+2])
+		}
+	}
+	return filepath.Join(append(parts, key+"."+string(part))...)
+}
+
+func (s *dirStore) Put(key string, part PagePart, r io.Reader) error {
+	path := s.path(key, part)
+	if s.shardLevels > 0 {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+	}
+	// Written next to the final file and renamed, so readers never see half a part
+	tmp := path + ".part"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	_, err = io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *dirStore) Get(key string, part PagePart) (io.ReadSeekCloser, error) {
+	return os.Open(s.path(key, part))
+}
+
+func (s *dirStore) Exists(key string, part PagePart) bool {
+	_, err := os.Stat(s.path(key, part))
+	return err == nil
+}
+
+func (s *dirStore) Iterate(fn func(key string) error) error {
+	last := ""
+	err := filepath.WalkDir(s.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(s.dir, path)
+		if rel == "." {
+			return nil
+		}
+		depth := strings.Count(rel, string(filepath.Separator))
+		if entry.IsDir() {
+			// Skip the crawl state and anything else that is not a shard directory
+			if depth >= s.shardLevels || len(entry.Name()) != 2 {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		key, ext, ok := strings.Cut(entry.Name(), ".")
+		if depth != s.shardLevels || !ok || key == last || !slices.Contains(pageParts, PagePart(ext)) {
+			return nil
+		}
+		// Parts of a page sort next to each other, so comparing with the last key is enough
+		last = key
+		return fn(key)
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *dirStore) Delete(key string) error {
+	for _, part := range pageParts {
+		if err := os.Remove(s.path(key, part)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *dirStore) Close() error {
+	return nil
+}
@@ -0,0 +1,207 @@
+package internal
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errReadTimeout ends a response whose body stalled for longer than the read timeout.
+// It wraps os.ErrDeadlineExceeded so it is classified as a timeout.
+var errReadTimeout = fmt.Errorf("no data within the read timeout: %w", os.ErrDeadlineExceeded)
+
+// Fetcher sends the crawler's HTTP requests: it pools connections per host, speaks HTTP/2,
+// decodes gzip and deflate bodies and adds the configured User-Agent and headers
+type Fetcher struct {
+	client         *http.Client
+	userAgent      string
+	headers        http.Header
+	readTimeout    time.Duration
+	requestTimeout time.Duration
+}
+
+// NewFetcher builds a fetcher from the connection settings of cfg
+func NewFetcher(cfg CrawlConfig) (*Fetcher, error) {
+	proxy := http.ProxyFromEnvironment
+	switch strings.ToLower(cfg.Proxy) {
+	case "":
+	case "direct", "none":
+		proxy = nil
+	default:
+		proxyURL, err := url.Parse(cfg.Proxy)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL %q", cfg.Proxy)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	conns := max(cfg.MaxHostConns, 1)
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   cfg.ConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   cfg.TLSTimeout,
+		ResponseHeaderTimeout: cfg.ReadTimeout,
+		// A custom dialer turns HTTP/2 off unless asked for explicitly
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        CrawlerCount * conns,
+		MaxIdleConnsPerHost: conns,
+		MaxConnsPerHost:     conns,
+		IdleConnTimeout:     90 * time.Second,
+		// Bodies are decoded by the fetcher, which also asks for deflate
+		DisableCompression: true,
+	}
+	return &Fetcher{
+		client: &http.Client{
+			Transport:     transport,
+			CheckRedirect: checkRedirect,
+		},
+		userAgent:      cfg.UserAgent,
+		headers:        cfg.Headers.Clone(),
+		readTimeout:    cfg.ReadTimeout,
+		requestTimeout: cfg.RequestTimeout,
+	}, nil
+}
+
+// NewRequest builds a GET request carrying the configured User-Agent and headers
+func (f *Fetcher) NewRequest(rawURL string) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range f.headers {
+		req.Header[name] = append([]string(nil), values...)
+	}
+	req.Header.Set("User-Agent", f.userAgent)
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	return req, nil
+}
+
+// Do sends req. The response body comes back decoded and fails with a timeout when
+// no data arrives for the read timeout or the whole request takes longer than the request timeout.
+func (f *Fetcher) Do(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancelCause(req.Context())
+	if f.requestTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeoutCause(ctx, f.requestTimeout, context.DeadlineExceeded)
+		cancelCause := cancel
+		cancel = func(cause error) {
+			cancelCause(cause)
+			cancelTimeout()
+		}
+	}
+	resp, err := f.client.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel(nil)
+		return nil, err
+	}
+	body := &fetchBody{
+		raw:      resp.Body,
+		encoding: strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	if f.readTimeout > 0 {
+		body.timer = time.AfterFunc(f.readTimeout, func() { cancel(errReadTimeout) })
+		body.readTimeout = f.readTimeout
+	}
+	if body.encoding == "gzip" || body.encoding == "x-gzip" || body.encoding == "deflate" {
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		resp.Uncompressed = true
+	} else {
+		body.encoding = ""
+	}
+	resp.Body = body
+	return resp, nil
+}
+
+// fetchBody decodes a response body and enforces the read timeout between reads
+type fetchBody struct {
+	raw      io.ReadCloser
+	encoding string
+	decoder  io.Reader
+
+	ctx         context.Context
+	cancel      context.CancelCauseFunc
+	timer       *time.Timer
+	readTimeout time.Duration
+	closeOnce   sync.Once
+}
+
+func (b *fetchBody) Read(p []byte) (int, error) {
+	if b.decoder == nil {
+		decoder, err := b.newDecoder()
+		if err != nil {
+			return 0, b.cause(err)
+		}
+		b.decoder = decoder
+	}
+	n, err := b.decoder.Read(p)
+	if b.timer != nil && n > 0 {
+		b.timer.Reset(b.readTimeout)
+	}
+	if err != nil && err != io.EOF {
+		err = b.cause(err)
+	}
+	return n, err
+}
+
+// newDecoder is called on the first read, so empty bodies (304, HEAD) never need valid compressed data
+func (b *fetchBody) newDecoder() (io.Reader, error) {
+	return decodeBody(b.raw, b.encoding)
+}
+
+// decodeBody decodes a body sent with the given Content-Encoding, unknown encodings are returned as they are
+func decodeBody(r io.Reader, encoding string) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		// Servers send both zlib-wrapped and raw deflate under this name
+		buffered := bufio.NewReader(r)
+		if header, err := buffered.Peek(2); err == nil && header[0]&0x0F == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			return zlib.NewReader(buffered)
+		}
+		return flate.NewReader(buffered), nil
+	}
+	return r, nil
+}
+
+// cause replaces a read error caused by a cancelled context with the reason it was cancelled
+func (b *fetchBody) cause(err error) error {
+	if cause := context.Cause(b.ctx); cause != nil && !errors.Is(err, cause) && b.ctx.Err() != nil {
+		return cause
+	}
+	return err
+}
+
+func (b *fetchBody) Close() error {
+	var err error
+	b.closeOnce.Do(func() {
+		if b.timer != nil {
+			b.timer.Stop()
+		}
+		if closer, ok := b.decoder.(io.Closer); ok && b.decoder != b.raw {
+			closer.Close()
+		}
+		err = b.raw.Close()
+		b.cancel(nil)
+	})
+	return err
+}
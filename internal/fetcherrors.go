@@ -0,0 +1,199 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FailureKind tells why a fetch failed
+type FailureKind string
+
+const (
+	FailureDNS         FailureKind = "dns"
+	FailureTimeout     FailureKind = "timeout"
+	FailureTLS         FailureKind = "tls"
+	FailureConnReset   FailureKind = "connection_reset"
+	FailureConnRefused FailureKind = "connection_refused"
+	// FailureTruncated is a response the server cut off before it was complete
+	FailureTruncated   FailureKind = "truncated_response"
+	FailureHTTP4xx     FailureKind = "http_4xx"
+	FailureHTTP5xx     FailureKind = "http_5xx"
+	FailureContentType FailureKind = "content_type"
+	FailureRedirect    FailureKind = "redirect"
+	// FailureRobots is a URL given up on because its host's robots.txt stayed unreachable
+	FailureRobots FailureKind = "robots_unavailable"
+	FailureOther  FailureKind = "other"
+)
+
+const failuresLogFile = "failures.jsonl"
+
+// fetchFailure describes a failed fetch, Transient ones are worth retrying
+type fetchFailure struct {
+	Kind      FailureKind
+	Status    int
+	Err       error
+	Transient bool
+}
+
+func (f *fetchFailure) Error() string {
+	if f.Err != nil {
+		return fmt.Sprintf("%s: %s", f.Kind, f.Err)
+	}
+	return fmt.Sprintf("%s: status %d", f.Kind, f.Status)
+}
+
+// classifyError sorts a transport error from client.Do into a FailureKind
+func classifyError(err error) *fetchFailure {
+	failure := &fetchFailure{Kind: FailureOther, Err: err}
+
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidCert x509.CertificateInvalidError
+	switch {
+	case errors.Is(err, errTooManyRedirects), errors.Is(err, errRedirectOutOfScope), errors.Is(err, errRedirectBlocked):
+		failure.Kind = FailureRedirect
+	case errors.As(err, &dnsErr):
+		failure.Kind = FailureDNS
+		// NXDOMAIN won't fix itself, a flaky resolver might
+		failure.Transient = !dnsErr.IsNotFound
+	case errors.As(err, &certErr), errors.As(err, &recordErr), errors.As(err, &unknownAuthority),
+		errors.As(err, &hostnameErr), errors.As(err, &invalidCert):
+		failure.Kind = FailureTLS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		failure.Kind = FailureTimeout
+		failure.Transient = true
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		failure.Kind = FailureConnReset
+		failure.Transient = true
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		// A server that closes mid-response tends to do so every time, so this is only retried once
+		failure.Kind = FailureTruncated
+	case errors.Is(err, syscall.ECONNREFUSED):
+		failure.Kind = FailureConnRefused
+		failure.Transient = true
+	case strings.Contains(err.Error(), "tls:"):
+		failure.Kind = FailureTLS
+	}
+	return failure
+}
+
+// classifyStatus turns an unsuccessful HTTP status into a failure, or nil for 2xx/304
+func classifyStatus(status int) *fetchFailure {
+	switch {
+	case status >= 200 && status < 300, status == http.StatusNotModified:
+		return nil
+	case status == http.StatusRequestTimeout || status == http.StatusTooManyRequests:
+		return &fetchFailure{Kind: FailureHTTP4xx, Status: status, Transient: true}
+	case status >= 400 && status < 500:
+		return &fetchFailure{Kind: FailureHTTP4xx, Status: status}
+	case status >= 500:
+		return &fetchFailure{Kind: FailureHTTP5xx, Status: status, Transient: status != http.StatusNotImplemented}
+	default:
+		// Redirects the client didn't follow and other oddities
+		return &fetchFailure{Kind: FailureOther, Status: status}
+	}
+}
+
+// retryDelay is an exponential backoff with jitter: a random duration in [d/2, d]
+// where d doubles with every attempt, capped at MaxRetryDelay
+func retryDelay(attempt int) time.Duration {
+	delay := crawlConfig.RetryBaseDelay << attempt
+	if delay <= 0 || delay > crawlConfig.MaxRetryDelay {
+		delay = crawlConfig.MaxRetryDelay
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int64N(int64(half)+1))
+}
+
+// failureRecord is one line of the failures log
+type failureRecord struct {
+	At       time.Time   `json:"at"`
+	URL      string      `json:"url"`
+	Referrer string      `json:"referrer,omitempty"`
+	Kind     FailureKind `json:"kind"`
+	Status   int         `json:"status,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Attempts int         `json:"attempts"`
+}
+
+// fetchFailures counts failures by kind and appends permanent ones to the failures log
+var fetchFailures = struct {
+	lock    sync.Mutex
+	counts  map[FailureKind]uint32
+	retries uint32
+	file    *os.File
+}{counts: make(map[FailureKind]uint32)}
+
+// recordRetry counts a transient failure that is going to be retried
+func recordRetry() {
+	fetchFailures.lock.Lock()
+	fetchFailures.retries++
+	fetchFailures.lock.Unlock()
+	fetchRetries.Inc()
+}
+
+// recordFailure counts a failure that was given up on and writes it to the failures log
+func recordFailure(url, referrer string, failure *fetchFailure, attempts int) {
+	record := failureRecord{
+		At:       time.Now(),
+		URL:      url,
+		Referrer: referrer,
+		Kind:     failure.Kind,
+		Status:   failure.Status,
+		Attempts: attempts,
+	}
+	if failure.Err != nil {
+		record.Error = failure.Err.Error()
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+
+	fetchFailures.lock.Lock()
+	defer fetchFailures.lock.Unlock()
+	fetchFailures.counts[failure.Kind]++
+	if fetchFailures.file == nil {
+		os.MkdirAll(crawlStateDir, 0755)
+		fetchFailures.file, err = os.OpenFile(filepath.Join(crawlStateDir, failuresLogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			fmt.Println("Could not open the failures log:", err)
+			return
+		}
+	}
+	fetchFailures.file.Write(append(data, '\n'))
+}
+
+// failureReport lists the failure counts by kind, e.g. "http_4xx=3 timeout=1 (2 retries)"
+func failureReport() string {
+	fetchFailures.lock.Lock()
+	defer fetchFailures.lock.Unlock()
+	if len(fetchFailures.counts) == 0 && fetchFailures.retries == 0 {
+		return "no failures"
+	}
+	parts := make([]string, 0, len(fetchFailures.counts))
+	for kind, count := range fetchFailures.counts {
+		parts = append(parts, fmt.Sprintf("%s=%d", kind, count))
+	}
+	sort.Strings(parts)
+	return fmt.Sprintf("%s (%d retries)", strings.Join(parts, " "), fetchFailures.retries)
+}
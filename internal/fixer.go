@@ -1,73 +1,109 @@
 package internal
 
 import (
+	"context"
 	"crawler/helpers"
 	"crawler/models"
-	"encoding/json"
 	"log"
-	"os"
-	"path/filepath"
-	"strings"
+	"reflect"
 	"time"
 )
 
-// FixJSONFiles re-parses all HTML files and regenerates JSON files with proper encoding
-// This is useful when encoding issues are fixed and you want to update existing JSON files
-func FixJSONFiles(dataDir string) {
+// FixJSONFiles re-parses all stored bodies and regenerates the documents with proper encoding
+// This is useful when encoding issues are fixed and you want to update existing documents.
+// Documents whose text is still flagged as mojibake are repaired, changed ones are flagged for reindexing.
+// The catalog is updated, also for pages stored without a meta file, and names the URL of pages
+// whose document and meta are missing.
+// Cancelling ctx stops after the page in progress.
+func FixJSONFiles(ctx context.Context, store PageStore, catalog *Catalog) {
 	log.Println("--- Fixing JSON files by re-parsing HTML with proper encoding ---")
 	startTime := time.Now()
 
-	files, err := os.ReadDir(dataDir)
-	if err != nil {
-		log.Fatalf("Error reading data directory: %s", err)
-	}
 	processed := 0
+	repaired := 0
 	errors := 0
-	for _, file := range files {
-		if !strings.HasSuffix(file.Name(), ".html") {
-			continue
+	err := store.Iterate(func(key string) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !store.Exists(key, PartBody) {
+			return nil
 		}
 
-		filePath := filepath.Join(dataDir, file.Name())
-		jsonPath := strings.TrimSuffix(filePath, ".html") + ".json"
-		// Try to get original URL from existing JSON file
+		// Try to get original URL from the existing document
 		var originalURL string
-		if jsonData, err := os.ReadFile(jsonPath); err == nil {
-			var existingDoc models.Document
-			if err := json.Unmarshal(jsonData, &existingDoc); err == nil && existingDoc.URL != "" {
-				originalURL = existingDoc.URL
-			}
+		existingDoc, err := loadDocument(store, key)
+		if err == nil && existingDoc.URL != "" {
+			originalURL = existingDoc.URL
 		}
-		// If we couldn't get the URL from JSON, use filename as fallback
+		// Extract document with proper encoding, the stored Content-Type may name the charset
+		// and picks the extractor; pages stored without one are HTML
+		meta, metaErr := loadPageMeta(store, key)
 		if originalURL == "" {
-			originalURL = file.Name()
+			originalURL = meta.URL
+		}
+		if record, ok := catalog.Lookup(key); ok && originalURL == "" {
+			originalURL = record.URL
+		}
+		urlKnown := originalURL != ""
+		// If we couldn't get the URL at all, use the key as fallback
+		if !urlKnown {
+			log.Printf("No URL known for %s, using the key instead", key)
+			originalURL = key
 		}
 
-		// Open and re-parse the HTML file with proper encoding
-		f, err := os.Open(filePath)
+		// Open and re-parse the stored body with proper encoding
+		f, err := store.Get(key, PartBody)
 		if err != nil {
-			log.Printf("Error opening %s: %s", file.Name(), err)
+			log.Printf("Error opening %s: %s", key, err)
 			errors++
-			continue
+			return nil
+		}
+		extract, ok := helpers.ExtractorFor(meta.ContentType)
+		if !ok {
+			extract = helpers.ExtractDocument
 		}
-		// Extract document with proper encoding
-		doc, err := helpers.ExtractDocument(f, originalURL)
+		doc, err := extract(f, originalURL, meta.ContentType)
 		f.Close()
 		if err != nil {
-			log.Printf("Error extracting document from %s: %s", file.Name(), err)
+			log.Printf("Error extracting document from %s: %s", key, err)
 			errors++
-			continue
+			return nil
 		}
-		// Save the updated JSON file
-		if err := helpers.SaveDocumentJSON(doc, filePath); err != nil {
-			log.Printf("Error saving JSON for %s: %s", file.Name(), err)
+		doc.Aliases = existingDoc.Aliases
+		doc.ClusterID = existingDoc.ClusterID
+		if doc.Mojibake && helpers.RepairDocument(&doc) {
+			repaired++
+		}
+		// Save the updated document
+		if err := saveDocument(store, key, doc); err != nil {
+			log.Printf("Error saving JSON for %s: %s", key, err)
 			errors++
-			continue
+			return nil
+		}
+		if metaErr == nil && !reflect.DeepEqual(doc, existingDoc) {
+			meta.NeedsReindex = true
+			if err := savePageMeta(store, key, meta); err != nil {
+				log.Printf("Error saving meta for %s: %s", key, err)
+			}
+		}
+		if metaErr != nil && urlKnown {
+			// Pages stored before their fetch state was kept are catalogued by the URL of their document
+			meta = models.PageMeta{URL: originalURL}
+		}
+		if metaErr == nil || urlKnown {
+			catalogPage(catalog, key, "", meta, &doc)
 		}
 		processed++
 		if processed%100 == 0 {
 			log.Printf("Processed %d files...", processed)
 		}
+		return nil
+	})
+	if ctx.Err() != nil {
+		log.Printf("Interrupted, stopping after %d files", processed)
+	} else if err != nil {
+		log.Fatalf("Error reading the page store: %s", err)
 	}
-	log.Printf("Fixed %d JSON files in %s (errors: %d)", processed, time.Since(startTime), errors)
+	log.Printf("Fixed %d JSON files in %s (mojibake repaired: %d, errors: %d)", processed, time.Since(startTime), repaired, errors)
 }
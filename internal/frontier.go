@@ -0,0 +1,246 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"crawler/helpers"
+	"crawler/models"
+)
+
+const (
+	// crawlStateDir holds the crawler's own bookkeeping, next to the stored pages
+	crawlStateDir   = "./site/.crawl"
+	frontierLogFile = "frontier.log"
+	checkpointFile  = "checkpoint.json"
+)
+
+// frontierRecord is one line of the append-only frontier log.
+// "add" records a queued entry, "done" marks its URL as processed.
+type frontierRecord struct {
+	Op    string                `json:"op"`
+	Entry *models.FrontierEntry `json:"entry,omitempty"`
+	URL   string                `json:"url,omitempty"`
+}
+
+// crawlCheckpoint is the periodically saved crawl progress
+type crawlCheckpoint struct {
+	SavedAt time.Time `json:"saved_at"`
+	Total   uint64    `json:"total"`
+	OK      uint64    `json:"ok"`
+	Failed  uint64    `json:"failed"`
+	Garbage uint64    `json:"garbage"`
+	Blocked uint64    `json:"blocked"`
+	// Unchanged counts revisited pages whose content had not changed
+	Unchanged uint64 `json:"unchanged"`
+	// Truncated counts pages cut off at the maximum body size
+	Truncated uint64 `json:"truncated"`
+	// Pages counts against the global page budget, HostPages against the per-host budgets
+	Pages      int            `json:"pages"`
+	HostPages  map[string]int `json:"host_pages,omitempty"`
+	StopReason string         `json:"stop_reason,omitempty"`
+}
+
+type frontierLog struct {
+	lock   sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+}
+
+var frontier *frontierLog
+
+// startFrontier truncates the frontier log for a fresh crawl
+func startFrontier() error {
+	if err := os.MkdirAll(crawlStateDir, 0755); err != nil {
+		return err
+	}
+	os.Remove(filepath.Join(crawlStateDir, checkpointFile))
+	file, err := os.Create(filepath.Join(crawlStateDir, frontierLogFile))
+	if err != nil {
+		return err
+	}
+	frontier = &frontierLog{file: file, writer: bufio.NewWriter(file)}
+	return nil
+}
+
+// resumeFrontier replays the frontier log into the seen-set, restores the counters from
+// the last checkpoint and returns the entries that were queued but never finished.
+// The log is compacted on the way so it doesn't grow forever across restarts.
+func resumeFrontier() ([]models.FrontierEntry, error) {
+	logPath := filepath.Join(crawlStateDir, frontierLogFile)
+	file, err := os.Open(logPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		order   []string
+		entries = make(map[string]models.FrontierEntry)
+		done    = make(map[string]struct{})
+	)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record frontierRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// The last line may be cut off if the process was killed mid-write
+			continue
+		}
+		switch record.Op {
+		case "add":
+			if record.Entry == nil {
+				continue
+			}
+			if _, ok := entries[record.Entry.URL]; !ok {
+				order = append(order, record.Entry.URL)
+			}
+			entries[record.Entry.URL] = *record.Entry
+		case "done":
+			done[record.URL] = struct{}{}
+		}
+	}
+	file.Close()
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var pending []models.FrontierEntry
+	for _, url := range order {
+		safeSet.Add(url)
+		if _, ok := done[url]; !ok {
+			pending = append(pending, entries[url])
+		}
+	}
+	for url := range done {
+		safeSet.Add(url)
+	}
+
+	if data, err := os.ReadFile(filepath.Join(crawlStateDir, checkpointFile)); err == nil {
+		var cp crawlCheckpoint
+		if err := json.Unmarshal(data, &cp); err == nil {
+			totalCounter.Store(cp.Total)
+			okCounter.Store(cp.OK)
+			failCounter.Store(cp.Failed)
+			garbageCounter.Store(cp.Garbage)
+			blockedCounter.Store(cp.Blocked)
+			unchangedCounter.Store(cp.Unchanged)
+			truncatedCounter.Store(cp.Truncated)
+			crawlBudget.pages = cp.Pages
+			for host, pages := range cp.HostPages {
+				crawlBudget.perHost[host] = pages
+			}
+		}
+	}
+	if totalCounter.Load() < uint64(len(entries)) {
+		totalCounter.Store(uint64(len(entries)))
+	}
+
+	// Rewrite the log as "done" lines for finished URLs followed by the pending entries
+	tmpPath := logPath + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for url := range done {
+		encoder.Encode(frontierRecord{Op: "done", URL: url})
+	}
+	for i := range pending {
+		encoder.Encode(frontierRecord{Op: "add", Entry: &pending[i]})
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	tmp.Close()
+	if err := os.Rename(tmpPath, logPath); err != nil {
+		return nil, err
+	}
+
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	frontier = &frontierLog{file: logFile, writer: bufio.NewWriter(logFile)}
+	return pending, nil
+}
+
+func (f *frontierLog) write(record frontierRecord) {
+	if f == nil {
+		return
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	f.lock.Lock()
+	f.writer.Write(data)
+	f.writer.WriteByte('\n')
+	f.lock.Unlock()
+}
+
+// add records a newly queued entry
+func (f *frontierLog) add(entry models.FrontierEntry) {
+	f.write(frontierRecord{Op: "add", Entry: &entry})
+}
+
+// markDone records that a URL was processed and must not be fetched again on resume
+func (f *frontierLog) markDone(url string) {
+	f.write(frontierRecord{Op: "done", URL: url})
+}
+
+// checkpoint flushes the log and saves the counters
+func (f *frontierLog) checkpoint() {
+	if f == nil {
+		return
+	}
+	f.lock.Lock()
+	if err := f.writer.Flush(); err != nil {
+		fmt.Println("Could not flush the frontier log:", err)
+	}
+	f.lock.Unlock()
+
+	crawlBudget.lock.Lock()
+	pages := crawlBudget.pages
+	hostPages := maps.Clone(crawlBudget.perHost)
+	crawlBudget.lock.Unlock()
+	cp := crawlCheckpoint{
+		SavedAt: time.Now(),
+		Total:   totalCounter.Load(),
+		OK:      okCounter.Load(),
+		Failed:  failCounter.Load(),
+		Garbage: garbageCounter.Load(),
+		Blocked: blockedCounter.Load(),
+		Pages:   pages,
+
+		Unchanged: unchangedCounter.Load(),
+		Truncated: truncatedCounter.Load(),
+		HostPages: hostPages,
+	}
+	if crawlStopped() {
+		cp.StopReason = stopReason
+	}
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return
+	}
+	path := filepath.Join(crawlStateDir, checkpointFile)
+	helpers.WriteFileAtomic(path, data, 0644)
+}
+
+func (f *frontierLog) close() {
+	if f == nil {
+		return
+	}
+	f.lock.Lock()
+	f.writer.Flush()
+	f.file.Close()
+	f.lock.Unlock()
+}
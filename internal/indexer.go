@@ -3,13 +3,10 @@ package internal
 import (
 	"bytes"
 	"context"
-	"crawler/models"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
-	"os"
-	"path/filepath"
 	"time"
 
 	"github.com/elastic/go-elasticsearch/v8"
@@ -137,6 +134,8 @@ func CreatePersianIndex(es *elasticsearch.Client, indexName string) error {
 				"h6":   map[string]any{"type": "text", "analyzer": "persian_index"},
 				"body": map[string]any{"type": "text", "analyzer": "persian_index"},
 				"url":  map[string]any{"type": "keyword"},
+				// URLs that redirect to the page, searchable by exact match
+				"aliases": map[string]any{"type": "keyword"},
 			},
 		},
 	}
@@ -153,86 +152,189 @@ func CreatePersianIndex(es *elasticsearch.Client, indexName string) error {
 	if res.IsError() {
 		return fmt.Errorf("failed to create index: %s", res.String())
 	}
+	// Like a bulk request, a 200 isn't enough, the cluster has to acknowledge the new index
+	var created struct {
+		Acknowledged bool `json:"acknowledged"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&created); err != nil {
+		return fmt.Errorf("unreadable create index response: %w", err)
+	}
+	if !created.Acknowledged {
+		return fmt.Errorf("index %s was not acknowledged by the cluster", indexName)
+	}
 	return nil
 }
 
-func StartIndexing(es *elasticsearch.Client, dataDir string) {
+// StartIndexing sends the extracted documents in the page store to Elasticsearch. A full run recreates the
+// index, an incremental one keeps it and only sends the pages a refresh crawl flagged as changed.
+// Cancelling ctx stops reading documents, the batch collected so far is still sent.
+func StartIndexing(ctx context.Context, es *elasticsearch.Client, store PageStore, catalog *Catalog, incremental bool) {
 	log.Println("--- Starting Offline Phase: Indexing ---")
 	startTime := time.Now()
 	const indexName = "html-indexer"
-	es.Indices.Delete([]string{indexName})
-	err := CreatePersianIndex(es, indexName)
-	if err != nil {
-		log.Fatalf("Failed to create index: %v", err)
+	if incremental {
+		if res, err := es.Indices.Exists([]string{indexName}); err == nil {
+			res.Body.Close()
+			if res.StatusCode == 404 {
+				incremental = false
+				log.Println("Index does not exist yet, running a full indexing instead")
+			}
+		}
 	}
-	log.Println("Created index")
-
-	files, err := os.ReadDir(dataDir)
-	if err != nil {
-		log.Fatalf("Error reading data directory: %s", err)
+	if !incremental {
+		es.Indices.Delete([]string{indexName})
+		err := CreatePersianIndex(es, indexName)
+		if err != nil {
+			log.Fatalf("Failed to create index: %v", err)
+		}
+		log.Println("Created index")
 	}
-	ctx := context.Background()
+
+	// The last batch is flushed even after an interrupt
+	flushCtx := context.WithoutCancel(ctx)
 
 	var bulkReq bytes.Buffer
 	batchSize := 50
 	count := 0
-	for _, file := range files {
-		if filepath.Ext(file.Name()) != ".json" {
-			continue
+	// Keys of the documents in the current batch, their reindex flag is cleared once indexed
+	var batchPages []string
+	err := store.Iterate(func(key string) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !store.Exists(key, PartDocument) {
+			return nil
 		}
 
-		filePath := filepath.Join(dataDir, file.Name())
-
-		var doc models.Document
-		jsonData, err := os.ReadFile(filePath)
-		if err != nil {
-			log.Printf("Failed reading %s: %v", file.Name(), err)
-			continue
+		// The page key is the document ID
+		docID := key
+		meta, metaErr := loadPageMeta(store, key)
+		if incremental && (metaErr != nil || !meta.NeedsReindex) {
+			return nil
+		}
+		// noindex pages, variants of a canonical page and duplicates of another page stay out of the index
+		if metaErr == nil && (meta.NoIndex || meta.Canonical != "" || meta.DuplicateOf != "") {
+			if incremental {
+				// They may have been indexed before the directive showed up
+				fmt.Fprintf(&bulkReq, `{"delete":{"_index":"%s","_id":"%s"}}%s`, indexName, docID, "\n")
+				batchPages = append(batchPages, key)
+				count++
+			} else {
+				catalogIndexed(catalog, store, []string{key})
+			}
+			return nil
 		}
 
-		if err := json.Unmarshal(jsonData, &doc); err != nil {
-			log.Printf("Invalid JSON %s: %v", file.Name(), err)
-			continue
+		doc, err := loadDocument(store, key)
+		if err != nil {
+			log.Printf("Invalid document %s: %v", key, err)
+			return nil
 		}
 
 		data, err := json.Marshal(doc)
 		if err != nil {
-			log.Printf("Failed marshaling %s: %v", file.Name(), err)
-			continue
+			log.Printf("Failed marshaling %s: %v", key, err)
+			return nil
 		}
 
-		// Add to bulk: index action + doc
-		meta := fmt.Appendf(nil, `{"index":{"_index":"%s"}}%s`, indexName, "\n")
-		bulkReq.Write(meta)
+		// Add to bulk: index action + doc. The storage name is the document ID,
+		// so a refreshed page replaces its old version instead of adding a second one.
+		action := fmt.Appendf(nil, `{"index":{"_index":"%s","_id":"%s"}}%s`, indexName, docID, "\n")
+		bulkReq.Write(action)
 		bulkReq.Write(data)
 		bulkReq.Write([]byte("\n"))
+		batchPages = append(batchPages, key)
 		count++
 
 		if count >= batchSize {
 			log.Printf("Indexed %d documents in %s", count, time.Since(startTime))
-			flushBulk(es, &bulkReq, ctx)
+			indexed := flushBulk(es, &bulkReq, batchPages, flushCtx)
+			clearReindexFlags(store, indexed)
+			catalogIndexed(catalog, store, indexed)
 			bulkReq.Reset()
+			batchPages = batchPages[:0]
 			count = 0
 		}
+		return nil
+	})
+	if ctx.Err() != nil {
+		log.Println("Interrupted, sending the last batch")
+	} else if err != nil {
+		log.Fatalf("Error reading the page store: %s", err)
+	}
+	if count > 0 {
+		log.Printf("Indexed %d documents in %s", count, time.Since(startTime))
+		indexed := flushBulk(es, &bulkReq, batchPages, flushCtx)
+		clearReindexFlags(store, indexed)
+		catalogIndexed(catalog, store, indexed)
 	}
 	log.Printf("Indexing completed in %s", time.Since(startTime))
 }
 
+// clearReindexFlags marks pages as indexed in their PageMeta
+func clearReindexFlags(store PageStore, keys []string) {
+	for _, key := range keys {
+		meta, err := loadPageMeta(store, key)
+		if err != nil || !meta.NeedsReindex {
+			continue
+		}
+		meta.NeedsReindex = false
+		if err := savePageMeta(store, key, meta); err != nil {
+			log.Printf("Failed updating meta of %s: %v", key, err)
+		}
+	}
+}
+
 var batchcount int
 
-func flushBulk(es *elasticsearch.Client, bulkReq *bytes.Buffer, ctx context.Context) {
+// bulkResponse is the part of an Elasticsearch bulk response that tells which actions failed
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	// Items has one entry per action, in request order, keyed by the action name
+	Items []map[string]struct {
+		ID     string          `json:"_id"`
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// flushBulk sends a bulk request and returns the keys of the pages Elasticsearch accepted.
+// A bulk request succeeds as a whole even when some of its actions are rejected, those are
+// logged and left out so their pages are sent again by the next incremental run.
+func flushBulk(es *elasticsearch.Client, bulkReq *bytes.Buffer, keys []string, ctx context.Context) []string {
 	res, err := es.Bulk(bytes.NewReader(bulkReq.Bytes()), es.Bulk.WithContext(ctx))
 	if err != nil {
 		log.Printf("Bulk error: %v", err)
-		return
+		return nil
 	}
 	defer res.Body.Close()
 
 	if res.IsError() {
 		body, _ := io.ReadAll(res.Body)
 		log.Printf("Bulk ES error: %s", body)
-	} else {
-		batchcount++
+		return nil
+	}
+	var response bulkResponse
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		log.Printf("Unreadable bulk response: %v", err)
+		return nil
+	}
+	batchcount++
+	if !response.Errors {
 		log.Printf("Bulk %d batch indexed successfully \n", batchcount)
+		return keys
+	}
+	var indexed []string
+	for _, item := range response.Items {
+		for action, result := range item {
+			// Deleting a page that was never indexed is fine
+			if result.Status/100 == 2 || (action == "delete" && result.Status == 404) {
+				indexed = append(indexed, result.ID)
+				continue
+			}
+			log.Printf("Elasticsearch rejected the %s of %s (%d): %s", action, result.ID, result.Status, result.Error)
+		}
 	}
+	log.Printf("Bulk %d batch indexed %d of %d documents \n", batchcount, len(indexed), len(keys))
+	return indexed
 }
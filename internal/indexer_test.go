@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+// fakeElasticsearch answers every request with status and body
+func fakeElasticsearch(t *testing.T, status int, body string) *elasticsearch.Client {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	es, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return es
+}
+
+func TestFlushBulk(t *testing.T) {
+	keys := []string{"a", "b", "c", "d"}
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   []string
+	}{
+		{"all accepted", 200, `{"errors":false,"items":[]}`, keys},
+		{"some rejected", 200, `{"errors":true,"items":[
+			{"index":{"_id":"a","status":201}},
+			{"index":{"_id":"b","status":400,"error":{"type":"mapper_parsing_exception"}}},
+			{"delete":{"_id":"c","status":404,"result":"not_found"}},
+			{"index":{"_id":"d","status":429,"error":{"type":"es_rejected_execution_exception"}}}]}`, []string{"a", "c"}},
+		{"request failed", 413, `{"error":"too large"}`, nil},
+		{"unreadable response", 200, `not json`, nil},
+	}
+	for _, test := range tests {
+		es := fakeElasticsearch(t, test.status, test.body)
+		got := flushBulk(es, bytes.NewBufferString("{}\n"), keys, context.Background())
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// latencyBuckets are the upper bounds in seconds of the fetch latency histogram
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Crawl metrics, the page counters printed by the crawler are registered in crawler.go
+var (
+	queueDepth = newGaugeFunc("crawler_queue_depth", "URLs waiting in the queue",
+		func() float64 { return float64(queue.len()) })
+	busyWorkers  = newGauge("crawler_workers_busy", "Workers currently processing a URL")
+	fetchRetries = newCounter("crawler_fetch_retries_total", "Fetches retried after a transient failure")
+
+	hostFetchDuration = newHistogramVec("crawler_fetch_duration_seconds", "Time from sending a request until its body was read",
+		latencyBuckets, "host")
+	hostResponses   = newCounterVec("crawler_responses_total", "HTTP responses received", "host", "code")
+	hostFetchErrors = newCounterVec("crawler_fetch_errors_total", "Requests that failed without a response", "host", "kind")
+	hostBodyBytes   = newCounterVec("crawler_body_bytes_total", "Body bytes stored", "host")
+	hostInFlight    = newGaugeVec("crawler_requests_in_flight", "Requests sent and not finished yet", "host")
+)
+
+// metricsRegistry holds every metric in registration order
+var metricsRegistry = struct {
+	lock    sync.Mutex
+	metrics []metric
+}{}
+
+// metric is a metric family that can write itself in the Prometheus text format
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+func register[M metric](m M) M {
+	metricsRegistry.lock.Lock()
+	defer metricsRegistry.lock.Unlock()
+	metricsRegistry.metrics = append(metricsRegistry.metrics, m)
+	return m
+}
+
+// writeMetrics writes all metrics in the Prometheus text exposition format
+func writeMetrics(w io.Writer) {
+	metricsRegistry.lock.Lock()
+	metrics := slices.Clone(metricsRegistry.metrics)
+	metricsRegistry.lock.Unlock()
+	for _, m := range metrics {
+		m.writeTo(w)
+	}
+}
+
+// metricInfo is the name and help text of a metric family
+type metricInfo struct {
+	name string
+	help string
+	kind string
+}
+
+func (info metricInfo) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", info.name, info.help, info.name, info.kind)
+}
+
+// Counter is a value that only goes up
+type Counter struct {
+	value atomic.Uint64
+}
+
+func (c *Counter) Inc()           { c.value.Add(1) }
+func (c *Counter) Add(n uint64)   { c.value.Add(n) }
+func (c *Counter) Load() uint64   { return c.value.Load() }
+func (c *Counter) Store(n uint64) { c.value.Store(n) }
+
+func (c *Counter) writeSamples(w io.Writer, name, labels string) {
+	fmt.Fprintf(w, "%s%s %d\n", name, braced(labels), c.Load())
+}
+
+// Gauge is a value that goes up and down
+type Gauge struct {
+	value atomic.Int64
+}
+
+func (g *Gauge) Inc()        { g.value.Add(1) }
+func (g *Gauge) Dec()        { g.value.Add(-1) }
+func (g *Gauge) Set(n int64) { g.value.Store(n) }
+func (g *Gauge) Load() int64 { return g.value.Load() }
+
+func (g *Gauge) writeSamples(w io.Writer, name, labels string) {
+	fmt.Fprintf(w, "%s%s %d\n", name, braced(labels), g.Load())
+}
+
+// Histogram counts observations into buckets with fixed upper bounds
+type Histogram struct {
+	bounds []float64
+	// counts has one more entry than bounds for the observations above the last bound
+	counts []atomic.Uint64
+	// sum holds the float64 bits of the sum of all observations
+	sum atomic.Uint64
+}
+
+func newHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds)+1)}
+}
+
+func (h *Histogram) Observe(value float64) {
+	i, _ := slices.BinarySearch(h.bounds, value)
+	h.counts[i].Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+value)) {
+			return
+		}
+	}
+}
+
+func (h *Histogram) writeSamples(w io.Writer, name, labels string) {
+	prefix := labels
+	if prefix != "" {
+		prefix += ","
+	}
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i].Load()
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, prefix, formatFloat(bound), cumulative)
+	}
+	cumulative += h.counts[len(h.bounds)].Load()
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, prefix, cumulative)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, braced(labels), formatFloat(math.Float64frombits(h.sum.Load())))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, braced(labels), cumulative)
+}
+
+// sampler is a single series that writes its samples under the given name and rendered labels
+type sampler interface {
+	writeSamples(w io.Writer, name, labels string)
+}
+
+// single is a metric family without labels
+type single struct {
+	metricInfo
+	sampler sampler
+}
+
+func (s *single) writeTo(w io.Writer) {
+	s.writeHeader(w)
+	s.sampler.writeSamples(w, s.name, "")
+}
+
+func newCounter(name, help string) *Counter {
+	c := &Counter{}
+	register(&single{metricInfo{name, help, "counter"}, c})
+	return c
+}
+
+func newGauge(name, help string) *Gauge {
+	g := &Gauge{}
+	register(&single{metricInfo{name, help, "gauge"}, g})
+	return g
+}
+
+// gaugeFunc is a gauge read from fn when the metrics are scraped
+type gaugeFunc func() float64
+
+func (fn gaugeFunc) writeSamples(w io.Writer, name, labels string) {
+	fmt.Fprintf(w, "%s%s %s\n", name, braced(labels), formatFloat(fn()))
+}
+
+func newGaugeFunc(name, help string, fn func() float64) gaugeFunc {
+	register(&single{metricInfo{name, help, "gauge"}, gaugeFunc(fn)})
+	return fn
+}
+
+// vec is a metric family with one series per combination of label values
+type vec struct {
+	metricInfo
+	labels    []string
+	newSeries func() sampler
+
+	lock   sync.RWMutex
+	series map[string]*labeledSeries
+}
+
+type labeledSeries struct {
+	// labels is the rendered label set, e.g. host="example.com",code="200"
+	labels  string
+	sampler sampler
+}
+
+func newVec(info metricInfo, labels []string, newSeries func() sampler) *vec {
+	return &vec{metricInfo: info, labels: labels, newSeries: newSeries, series: make(map[string]*labeledSeries)}
+}
+
+// with returns the series of the label values, creating it on first use
+func (v *vec) with(values ...string) sampler {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s takes %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.lock.RLock()
+	s, ok := v.series[key]
+	v.lock.RUnlock()
+	if ok {
+		return s.sampler
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if s, ok := v.series[key]; ok {
+		return s.sampler
+	}
+	pairs := make([]string, len(values))
+	for i, value := range values {
+		pairs[i] = v.labels[i] + `="` + labelEscaper.Replace(value) + `"`
+	}
+	s = &labeledSeries{labels: strings.Join(pairs, ","), sampler: v.newSeries()}
+	v.series[key] = s
+	return s.sampler
+}
+
+func (v *vec) writeTo(w io.Writer) {
+	v.lock.RLock()
+	series := make([]*labeledSeries, 0, len(v.series))
+	for _, s := range v.series {
+		series = append(series, s)
+	}
+	v.lock.RUnlock()
+	slices.SortFunc(series, func(a, b *labeledSeries) int { return strings.Compare(a.labels, b.labels) })
+
+	v.writeHeader(w)
+	for _, s := range series {
+		s.sampler.writeSamples(w, v.name, s.labels)
+	}
+}
+
+// CounterVec is a counter per combination of label values
+type CounterVec struct{ *vec }
+
+func (v CounterVec) With(values ...string) *Counter { return v.with(values...).(*Counter) }
+
+func newCounterVec(name, help string, labels ...string) CounterVec {
+	return CounterVec{register(newVec(metricInfo{name, help, "counter"}, labels, func() sampler { return &Counter{} }))}
+}
+
+// GaugeVec is a gauge per combination of label values
+type GaugeVec struct{ *vec }
+
+func (v GaugeVec) With(values ...string) *Gauge { return v.with(values...).(*Gauge) }
+
+func newGaugeVec(name, help string, labels ...string) GaugeVec {
+	return GaugeVec{register(newVec(metricInfo{name, help, "gauge"}, labels, func() sampler { return &Gauge{} }))}
+}
+
+// HistogramVec is a histogram per combination of label values
+type HistogramVec struct{ *vec }
+
+func (v HistogramVec) With(values ...string) *Histogram { return v.with(values...).(*Histogram) }
+
+func newHistogramVec(name, help string, bounds []float64, labels ...string) HistogramVec {
+	return HistogramVec{register(newVec(metricInfo{name, help, "histogram"}, labels, func() sampler { return newHistogram(bounds) }))}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func braced(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// hostLabel is the host label value of a URL
+func hostLabel(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil {
+		return strings.ToLower(u.Host)
+	}
+	return ""
+}
+
+// handleMetrics serves the metrics to Prometheus
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w)
+}
@@ -0,0 +1,447 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+const (
+	packDataFile  = "pages.pack"
+	packIndexFile = "pages.idx"
+	// packCompactSuffix marks the files Compact writes before they replace the pack and its index
+	packCompactSuffix = ".compact"
+)
+
+// packIndexRecord is one line of the pack index. Later lines win, a deleted record drops the whole page.
+type packIndexRecord struct {
+	Key     string   `json:"key"`
+	Part    PagePart `json:"part,omitempty"`
+	Offset  int64    `json:"offset,omitempty"`
+	Length  int64    `json:"length,omitempty"`
+	Deleted bool     `json:"deleted,omitempty"`
+}
+
+type packSpan struct {
+	offset int64
+	length int64
+}
+
+// packStore appends every part to a single pack file and records where it went in an append-only index.
+// Replaced and deleted parts stay in the pack until Compact rewrites it.
+type packStore struct {
+	dir string
+
+	lock  sync.RWMutex
+	data  *os.File
+	index *os.File
+	// size is where the next part is appended
+	size  int64
+	pages map[string]map[PagePart]packSpan
+	// indexOffset is where the last complete line read from the index ends, indexInfo the index it was read from
+	indexOffset int64
+	indexInfo   os.FileInfo
+
+	// readOnly stores follow a writer in another process, see openPackReader
+	readOnly bool
+	dataInfo os.FileInfo
+	// retired are the packs a compaction replaced, parts opened before may still be reading them
+	retired []*os.File
+}
+
+func openPackStore(dir string) (*packStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := finishCompaction(dir); err != nil {
+		return nil, err
+	}
+	data, err := os.OpenFile(filepath.Join(dir, packDataFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := data.Stat()
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+	s := &packStore{dir: dir, data: data, size: info.Size(), pages: make(map[string]map[PagePart]packSpan)}
+	if err := s.loadIndex(); err != nil {
+		data.Close()
+		return nil, err
+	}
+	s.index, err = os.OpenFile(filepath.Join(dir, packIndexFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+	// Cut off a torn last line from a crash, so the next record starts on a line of its own
+	if err := s.index.Truncate(s.indexOffset); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// openPackReader opens the pack store in dir for reading only, next to a crawl that may be
+// writing and compacting it. Every read first picks up what the writer appended since, and
+// switches to the new pack once a compaction replaced it. A missing pack is empty until a
+// writer creates it.
+func openPackReader(dir string) (*packStore, error) {
+	s := &packStore{dir: dir, readOnly: true, pages: make(map[string]map[PagePart]packSpan)}
+	if err := s.refresh(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// refresh follows the writer of a read-only store
+func (s *packStore) refresh() error {
+	dataPath := filepath.Join(s.dir, packDataFile)
+	indexPath := filepath.Join(s.dir, packIndexFile)
+	_, packErr := os.Stat(dataPath + packCompactSuffix)
+	if _, err := os.Stat(indexPath + packCompactSuffix); err == nil && os.IsNotExist(packErr) {
+		// Compact is between moving the new pack and its index into place,
+		// keep reading what was loaded before until the index follows
+		return nil
+	}
+	info, err := os.Stat(dataPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if s.data == nil || !os.SameFile(s.dataInfo, info) {
+		data, err := os.Open(dataPath)
+		if err != nil {
+			return err
+		}
+		if s.dataInfo, err = data.Stat(); err != nil {
+			data.Close()
+			return err
+		}
+		if s.data != nil {
+			s.retired = append(s.retired, s.data)
+		}
+		s.data = data
+		s.pages, s.indexInfo, s.indexOffset = make(map[string]map[PagePart]packSpan), nil, 0
+	}
+	return s.loadIndex()
+}
+
+// loadIndex replays the lines appended to the index since the last call. A torn last line or a
+// span past the end of the pack is what a crash in the middle of a Put leaves behind, those are
+// skipped. When the index was replaced in the meantime it is read again from the start.
+func (s *packStore) loadIndex() error {
+	file, err := os.Open(filepath.Join(s.dir, packIndexFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if s.indexInfo != nil && (!os.SameFile(s.indexInfo, info) || info.Size() < s.indexOffset) {
+		s.pages, s.indexOffset = make(map[string]map[PagePart]packSpan), 0
+	}
+	s.indexInfo = info
+	if _, err := file.Seek(s.indexOffset, io.SeekStart); err != nil {
+		return err
+	}
+	var records []packIndexRecord
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		s.indexOffset += int64(len(line))
+		var record packIndexRecord
+		if err := json.Unmarshal(line, &record); err != nil || record.Key == "" {
+			continue
+		}
+		records = append(records, record)
+	}
+	if s.readOnly {
+		// The writer appends a part before its index line, so the pack now holds every part read above
+		info, err := s.data.Stat()
+		if err != nil {
+			return err
+		}
+		s.size = info.Size()
+	}
+	for _, record := range records {
+		if record.Deleted {
+			delete(s.pages, record.Key)
+			continue
+		}
+		if record.Offset < 0 || record.Length < 0 || record.Offset+record.Length > s.size {
+			continue
+		}
+		s.setSpan(record.Key, record.Part, packSpan{record.Offset, record.Length})
+	}
+	return nil
+}
+
+// follow picks up the changes of the writer before a read from a read-only store
+func (s *packStore) follow() {
+	if !s.readOnly {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.refresh(); err != nil {
+		fmt.Println("Could not read the pack index:", err)
+	}
+}
+
+// errPackReadOnly is returned by the writes to a store opened with openPackReader
+var errPackReadOnly = errors.New("the pack store is open for reading only")
+
+func (s *packStore) setSpan(key string, part PagePart, span packSpan) {
+	parts := s.pages[key]
+	if parts == nil {
+		parts = make(map[PagePart]packSpan, len(pageParts))
+		s.pages[key] = parts
+	}
+	parts[part] = span
+}
+
+func (s *packStore) writeIndex(record packIndexRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = s.index.Write(append(data, '\n'))
+	return err
+}
+
+func (s *packStore) Put(key string, part PagePart, r io.Reader) error {
+	if s.readOnly {
+		return errPackReadOnly
+	}
+	// Spool the part first so a slow body doesn't hold up the other writers
+	spool, err := os.CreateTemp(s.dir, "put-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	length, err := io.Copy(spool, r)
+	if err != nil {
+		return err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	offset := s.size
+	written, err := io.Copy(io.NewOffsetWriter(s.data, offset), spool)
+	if err != nil || written != length {
+		// Drop whatever made it into the pack, the previous version stays in place
+		s.data.Truncate(offset)
+		return fmt.Errorf("writing %s.%s to the pack: %w", key, part, err)
+	}
+	if err := s.writeIndex(packIndexRecord{Key: key, Part: part, Offset: offset, Length: length}); err != nil {
+		s.data.Truncate(offset)
+		return err
+	}
+	s.size += length
+	s.setSpan(key, part, packSpan{offset, length})
+	return nil
+}
+
+// packReader reads one part out of the pack
+type packReader struct {
+	*io.SectionReader
+}
+
+func (packReader) Close() error { return nil }
+
+func (s *packStore) Get(key string, part PagePart) (io.ReadSeekCloser, error) {
+	s.follow()
+	s.lock.RLock()
+	span, ok := s.pages[key][part]
+	data := s.data
+	s.lock.RUnlock()
+	if !ok {
+		return nil, &fs.PathError{Op: "get", Path: key + "." + string(part), Err: fs.ErrNotExist}
+	}
+	return packReader{io.NewSectionReader(data, span.offset, span.length)}, nil
+}
+
+func (s *packStore) Exists(key string, part PagePart) bool {
+	s.follow()
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	_, ok := s.pages[key][part]
+	return ok
+}
+
+func (s *packStore) Iterate(fn func(key string) error) error {
+	s.follow()
+	s.lock.RLock()
+	keys := make([]string, 0, len(s.pages))
+	for key := range s.pages {
+		keys = append(keys, key)
+	}
+	s.lock.RUnlock()
+	slices.Sort(keys)
+	for _, key := range keys {
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *packStore) Delete(key string) error {
+	if s.readOnly {
+		return errPackReadOnly
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.pages[key]; !ok {
+		return nil
+	}
+	if err := s.writeIndex(packIndexRecord{Key: key, Deleted: true}); err != nil {
+		return err
+	}
+	delete(s.pages, key)
+	return nil
+}
+
+// Compact rewrites the pack with only the current version of every part and returns the number
+// of bytes reclaimed. Parts opened with Get before must not be read afterwards.
+func (s *packStore) Compact() (int64, error) {
+	if s.readOnly {
+		return 0, errPackReadOnly
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	dataPath := filepath.Join(s.dir, packDataFile)
+	indexPath := filepath.Join(s.dir, packIndexFile)
+	data, err := os.OpenFile(dataPath+packCompactSuffix, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(data.Name())
+	defer data.Close()
+	index, err := os.OpenFile(indexPath+packCompactSuffix, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(index.Name())
+	defer index.Close()
+
+	keys := make([]string, 0, len(s.pages))
+	for key := range s.pages {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	pages := make(map[string]map[PagePart]packSpan, len(keys))
+	dataWriter, indexWriter := bufio.NewWriter(data), bufio.NewWriter(index)
+	encoder := json.NewEncoder(indexWriter)
+	var size int64
+	for _, key := range keys {
+		parts := make(map[PagePart]packSpan, len(s.pages[key]))
+		for _, part := range pageParts {
+			span, ok := s.pages[key][part]
+			if !ok {
+				continue
+			}
+			if _, err := io.Copy(dataWriter, io.NewSectionReader(s.data, span.offset, span.length)); err != nil {
+				return 0, fmt.Errorf("copying %s.%s: %w", key, part, err)
+			}
+			if err := encoder.Encode(packIndexRecord{Key: key, Part: part, Offset: size, Length: span.length}); err != nil {
+				return 0, err
+			}
+			parts[part] = packSpan{size, span.length}
+			size += span.length
+		}
+		pages[key] = parts
+	}
+	if err := dataWriter.Flush(); err != nil {
+		return 0, err
+	}
+	if err := indexWriter.Flush(); err != nil {
+		return 0, err
+	}
+	if err := data.Sync(); err != nil {
+		return 0, err
+	}
+	if err := index.Sync(); err != nil {
+		return 0, err
+	}
+
+	// The pack goes first, finishCompaction completes the swap if we crash in between
+	if err := os.Rename(data.Name(), dataPath); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(index.Name(), indexPath); err != nil {
+		return 0, err
+	}
+	newData, err := os.OpenFile(dataPath, os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	newIndex, err := os.OpenFile(indexPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		newData.Close()
+		return 0, err
+	}
+	s.data.Close()
+	s.index.Close()
+	reclaimed := s.size - size
+	s.data, s.index, s.size, s.pages = newData, newIndex, size, pages
+	return reclaimed, nil
+}
+
+// finishCompaction cleans up after a Compact that was interrupted. Before the compacted pack
+// replaced the old one, the old pack and index are still valid and the compacted files are
+// dropped. After it, the compacted index belongs to the pack and replaces the old index.
+func finishCompaction(dir string) error {
+	dataPath := filepath.Join(dir, packDataFile)
+	indexPath := filepath.Join(dir, packIndexFile)
+	if _, err := os.Stat(dataPath + packCompactSuffix); err == nil {
+		os.Remove(indexPath + packCompactSuffix)
+		return os.Remove(dataPath + packCompactSuffix)
+	}
+	if _, err := os.Stat(indexPath + packCompactSuffix); err == nil {
+		return os.Rename(indexPath+packCompactSuffix, indexPath)
+	}
+	return nil
+}
+
+func (s *packStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, retired := range s.retired {
+		retired.Close()
+	}
+	var indexErr error
+	if s.index != nil {
+		indexErr = s.index.Close()
+	}
+	if s.data != nil {
+		if err := s.data.Close(); err != nil {
+			return err
+		}
+	}
+	return indexErr
+}
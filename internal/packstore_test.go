@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readPart(t *testing.T, store PageStore, key string, part PagePart) string {
+	t.Helper()
+	r, err := store.Get(key, part)
+	if err != nil {
+		t.Fatalf("get %s.%s: %s", key, part, err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestPackStoreCompact(t *testing.T) {
+	dir := t.TempDir()
+	store, err := openPackStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, version := range []string{"first", "second", "third"} {
+		if err := store.Put("a", PartBody, strings.NewReader("a "+version)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Put("a", PartMeta, strings.NewReader(`{"url":"https://example.com/a"}`))
+	store.Put("b", PartBody, strings.NewReader("b"))
+	store.Put("gone", PartBody, strings.NewReader("deleted page"))
+	if err := store.Delete("gone"); err != nil {
+		t.Fatal(err)
+	}
+
+	reclaimed, ok, err := CompactPages(store)
+	if err != nil || !ok {
+		t.Fatalf("CompactPages = %d, %v, %v", reclaimed, ok, err)
+	}
+	if want := int64(len("a first") + len("a second") + len("deleted page")); reclaimed != want {
+		t.Errorf("reclaimed %d bytes, want %d", reclaimed, want)
+	}
+	check := func(store PageStore) {
+		t.Helper()
+		if got := readPart(t, store, "a", PartBody); got != "a third" {
+			t.Errorf("a.html = %q", got)
+		}
+		if got := readPart(t, store, "b", PartBody); got != "b" {
+			t.Errorf("b.html = %q", got)
+		}
+		if store.Exists("gone", PartBody) {
+			t.Error("deleted page survived the compaction")
+		}
+	}
+	check(store)
+
+	// Writes after the compaction land in the new pack, and everything survives a reopen
+	if err := store.Put("c", PartBody, strings.NewReader("c")); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	store, err = openPackStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	check(store)
+	if got := readPart(t, store, "c", PartBody); got != "c" {
+		t.Errorf("c.html = %q", got)
+	}
+	if info, _ := os.Stat(filepath.Join(dir, packDataFile)); info.Size() != int64(len(`a third{"url":"https://example.com/a"}bc`)) {
+		t.Errorf("pack is %d bytes", info.Size())
+	}
+}
+
+func TestPackStoreInterruptedCompaction(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// packRenamed is whether the crash came after the compacted pack replaced the old one
+		packRenamed bool
+	}{{"before the swap", false}, {"between the renames", true}} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := openPackStore(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			store.Put("a", PartBody, strings.NewReader("old"))
+			store.Put("a", PartBody, strings.NewReader("new"))
+			store.Close()
+
+			// Lay out the files a crash in the middle of Compact leaves behind
+			compactIndex := `{"key":"a","part":"html","length":3}` + "\n"
+			os.WriteFile(filepath.Join(dir, packIndexFile+packCompactSuffix), []byte(compactIndex), 0644)
+			if test.packRenamed {
+				os.WriteFile(filepath.Join(dir, packDataFile), []byte("new"), 0644)
+			} else {
+				os.WriteFile(filepath.Join(dir, packDataFile+packCompactSuffix), []byte("new"), 0644)
+			}
+
+			store, err = openPackStore(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			if got := readPart(t, store, "a", PartBody); got != "new" {
+				t.Errorf("a.html = %q", got)
+			}
+			for _, name := range []string{packDataFile, packIndexFile} {
+				if _, err := os.Stat(filepath.Join(dir, name+packCompactSuffix)); !os.IsNotExist(err) {
+					t.Errorf("%s%s was left behind", name, packCompactSuffix)
+				}
+			}
+		})
+	}
+}
+
+func TestPackReaderFollowsWriter(t *testing.T) {
+	dir := t.TempDir()
+	reader, err := openPackReader(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if reader.Exists("a", PartBody) {
+		t.Fatal("empty store has a page")
+	}
+
+	writer, err := openPackStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	writer.Put("a", PartBody, strings.NewReader("a first"))
+	writer.Put("a", PartBody, strings.NewReader("a second"))
+	writer.Put("gone", PartBody, strings.NewReader("deleted page"))
+	if got := readPart(t, reader, "a", PartBody); got != "a second" {
+		t.Errorf("a.html = %q before the compaction", got)
+	}
+	// A part opened before the compaction stays readable after it
+	opened, err := reader.Get("gone", PartBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer opened.Close()
+
+	writer.Delete("gone")
+	if _, _, err := CompactPages(writer); err != nil {
+		t.Fatal(err)
+	}
+	writer.Put("b", PartBody, strings.NewReader("b"))
+
+	if got := readPart(t, reader, "a", PartBody); got != "a second" {
+		t.Errorf("a.html = %q after the compaction", got)
+	}
+	if got := readPart(t, reader, "b", PartBody); got != "b" {
+		t.Errorf("b.html = %q", got)
+	}
+	if reader.Exists("gone", PartBody) {
+		t.Error("the reader still has a deleted page")
+	}
+	if data, err := io.ReadAll(opened); err != nil || string(data) != "deleted page" {
+		t.Errorf("part opened before the compaction reads %q, %v", data, err)
+	}
+	if err := reader.Put("c", PartBody, strings.NewReader("c")); err != errPackReadOnly {
+		t.Errorf("Put on a reader = %v", err)
+	}
+
+	// Between the renames of Compact the reader keeps what it had
+	os.WriteFile(filepath.Join(dir, packIndexFile+packCompactSuffix), nil, 0644)
+	os.WriteFile(filepath.Join(dir, "new.pack"), []byte("garbage"), 0644)
+	os.Rename(filepath.Join(dir, "new.pack"), filepath.Join(dir, packDataFile))
+	if got := readPart(t, reader, "a", PartBody); got != "a second" {
+		t.Errorf("a.html = %q in the middle of a compaction", got)
+	}
+}
+
+func TestPackStoreTornIndexLine(t *testing.T) {
+	dir := t.TempDir()
+	store, err := openPackStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Put("a", PartBody, strings.NewReader("a"))
+	store.Close()
+	// A crash in the middle of writing an index line
+	index, _ := os.OpenFile(filepath.Join(dir, packIndexFile), os.O_WRONLY|os.O_APPEND, 0644)
+	index.WriteString(`{"key":"b","part":"ht`)
+	index.Close()
+
+	store, err = openPackStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Put("c", PartBody, strings.NewReader("c"))
+	store.Close()
+	store, err = openPackStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if got := readPart(t, store, "c", PartBody); got != "c" {
+		t.Errorf("the part put after a torn index line reads %q", got)
+	}
+}
@@ -0,0 +1,202 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+
+	"crawler/models"
+)
+
+// PagePart is one of the parts stored per page
+type PagePart string
+
+const (
+	// PartBody is the raw response body, whatever its content type
+	PartBody PagePart = "html"
+	// PartDocument is the extracted models.Document as JSON
+	PartDocument PagePart = "json"
+	// PartMeta is the models.PageMeta as JSON
+	PartMeta PagePart = "meta"
+)
+
+// pageParts lists every part, a page is stored if it has any of them
+var pageParts = []PagePart{PartBody, PartDocument, PartMeta}
+
+// PageStore keeps the crawled pages. A page is addressed by its key from PageKey and has up to one
+// of each PagePart. Implementations are safe for concurrent use.
+type PageStore interface {
+	// Put stores a part, an older version is only replaced once r was read completely
+	Put(key string, part PagePart, r io.Reader) error
+	// Get opens a stored part, the error satisfies os.IsNotExist if there is none
+	Get(key string, part PagePart) (io.ReadSeekCloser, error)
+	Exists(key string, part PagePart) bool
+	// Iterate calls fn with the key of every stored page in key order, stopping at the first error
+	Iterate(fn func(key string) error) error
+	// Delete removes all parts of a page
+	Delete(key string) error
+	Close() error
+}
+
+// Page store backends, selected with -store
+const (
+	StoreFlat    = "flat"
+	StoreSharded = "sharded"
+	StorePack    = "pack"
+)
+
+// OpenPageStore opens the store of the given backend in dir. The flat backend is the
+// historic ./site layout, so existing crawls are readable without converting them.
+func OpenPageStore(backend, dir string) (PageStore, error) {
+	switch backend {
+	case StoreFlat, "":
+		return newFlatStore(dir)
+	case StoreSharded:
+		return newShardedStore(dir)
+	case StorePack:
+		return openPackStore(dir)
+	}
+	return nil, fmt.Errorf("unknown page store %q, use %s, %s or %s", backend, StoreFlat, StoreSharded, StorePack)
+}
+
+// OpenPageStoreReader opens the store in dir for modes that only read it, while a crawl may be
+// writing it. The flat and sharded backends read the files as they are, the pack backend follows
+// the appends and compactions of the writer.
+func OpenPageStoreReader(backend, dir string) (PageStore, error) {
+	if backend == StorePack {
+		return openPackReader(dir)
+	}
+	return OpenPageStore(backend, dir)
+}
+
+// compactingStore is implemented by stores that keep replaced parts around until they are compacted
+type compactingStore interface {
+	Compact() (int64, error)
+}
+
+// CompactPages reclaims the space taken by replaced and deleted parts. ok is false
+// when the store has nothing to compact because it replaces parts in place.
+func CompactPages(store PageStore) (reclaimed int64, ok bool, err error) {
+	compacter, ok := store.(compactingStore)
+	if !ok {
+		return 0, false, nil
+	}
+	reclaimed, err = compacter.Compact()
+	return reclaimed, true, err
+}
+
+// CopyPages copies every page of src into dst and returns the number of pages copied
+func CopyPages(dst, src PageStore) (int, error) {
+	copied := 0
+	err := src.Iterate(func(key string) error {
+		for _, part := range pageParts {
+			r, err := src.Get(key, part)
+			if err != nil {
+				continue
+			}
+			err = dst.Put(key, part, r)
+			r.Close()
+			if err != nil {
+				return fmt.Errorf("copying %s.%s: %w", key, part, err)
+			}
+		}
+		copied++
+		return nil
+	})
+	return copied, err
+}
+
+// RekeyPages moves the pages stored under another key than the one of their URL to that key.
+// Pages stored before URLs were normalized have such keys, and a crawl would fetch them again
+// under the new one. When the new key is taken already, the page stored there is the fresher
+// copy and the old one is deleted. It returns the number of pages moved and deleted.
+func RekeyPages(store PageStore, catalog *Catalog) (moved, dropped int, err error) {
+	type rekey struct{ from, to string }
+	var rekeys []rekey
+	err = store.Iterate(func(key string) error {
+		url := ""
+		if meta, err := loadPageMeta(store, key); err == nil {
+			url = meta.URL
+		} else if doc, err := loadDocument(store, key); err == nil {
+			url = doc.URL
+		}
+		if url != "" && PageKey(url) != key {
+			rekeys = append(rekeys, rekey{key, PageKey(url)})
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, r := range rekeys {
+		taken := slices.ContainsFunc(pageParts, func(part PagePart) bool { return store.Exists(r.to, part) })
+		if !taken {
+			for _, part := range pageParts {
+				src, err := store.Get(r.from, part)
+				if err != nil {
+					continue
+				}
+				err = store.Put(r.to, part, src)
+				src.Close()
+				if err != nil {
+					return moved, dropped, fmt.Errorf("moving %s.%s to %s: %w", r.from, part, r.to, err)
+				}
+			}
+		}
+		if err := store.Delete(r.from); err != nil {
+			return moved, dropped, fmt.Errorf("deleting %s: %w", r.from, err)
+		}
+		if err := catalog.Move(r.from, r.to); err != nil {
+			return moved, dropped, err
+		}
+		if taken {
+			dropped++
+		} else {
+			moved++
+		}
+	}
+	return moved, dropped, nil
+}
+
+// loadJSONPart decodes a JSON part of a page into v
+func loadJSONPart(store PageStore, key string, part PagePart, v any) error {
+	r, err := store.Get(key, part)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return json.NewDecoder(r).Decode(v)
+}
+
+func saveJSONPart(store PageStore, key string, part PagePart, v any) error {
+	// Indented for readability, like the files of the flat layout always were
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return store.Put(key, part, bytes.NewReader(data))
+}
+
+// loadPageMeta reads the fetch state of a stored page
+func loadPageMeta(store PageStore, key string) (models.PageMeta, error) {
+	var meta models.PageMeta
+	err := loadJSONPart(store, key, PartMeta, &meta)
+	return meta, err
+}
+
+func savePageMeta(store PageStore, key string, meta models.PageMeta) error {
+	return saveJSONPart(store, key, PartMeta, meta)
+}
+
+// loadDocument reads the extracted document of a stored page
+func loadDocument(store PageStore, key string) (models.Document, error) {
+	var doc models.Document
+	err := loadJSONPart(store, key, PartDocument, &doc)
+	return doc, err
+}
+
+func saveDocument(store PageStore, key string, doc models.Document) error {
+	return saveJSONPart(store, key, PartDocument, doc)
+}
@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"strings"
+	"testing"
+
+	"crawler/models"
+)
+
+// rawKey is the key the baseline stored a page under: the hash of its URL as it was linked
+func rawKey(url string) string {
+	hashed := sha256.Sum256([]byte(url))
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(hashed[:])
+}
+
+func TestRekeyPages(t *testing.T) {
+	store, err := OpenPageStore(StorePack, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// An old page known only by its document, one whose new key holds a fresher copy,
+	// and one stored under its current key already
+	oldURL, takenURL, currentURL := "https://EXAMPLE.com:443/a?b=2&a=1", "https://example.com/b/", "https://example.com/c"
+	saveDocument(store, rawKey(oldURL), models.Document{URL: oldURL, Title: "a"})
+	store.Put(rawKey(oldURL), PartBody, strings.NewReader("<p>a</p>"))
+	savePageMeta(store, rawKey(takenURL), models.PageMeta{URL: takenURL, Status: 200})
+	store.Put(rawKey(takenURL), PartBody, strings.NewReader("old b"))
+	store.Put(PageKey(takenURL), PartBody, strings.NewReader("new b"))
+	savePageMeta(store, PageKey(currentURL), models.PageMeta{URL: currentURL})
+
+	moved, dropped, err := RekeyPages(store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 1 || dropped != 1 {
+		t.Errorf("moved %d and dropped %d pages, want 1 and 1", moved, dropped)
+	}
+	if rawKey(oldURL) == PageKey(oldURL) || rawKey(takenURL) == PageKey(takenURL) {
+		t.Fatal("test URLs are normalized already")
+	}
+	for _, key := range []string{rawKey(oldURL), rawKey(takenURL)} {
+		if store.Exists(key, PartBody) {
+			t.Errorf("page left under its old key %s", key)
+		}
+	}
+	if doc, err := loadDocument(store, PageKey(oldURL)); err != nil || doc.Title != "a" {
+		t.Errorf("moved document = %+v, %v", doc, err)
+	}
+	if got := readPart(t, store, PageKey(oldURL), PartBody); got != "<p>a</p>" {
+		t.Errorf("moved body = %q", got)
+	}
+	if got := readPart(t, store, PageKey(takenURL), PartBody); got != "new b" {
+		t.Errorf("fresher copy replaced by %q", got)
+	}
+	if !store.Exists(PageKey(currentURL), PartMeta) {
+		t.Error("page under its current key was touched")
+	}
+}
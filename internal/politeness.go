@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Responses faster than this let the scheduler speed back up towards the minimum delay
+	healthyLatency = time.Second
+	// Responses slower than this are treated like a struggling server
+	slowLatency = 5 * time.Second
+	// Retry-After values above this are capped so one host can't park a worker for hours
+	maxRetryAfter = 10 * time.Minute
+)
+
+// errCrawlStopped is returned by waits cut short because the crawl is stopping
+var errCrawlStopped = errors.New("crawl stopped")
+
+// hostSchedule paces the requests sent to a single host
+type hostSchedule struct {
+	// slots limits the number of concurrent connections to the host
+	slots chan struct{}
+
+	lock     sync.Mutex
+	next     time.Time
+	delay    time.Duration
+	minDelay time.Duration
+	maxDelay time.Duration
+}
+
+var politeness = struct {
+	lock  sync.Mutex
+	hosts map[string]*hostSchedule
+}{hosts: make(map[string]*hostSchedule)}
+
+// hostScheduleFor returns the scheduler of u's host, creating it on first use.
+// The minimum delay is the configured one or the robots.txt Crawl-delay, whichever is larger.
+func hostScheduleFor(u *url.URL) *hostSchedule {
+	key := strings.ToLower(u.Host)
+
+	politeness.lock.Lock()
+	h, ok := politeness.hosts[key]
+	politeness.lock.Unlock()
+	if ok {
+		return h
+	}
+
+	// robots.txt may have to be fetched, which must not hold up the scheduling of other hosts
+	minDelay := crawlConfig.MinHostDelay
+	if rules := robotsFor(u); rules != nil && rules.CrawlDelay > minDelay {
+		minDelay = rules.CrawlDelay
+	}
+
+	politeness.lock.Lock()
+	defer politeness.lock.Unlock()
+	if h, ok := politeness.hosts[key]; ok {
+		// Another worker got there first
+		return h
+	}
+	maxDelay := max(crawlConfig.MaxHostDelay, minDelay)
+	h = &hostSchedule{
+		slots:    make(chan struct{}, max(crawlConfig.MaxHostConns, 1)),
+		delay:    minDelay,
+		minDelay: minDelay,
+		maxDelay: maxDelay,
+	}
+	politeness.hosts[key] = h
+	return h
+}
+
+// acquire blocks until a connection slot is free and the host's delay has passed.
+// It returns an error without holding a slot if the crawl stops or ctx is cancelled first.
+func (h *hostSchedule) acquire(ctx context.Context) error {
+	select {
+	case h.slots <- struct{}{}:
+	case <-crawlStop:
+		return errCrawlStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	h.lock.Lock()
+	now := time.Now()
+	start := h.next
+	if start.Before(now) {
+		start = now
+	}
+	// Reserve our start time so concurrent callers line up behind us
+	h.next = start.Add(h.delay)
+	h.lock.Unlock()
+
+	timer := time.NewTimer(time.Until(start))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-crawlStop:
+		<-h.slots
+		return errCrawlStopped
+	case <-ctx.Done():
+		<-h.slots
+		return ctx.Err()
+	}
+}
+
+// release frees the connection slot and adapts the delay to how the host responded.
+// status is 0 when the request failed without a response.
+func (h *hostSchedule) release(status int, latency time.Duration, retryAfter string) {
+	<-h.slots
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	switch {
+	case status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable:
+		h.delay = min(max(h.delay*2, time.Second), h.maxDelay)
+		if wait, ok := parseRetryAfter(retryAfter); ok {
+			if until := time.Now().Add(min(wait, maxRetryAfter)); until.After(h.next) {
+				h.next = until
+			}
+		}
+	case status == 0 || status >= 500 || latency > slowLatency:
+		h.delay = min(max(h.delay*3/2, time.Second), h.maxDelay)
+	case latency < healthyLatency:
+		h.delay = max(h.delay*4/5, h.minDelay)
+	}
+}
+
+// parseRetryAfter understands both forms of Retry-After: delay-seconds and an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0), true
+	}
+	return 0, false
+}
@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"sync"
+
+	"crawler/models"
+)
+
+// entryQueue is the unbounded FIFO of entries waiting for a worker. Workers queue the links
+// of the pages they process while being its only consumers, so pushing must never block.
+type entryQueue struct {
+	lock    sync.Mutex
+	entries []models.FrontierEntry
+	head    int
+	// ready holds a token while entries are waiting
+	ready chan struct{}
+}
+
+func newEntryQueue() *entryQueue {
+	return &entryQueue{ready: make(chan struct{}, 1)}
+}
+
+func (q *entryQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// push appends an entry
+func (q *entryQueue) push(entry models.FrontierEntry) {
+	q.lock.Lock()
+	q.entries = append(q.entries, entry)
+	q.lock.Unlock()
+	q.signal()
+}
+
+// pop takes the oldest entry, waiting for one until quit or crawlStop is closed
+func (q *entryQueue) pop(quit <-chan struct{}) (models.FrontierEntry, bool) {
+	for {
+		q.lock.Lock()
+		if q.head < len(q.entries) {
+			entry := q.entries[q.head]
+			q.entries[q.head] = models.FrontierEntry{}
+			q.head++
+			// Drop the taken part once it makes up most of the slice
+			if q.head > len(q.entries)/2 {
+				q.entries = append(q.entries[:0:0], q.entries[q.head:]...)
+				q.head = 0
+			}
+			more := q.head < len(q.entries)
+			q.lock.Unlock()
+			if more {
+				// Pass the token on to the next waiting worker
+				q.signal()
+			}
+			return entry, true
+		}
+		q.lock.Unlock()
+		select {
+		case <-q.ready:
+		case <-quit:
+			return models.FrontierEntry{}, false
+		case <-crawlStop:
+			return models.FrontierEntry{}, false
+		}
+	}
+}
+
+// len is the number of waiting entries
+func (q *entryQueue) len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.entries) - q.head
+}
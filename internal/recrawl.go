@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"crawler/models"
+)
+
+const (
+	// recrawlHistorySize is how many visits are kept per page for the change-rate estimate
+	recrawlHistorySize = 32
+	// defaultRecrawlInterval is used until a page has been visited at least twice
+	defaultRecrawlInterval = 24 * time.Hour
+)
+
+// recordVisit appends a visit to the page's history and plans the next one.
+// hash is the main text hash of this fetch, empty when the server answered 304 Not Modified.
+func recordVisit(meta *models.PageMeta, hash string, at time.Time) {
+	changed := hash != "" && meta.ContentHash != "" && hash != meta.ContentHash
+	if hash != "" {
+		meta.ContentHash = hash
+	}
+	// The first visit only sets the baseline, later ones are the observations
+	meta.History = append(meta.History, models.PageVisit{At: at, Changed: changed})
+	if len(meta.History) > recrawlHistorySize {
+		meta.History = meta.History[len(meta.History)-recrawlHistorySize:]
+	}
+	planNextVisit(meta, at)
+}
+
+// planNextVisit estimates how often a page changes and schedules the next visit accordingly.
+// The estimator assumes Poisson distributed changes observed at irregular intervals:
+// rate = -ln((n - X + 0.5) / (n + 0.5)) / meanInterval, with n revisits of which X saw a change.
+func planNextVisit(meta *models.PageMeta, now time.Time) {
+	revisits := len(meta.History) - 1
+	if revisits < 1 {
+		meta.ChangeRate = 0
+		meta.NextVisit = now.Add(clampRecrawlInterval(defaultRecrawlInterval))
+		return
+	}
+
+	changes := 0
+	for _, visit := range meta.History[1:] {
+		if visit.Changed {
+			changes++
+		}
+	}
+	span := meta.History[len(meta.History)-1].At.Sub(meta.History[0].At)
+	meanInterval := span / time.Duration(revisits)
+	if meanInterval <= 0 {
+		meanInterval = time.Minute
+	}
+
+	n, x := float64(revisits), float64(changes)
+	perInterval := -math.Log((n - x + 0.5) / (n + 0.5))
+	meta.ChangeRate = perInterval / meanInterval.Hours() * 24
+
+	var interval time.Duration
+	if perInterval <= 0 {
+		// Never seen a change: back off exponentially
+		interval = meanInterval * 2
+	} else {
+		interval = time.Duration(float64(meanInterval) / perInterval)
+	}
+	meta.NextVisit = now.Add(clampRecrawlInterval(interval))
+}
+
+func clampRecrawlInterval(interval time.Duration) time.Duration {
+	return min(max(interval, crawlConfig.MinRecrawlInterval), crawlConfig.MaxRecrawlInterval)
+}
+
+// dueForRecrawl lists stored pages whose next visit has come, most overdue first, capped at budget
+func dueForRecrawl(store PageStore, budget int, now time.Time) ([]models.FrontierEntry, int, error) {
+	type duePage struct {
+		entry models.FrontierEntry
+		next  time.Time
+	}
+	var due []duePage
+	err := store.Iterate(func(key string) error {
+		meta, err := loadPageMeta(store, key)
+		if err != nil || meta.URL == "" {
+			return nil
+		}
+		next := meta.NextVisit
+		if next.IsZero() {
+			// Fetched before visits were scheduled
+			next = meta.FetchedAt.Add(defaultRecrawlInterval)
+		}
+		if !next.After(now) {
+			due = append(due, duePage{entry: models.FrontierEntry{URL: meta.URL}, next: next})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].next.Before(due[j].next)
+	})
+
+	total := len(due)
+	if budget > 0 && len(due) > budget {
+		due = due[:budget]
+	}
+	entries := make([]models.FrontierEntry, len(due))
+	for i, page := range due {
+		entries[i] = page.entry
+	}
+	return entries, total, nil
+}
+
+// StartRecrawl runs one recrawl round: it revalidates the stored pages that are due,
+// without following links, fetching at most cfg.RecrawlBudget pages
+func StartRecrawl(ctx context.Context, cfg CrawlConfig) {
+	crawlConfig = cfg
+	due, total, err := dueForRecrawl(cfg.Store, cfg.RecrawlBudget, time.Now())
+	if err != nil {
+		fmt.Println("Could not read the stored pages:", err)
+		return
+	}
+	fmt.Printf("%d pages are due for a recrawl, visiting %d of them\n", total, len(due))
+	if len(due) == 0 {
+		return
+	}
+	cfg.Refresh = true
+	cfg.FollowLinks = false
+	cfg.MaxPages = len(due)
+	runCrawl(ctx, cfg, due)
+}
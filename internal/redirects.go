@@ -0,0 +1,291 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"crawler/models"
+)
+
+const aliasesLogFile = "aliases.jsonl"
+
+var (
+	errTooManyRedirects   = errors.New("too many redirects")
+	errRedirectOutOfScope = errors.New("redirect leaves the crawl scope")
+	errRedirectBlocked    = errors.New("redirect target is disallowed by robots.txt")
+)
+
+// pageFetchKey marks the context of page requests, robots.txt and sitemap requests
+// follow redirects without the scope and robots checks
+type pageFetchKey struct{}
+
+// aliasKind tells how a URL became the alias of another one
+type aliasKind string
+
+const (
+	aliasRedirect  aliasKind = "redirect"
+	aliasCanonical aliasKind = "canonical"
+)
+
+// aliasRecord is one line of the aliases log: a fetch that ended on a different URL,
+// or a page whose canonical URL points elsewhere. An empty Final drops the aliases again.
+type aliasRecord struct {
+	At    time.Time `json:"at"`
+	Kind  aliasKind `json:"kind,omitempty"`
+	Final string    `json:"final"`
+	// Chain lists every URL before the final one, starting with the requested URL
+	Chain []string `json:"chain"`
+}
+
+type aliasTarget struct {
+	final string
+	kind  aliasKind
+}
+
+// aliasMap maps every URL that redirects or is canonicalized somewhere to its final URL
+var aliasMap = struct {
+	lock    sync.Mutex
+	finals  map[string]aliasTarget
+	file    *os.File
+	writer  *bufio.Writer
+	records int
+}{finals: make(map[string]aliasTarget)}
+
+// withPageFetch marks req as a page fetch, see checkRedirect
+func withPageFetch(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), pageFetchKey{}, true))
+}
+
+// checkRedirect caps the redirect hops. Page fetches also refuse to follow redirects
+// out of the crawl scope or to URLs robots.txt disallows.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > crawlConfig.MaxRedirects {
+		return errTooManyRedirects
+	}
+	req.Header.Set("User-Agent", crawlConfig.UserAgent)
+	if req.Context().Value(pageFetchKey{}) == nil {
+		return nil
+	}
+	target := normalizeOrRaw(req.URL.String())
+	if !inScope(target) {
+		return errRedirectOutOfScope
+	}
+	if !allowedByRobots(target) {
+		return errRedirectBlocked
+	}
+	return nil
+}
+
+// redirectChain returns the normalized URLs a response was redirected through, oldest first,
+// and the normalized final URL. The chain is empty when there was no redirect.
+func redirectChain(resp *http.Response) ([]string, string) {
+	final := normalizeOrRaw(resp.Request.URL.String())
+	var chain []string
+	for r := resp.Request; r.Response != nil && r.Response.Request != nil; r = r.Response.Request {
+		if hop := normalizeOrRaw(r.Response.Request.URL.String()); hop != final && !slices.Contains(chain, hop) {
+			chain = append(chain, hop)
+		}
+	}
+	slices.Reverse(chain)
+	return chain, final
+}
+
+func normalizeOrRaw(raw string) string {
+	if normalized, err := urlNormalizer.Normalize(raw); err == nil {
+		return normalized
+	}
+	return raw
+}
+
+// loadAliases reads the aliases log so known redirects are never queued again
+func loadAliases() error {
+	if err := os.MkdirAll(crawlStateDir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(crawlStateDir, aliasesLogFile)
+	if file, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var record aliasRecord
+			if json.Unmarshal(scanner.Bytes(), &record) != nil {
+				continue
+			}
+			for _, alias := range record.Chain {
+				if record.Final == "" {
+					delete(aliasMap.finals, alias)
+					continue
+				}
+				aliasMap.finals[alias] = aliasTarget{final: record.Final, kind: record.Kind}
+			}
+		}
+		for alias, target := range aliasMap.finals {
+			// Canonical variants are still visited for their links, redirects never again
+			if target.kind != aliasCanonical {
+				safeSet.Add(alias)
+			}
+		}
+		file.Close()
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	aliasMap.file = file
+	aliasMap.writer = bufio.NewWriter(file)
+	return nil
+}
+
+// recordAliases remembers the aliases of final, marks them as seen and logs them
+func recordAliases(kind aliasKind, chain []string, final string) {
+	aliasMap.lock.Lock()
+	defer aliasMap.lock.Unlock()
+	changed := false
+	for _, alias := range chain {
+		target := aliasTarget{final: final, kind: kind}
+		if aliasMap.finals[alias] != target {
+			aliasMap.finals[alias] = target
+			changed = true
+		}
+		safeSet.Add(alias)
+	}
+	if changed {
+		writeAliasRecord(aliasRecord{At: time.Now(), Kind: kind, Final: final, Chain: chain})
+	}
+}
+
+// forgetAlias drops url from the alias map, it was fetched and turned out to be a page of its own
+func forgetAlias(url string) {
+	aliasMap.lock.Lock()
+	defer aliasMap.lock.Unlock()
+	if _, ok := aliasMap.finals[url]; !ok {
+		return
+	}
+	delete(aliasMap.finals, url)
+	writeAliasRecord(aliasRecord{At: time.Now(), Chain: []string{url}})
+}
+
+// writeAliasRecord appends to the aliases log, aliasMap.lock must be held
+func writeAliasRecord(record aliasRecord) {
+	if aliasMap.writer == nil {
+		return
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	aliasMap.writer.Write(data)
+	aliasMap.writer.WriteByte('\n')
+	aliasMap.records++
+	if aliasMap.records%100 == 0 {
+		aliasMap.writer.Flush()
+	}
+}
+
+// aliasesOf lists every known alias of final
+func aliasesOf(final string) []string {
+	aliasMap.lock.Lock()
+	defer aliasMap.lock.Unlock()
+	var aliases []string
+	for alias, target := range aliasMap.finals {
+		if target.final == final {
+			aliases = append(aliases, alias)
+		}
+	}
+	slices.Sort(aliases)
+	return aliases
+}
+
+// pageLocks serializes the updates of a stored page's document and meta between workers,
+// e.g. the fetch of the page and the merge of aliases found while fetching another page
+var pageLocks = struct {
+	lock  sync.Mutex
+	pages map[string]*pageLock
+}{pages: make(map[string]*pageLock)}
+
+type pageLock struct {
+	sync.Mutex
+	// users counts the holders and waiters, the lock is dropped when the last one is done
+	users int
+}
+
+// lockPage locks the stored page of key and returns the function that unlocks it.
+// No other page may be locked while holding it.
+func lockPage(key string) (unlock func()) {
+	pageLocks.lock.Lock()
+	l := pageLocks.pages[key]
+	if l == nil {
+		l = &pageLock{}
+		pageLocks.pages[key] = l
+	}
+	l.users++
+	pageLocks.lock.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		pageLocks.lock.Lock()
+		if l.users--; l.users == 0 {
+			delete(pageLocks.pages, key)
+		}
+		pageLocks.lock.Unlock()
+	}
+}
+
+// saveFetchedMeta saves the meta of a page that was loaded before its fetch. A reindex flag
+// set meanwhile, by an alias merge, is kept. The page must be locked.
+func saveFetchedMeta(key string, meta *models.PageMeta) error {
+	if stored, err := loadPageMeta(pageStore, key); err == nil && stored.NeedsReindex {
+		meta.NeedsReindex = true
+	}
+	return savePageMeta(pageStore, key, *meta)
+}
+
+// addAliasesToStoredDocument merges newly found aliases into the stored document of a final URL
+// and flags it for reindexing, so the index keeps one document per final URL
+func addAliasesToStoredDocument(key string, aliases []string) {
+	defer lockPage(key)()
+	doc, err := loadDocument(pageStore, key)
+	if err != nil {
+		return
+	}
+	changed := false
+	for _, alias := range aliases {
+		if alias != doc.URL && !slices.Contains(doc.Aliases, alias) {
+			doc.Aliases = append(doc.Aliases, alias)
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	slices.Sort(doc.Aliases)
+	if err := saveDocument(pageStore, key, doc); err != nil {
+		fmt.Printf("Error saving aliases of %s: %s\n", doc.URL, err)
+		return
+	}
+	if meta, err := loadPageMeta(pageStore, key); err == nil {
+		meta.NeedsReindex = true
+		savePageMeta(pageStore, key, meta)
+	}
+}
+
+func closeAliases() {
+	aliasMap.lock.Lock()
+	defer aliasMap.lock.Unlock()
+	if aliasMap.writer != nil {
+		aliasMap.writer.Flush()
+		aliasMap.file.Close()
+		aliasMap.writer, aliasMap.file = nil, nil
+	}
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"crawler/helpers"
+	"crawler/models"
+)
+
+const (
+	robotsMaxBytes   = 512 * 1024
+	robotsTTL        = 24 * time.Hour
+	robotsFailureTTL = time.Minute
+	// robotsMaxRetries is how often an entry waits for an unreachable robots.txt before it is given up on
+	robotsMaxRetries = 5
+)
+
+var errRobotsUnavailable = errors.New("robots.txt could not be fetched")
+
+type robotsEntry struct {
+	once    sync.Once
+	rules   *helpers.RobotsRules
+	expires time.Time
+	// failed is set when robots.txt could not be fetched, rules then disallow everything until expires
+	failed bool
+}
+
+// robotsCache keeps one robots.txt per scheme://host for the duration of the crawl
+var robotsCache = struct {
+	lock  sync.Mutex
+	hosts map[string]*robotsEntry
+}{hosts: make(map[string]*robotsEntry)}
+
+// robotsFor returns the cached rules for the host of u, fetching robots.txt on first use
+func robotsFor(u *url.URL) *helpers.RobotsRules {
+	return robotsEntryFor(u).rules
+}
+
+func robotsEntryFor(u *url.URL) *robotsEntry {
+	key := u.Scheme + "://" + u.Host
+
+	robotsCache.lock.Lock()
+	entry, ok := robotsCache.hosts[key]
+	if !ok || (!entry.expires.IsZero() && time.Now().After(entry.expires)) {
+		entry = &robotsEntry{}
+		robotsCache.hosts[key] = entry
+	}
+	robotsCache.lock.Unlock()
+
+	entry.once.Do(func() {
+		rules, ttl, failed := fetchRobots(key)
+		entry.rules, entry.failed = rules, failed
+		robotsCache.lock.Lock()
+		entry.expires = time.Now().Add(ttl)
+		robotsCache.lock.Unlock()
+	})
+	return entry
+}
+
+// fetchRobots downloads and parses robots.txt. Following RFC 9309 a missing file (4xx) allows
+// everything, while an unreachable one (5xx, network error) disallows everything for a short while,
+// which is reported as failed.
+func fetchRobots(origin string) (*helpers.RobotsRules, time.Duration, bool) {
+	disallowAll := helpers.ParseRobots(strings.NewReader("User-agent: *\nDisallow: /\n"), crawlConfig.UserAgent)
+
+	req, err := fetcher.NewRequest(origin + "/robots.txt")
+	if err != nil {
+		return disallowAll, robotsFailureTTL, true
+	}
+	resp, err := fetcher.Do(req)
+	if err != nil {
+		fmt.Printf("Could not fetch robots.txt for %s: %s\n", origin, err)
+		return disallowAll, robotsFailureTTL, true
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return helpers.ParseRobots(io.LimitReader(resp.Body, robotsMaxBytes), crawlConfig.UserAgent), robotsTTL, false
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return nil, robotsTTL, false
+	default:
+		fmt.Printf("robots.txt for %s answered %d, treating host as disallowed\n", origin, resp.StatusCode)
+		return disallowAll, robotsFailureTTL, true
+	}
+}
+
+// allowedByRobots reports whether the crawler may fetch rawURL
+func allowedByRobots(rawURL string) bool {
+	allowed, _ := robotsCheck(rawURL)
+	return allowed
+}
+
+// robotsCheck reports whether the crawler may fetch rawURL. A disallow that only stands because
+// robots.txt could not be fetched is no lasting verdict, retryAt is then when to ask again.
+func robotsCheck(rawURL string) (allowed bool, retryAt time.Time) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false, time.Time{}
+	}
+	path := u.EscapedPath()
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	entry := robotsEntryFor(u)
+	if entry.rules.Allowed(path) {
+		return true, time.Time{}
+	}
+	if entry.failed {
+		robotsCache.lock.Lock()
+		retryAt = entry.expires
+		robotsCache.lock.Unlock()
+	}
+	return false, retryAt
+}
+
+// requeueAfter queues entry again at the given time. It counts as pending work meanwhile,
+// so the crawl doesn't end while the entry waits.
+func requeueAfter(entry models.FrontierEntry, at time.Time) {
+	startWork()
+	time.AfterFunc(time.Until(at), func() {
+		defer finishWork()
+		queueEntry(entry)
+	})
+}
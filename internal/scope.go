@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// DefaultSeed is crawled when neither a scope file nor -seed is given
+const DefaultSeed = "https://barbadpiano.com/"
+
+// CrawlScope decides which URLs belong to a crawl. It can be loaded from a JSON file
+// and extended from the command line.
+type CrawlScope struct {
+	Seeds []string `json:"seeds"`
+	// AllowedHosts defaults to the hosts of the seeds
+	AllowedHosts []string `json:"allowed_hosts"`
+	// IncludeSubdomains also accepts any subdomain of an allowed host
+	IncludeSubdomains bool `json:"include_subdomains"`
+	// Include and Exclude are regexes matched against the path and query of a URL.
+	// With Include set a URL must match at least one of them, Exclude always wins.
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// BuildCrawlScope loads the scope file (if any), merges the flag values on top of it
+// and falls back to DefaultSeed when no seed was configured
+func BuildCrawlScope(path string, flags CrawlScope) (*CrawlScope, error) {
+	scope := &CrawlScope{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, scope); err != nil {
+			return nil, fmt.Errorf("invalid scope file %s: %w", path, err)
+		}
+	}
+	scope.Seeds = append(scope.Seeds, flags.Seeds...)
+	scope.AllowedHosts = append(scope.AllowedHosts, flags.AllowedHosts...)
+	scope.IncludeSubdomains = scope.IncludeSubdomains || flags.IncludeSubdomains
+	scope.Include = append(scope.Include, flags.Include...)
+	scope.Exclude = append(scope.Exclude, flags.Exclude...)
+
+	if len(scope.Seeds) == 0 {
+		// Keep the historic behaviour: barbadpiano.com including www. and other subdomains
+		scope.Seeds = []string{DefaultSeed}
+		scope.IncludeSubdomains = true
+	}
+	if err := scope.compile(); err != nil {
+		return nil, err
+	}
+	return scope, nil
+}
+
+func (s *CrawlScope) compile() error {
+	for i, seed := range s.Seeds {
+		u, err := url.Parse(strings.TrimSpace(seed))
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid seed URL %q", seed)
+		}
+		s.Seeds[i] = u.String()
+		if !s.hostAllowed(canonicalHost(u.Hostname())) {
+			s.AllowedHosts = append(s.AllowedHosts, u.Hostname())
+		}
+	}
+	for i, host := range s.AllowedHosts {
+		s.AllowedHosts[i] = canonicalHost(host)
+	}
+
+	s.include = s.include[:0]
+	for _, expr := range s.Include {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("invalid include pattern %q: %w", expr, err)
+		}
+		s.include = append(s.include, re)
+	}
+	s.exclude = s.exclude[:0]
+	for _, expr := range s.Exclude {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("invalid exclude pattern %q: %w", expr, err)
+		}
+		s.exclude = append(s.exclude, re)
+	}
+	return nil
+}
+
+func canonicalHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
+
+func (s *CrawlScope) hostAllowed(host string) bool {
+	for _, allowed := range s.AllowedHosts {
+		allowed = canonicalHost(allowed)
+		if host == allowed {
+			return true
+		}
+		if s.IncludeSubdomains && strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains reports whether u is inside the scope. Hosts are compared on the parsed
+// hostname, so lookalikes such as barbadpiano.com.attacker.net never match.
+func (s *CrawlScope) Contains(u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	if !s.hostAllowed(canonicalHost(u.Hostname())) {
+		return false
+	}
+
+	target := u.Path
+	if u.RawQuery != "" {
+		target += "?" + u.RawQuery
+	}
+	for _, re := range s.exclude {
+		if re.MatchString(target) {
+			return false
+		}
+	}
+	if len(s.include) == 0 {
+		return true
+	}
+	for _, re := range s.include {
+		if re.MatchString(target) {
+			return true
+		}
+	}
+	return false
+}
+
+// scopeLock guards the crawl scope against seeds added while the crawl runs
+var scopeLock sync.RWMutex
+
+// inScope reports whether a URL belongs to the crawl
+func inScope(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	scopeLock.RLock()
+	defer scopeLock.RUnlock()
+	return crawlConfig.Scope.Contains(u)
+}
+
+// addSeed adds a seed to the scope of the running crawl. Its host becomes allowed
+// just like the hosts of the seeds the crawl started with.
+func addSeed(rawURL string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", fmt.Errorf("invalid seed URL %q", rawURL)
+	}
+	scopeLock.Lock()
+	defer scopeLock.Unlock()
+	scope := crawlConfig.Scope
+	if scope == nil {
+		return "", fmt.Errorf("this crawl does not take seeds")
+	}
+	scope.Seeds = append(scope.Seeds, u.String())
+	if host := canonicalHost(u.Hostname()); !scope.hostAllowed(host) {
+		scope.AllowedHosts = append(scope.AllowedHosts, host)
+	}
+	return u.String(), nil
+}
@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"time"
+
+	"crawler/helpers"
+	"crawler/models"
+)
+
+const (
+	// The sitemap protocol caps a single file at 50MB uncompressed
+	sitemapMaxBytes = 50 * 1024 * 1024
+	// Sitemap indexes may not nest by spec, but some sites do it anyway
+	sitemapMaxDepth = 3
+)
+
+// seedFromSitemaps enqueues every <loc> from the sitemaps of the seed's host.
+// Sources are the Sitemap: lines of robots.txt plus the default /sitemap.xml.
+// It returns early once the crawl stops.
+func seedFromSitemaps(seed string) {
+	u, err := url.Parse(seed)
+	if err != nil {
+		return
+	}
+	origin := u.Scheme + "://" + u.Host
+
+	sources := append([]string{}, robotsFor(u).Sitemaps...)
+	sources = append(sources, origin+"/sitemap.xml")
+
+	seen := make(map[string]struct{})
+	added := 0
+	for _, source := range sources {
+		if crawlStopped() {
+			break
+		}
+		added += walkSitemap(source, 0, seen)
+	}
+	fmt.Printf("Sitemaps of %s added %d URLs to the queue\n", origin, added)
+}
+
+// walkSitemap fetches one sitemap, enqueues its pages and recurses into nested indexes
+func walkSitemap(sitemapURL string, depth int, seen map[string]struct{}) int {
+	if depth > sitemapMaxDepth {
+		return 0
+	}
+	if _, ok := seen[sitemapURL]; ok {
+		return 0
+	}
+	seen[sitemapURL] = struct{}{}
+
+	urls, children, err := fetchSitemap(sitemapURL)
+	if err != nil {
+		fmt.Printf("Could not read sitemap %s: %s\n", sitemapURL, err)
+		return 0
+	}
+
+	// The most important and most recently changed pages are queued first
+	sort.SliceStable(urls, func(i, j int) bool {
+		if urls[i].Priority != urls[j].Priority {
+			return urls[i].Priority > urls[j].Priority
+		}
+		a, _ := helpers.ParseLastMod(urls[i].LastMod)
+		b, _ := helpers.ParseLastMod(urls[j].LastMod)
+		return a.After(b)
+	})
+	added := 0
+	for _, entry := range urls {
+		if enqueue(models.FrontierEntry{URL: entry.Loc, LastMod: entry.LastMod, Priority: entry.Priority, Depth: 1, Referrer: sitemapURL}, nil) {
+			added++
+		}
+	}
+	for _, child := range children {
+		if crawlStopped() {
+			break
+		}
+		added += walkSitemap(child, depth+1, seen)
+	}
+	return added
+}
+
+// fetchSitemap downloads a sitemap, transparently gunzipping it when needed. It waits for its turn
+// at the host like a page fetch does. Unlike a page in progress, the download is aborted as soon
+// as the crawl stops.
+func fetchSitemap(sitemapURL string) ([]helpers.SitemapURL, []string, error) {
+	req, err := fetcher.NewRequest(sitemapURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithCancel(crawlCtx)
+	defer cancel()
+	go func() {
+		select {
+		case <-crawlStop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	req = req.WithContext(ctx)
+	host := hostScheduleFor(req.URL)
+	if err := host.acquire(ctx); err != nil {
+		return nil, nil, err
+	}
+	started := time.Now()
+	resp, err := fetcher.Do(req)
+	if err != nil {
+		host.release(0, time.Since(started), "")
+		return nil, nil, err
+	}
+	// The host's slot is held until the sitemap is read
+	defer func() {
+		host.release(resp.StatusCode, time.Since(started), resp.Header.Get("Retry-After"))
+	}()
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	// Detect gzip by its magic bytes, .xml.gz files are often served as application/octet-stream
+	body := bufio.NewReader(resp.Body)
+	var reader io.Reader = body
+	if magic, _ := body.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	return helpers.ParseSitemap(io.LimitReader(reader, sitemapMaxBytes))
+}
+
+// sitemapChangedSince reports whether a sitemap lists the entry's page as modified after the
+// stored copy under key was fetched, so that copy has to be revalidated instead of reused
+func sitemapChangedSince(entry models.FrontierEntry, key string) bool {
+	lastMod, ok := helpers.ParseLastMod(entry.LastMod)
+	if !ok {
+		return false
+	}
+	meta, err := loadPageMeta(pageStore, key)
+	return err == nil && lastMod.After(meta.FetchedAt)
+}
@@ -0,0 +1,206 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strings"
+	"time"
+
+	"crawler/helpers"
+	"crawler/models"
+)
+
+// snapshotStore keeps the old versions of the pages, set from CrawlConfig.Snapshots
+var snapshotStore PageStore
+
+// snapshotKey is the key a snapshot is kept under in the snapshot store, next to the other snapshots of the page
+func snapshotKey(key, id string) string {
+	return key + "-" + id
+}
+
+// snapshotFields lists the compared fields of a document by name
+func snapshotFields(doc models.Document) [][2]string {
+	return [][2]string{
+		{"title", doc.Title},
+		{"h1", doc.H1},
+		{"h2", doc.H2},
+		{"h3", doc.H3},
+		{"h4", doc.H4},
+		{"h5", doc.H5},
+		{"h6", doc.H6},
+		{"body", doc.Body},
+	}
+}
+
+func documentTextHash(doc models.Document) string {
+	var values []string
+	for _, field := range snapshotFields(doc) {
+		values = append(values, field[1])
+	}
+	return helpers.TextHash(strings.Join(values, "\x00"))
+}
+
+// takeSnapshot keeps the stored body and document of a page as a snapshot when its text changed
+// since the last snapshot, and drops the oldest snapshots beyond CrawlConfig.SnapshotRetention.
+// The snapshot list in meta is updated, saving meta is up to the caller.
+func takeSnapshot(key string, meta *models.PageMeta, doc models.Document, at time.Time) error {
+	if snapshotStore == nil || crawlConfig.SnapshotRetention <= 0 {
+		return nil
+	}
+	textHash := documentTextHash(doc)
+	if last := len(meta.Snapshots) - 1; last >= 0 && meta.Snapshots[last].TextHash == textHash {
+		return nil
+	}
+	snapshot := models.PageSnapshot{ID: at.UTC().Format("20060102T150405Z"), At: at, BodyHash: meta.BodyHash, TextHash: textHash}
+	if last := len(meta.Snapshots) - 1; last >= 0 && meta.Snapshots[last].ID == snapshot.ID {
+		// Changed again within the same second, the newer version replaces it
+		meta.Snapshots = meta.Snapshots[:last]
+	}
+
+	body, err := pageStore.Get(key, PartBody)
+	if err != nil {
+		return err
+	}
+	err = snapshotStore.Put(snapshotKey(key, snapshot.ID), PartBody, body)
+	body.Close()
+	if err != nil {
+		return err
+	}
+	if err := saveDocument(snapshotStore, snapshotKey(key, snapshot.ID), doc); err != nil {
+		return err
+	}
+	meta.Snapshots = append(meta.Snapshots, snapshot)
+
+	for len(meta.Snapshots) > crawlConfig.SnapshotRetention {
+		if err := snapshotStore.Delete(snapshotKey(key, meta.Snapshots[0].ID)); err != nil {
+			return err
+		}
+		meta.Snapshots = meta.Snapshots[1:]
+	}
+	return nil
+}
+
+// ListSnapshots returns the kept snapshots of a page, oldest first
+func ListSnapshots(store PageStore, pageURL string) ([]models.PageSnapshot, error) {
+	meta, err := loadPageMeta(store, PageKey(pageURL))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%s has not been crawled", pageURL)
+	} else if err != nil {
+		return nil, err
+	}
+	return meta.Snapshots, nil
+}
+
+// FieldDiff is the change of one document field between two snapshots
+type FieldDiff struct {
+	Field  string              `json:"field"`
+	Old    string              `json:"-"`
+	New    string              `json:"-"`
+	Chunks []helpers.DiffChunk `json:"chunks"`
+}
+
+// SnapshotDiff lists the fields that changed between two snapshots of a page
+type SnapshotDiff struct {
+	URL    string              `json:"url"`
+	From   models.PageSnapshot `json:"from"`
+	To     models.PageSnapshot `json:"to"`
+	Fields []FieldDiff         `json:"fields"`
+}
+
+// DiffSnapshots compares the documents of two snapshots of a page field by field. Empty IDs
+// pick the last two snapshots, or the one before the other ID.
+func DiffSnapshots(store, snapshots PageStore, pageURL, fromID, toID string) (SnapshotDiff, error) {
+	list, err := ListSnapshots(store, pageURL)
+	if err != nil {
+		return SnapshotDiff{}, err
+	}
+	find := func(id string) (int, error) {
+		for i, snapshot := range list {
+			if snapshot.ID == id {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("%s has no snapshot %s", pageURL, id)
+	}
+	to := len(list) - 1
+	if toID != "" {
+		if to, err = find(toID); err != nil {
+			return SnapshotDiff{}, err
+		}
+	}
+	from := to - 1
+	if fromID != "" {
+		if from, err = find(fromID); err != nil {
+			return SnapshotDiff{}, err
+		}
+	}
+	if from < 0 || to < 0 {
+		return SnapshotDiff{}, fmt.Errorf("%s has %d snapshots, two are needed for a diff", pageURL, len(list))
+	}
+
+	key := PageKey(pageURL)
+	oldDoc, err := loadDocument(snapshots, snapshotKey(key, list[from].ID))
+	if err != nil {
+		return SnapshotDiff{}, err
+	}
+	newDoc, err := loadDocument(snapshots, snapshotKey(key, list[to].ID))
+	if err != nil {
+		return SnapshotDiff{}, err
+	}
+	diff := SnapshotDiff{URL: pageURL, From: list[from], To: list[to], Fields: []FieldDiff{}}
+	newFields := snapshotFields(newDoc)
+	for i, field := range snapshotFields(oldDoc) {
+		if field[1] == newFields[i][1] {
+			continue
+		}
+		diff.Fields = append(diff.Fields, FieldDiff{
+			Field:  field[0],
+			Old:    field[1],
+			New:    newFields[i][1],
+			Chunks: helpers.DiffWords(field[1], newFields[i][1]),
+		})
+	}
+	return diff, nil
+}
+
+// FormatSnapshotDiff renders a diff for the terminal, long unchanged text is shortened
+func FormatSnapshotDiff(diff SnapshotDiff) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n--- %s\n+++ %s\n", diff.URL, diff.From.ID, diff.To.ID)
+	if len(diff.Fields) == 0 {
+		b.WriteString("No changes in the title, headings or body\n")
+	}
+	for _, field := range diff.Fields {
+		if field.Field == "body" {
+			fmt.Fprintf(&b, "\n%s:\n  %s\n", field.Field, helpers.FormatWordDiff(field.Chunks, 8))
+			continue
+		}
+		fmt.Fprintf(&b, "\n%s:\n  - %s\n  + %s\n", field.Field, field.Old, field.New)
+	}
+	return b.String()
+}
+
+// SnapshotListHandler responds with the snapshots kept of a page
+func SnapshotListHandler(store PageStore, w http.ResponseWriter, pageURL string) {
+	list, err := ListSnapshots(store, pageURL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, struct {
+		URL       string                `json:"url"`
+		Snapshots []models.PageSnapshot `json:"snapshots"`
+	}{pageURL, append([]models.PageSnapshot{}, list...)})
+}
+
+// SnapshotDiffHandler responds with the changes between two snapshots of a page, see DiffSnapshots
+func SnapshotDiffHandler(store, snapshots PageStore, w http.ResponseWriter, pageURL, fromID, toID string) {
+	diff, err := DiffSnapshots(store, snapshots, pageURL, fromID, toID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, diff)
+}
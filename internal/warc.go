@@ -0,0 +1,437 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"crawler/helpers"
+)
+
+const warcVersion = "WARC/1.1"
+
+// warcField is one named field of a WARC record header, kept in order
+type warcField struct {
+	name, value string
+}
+
+// warcArchive writes the fetched pages into gzipped WARC files in CrawlConfig.WARCDir,
+// starting a new file once the current one grows past CrawlConfig.WARCMaxSize
+var warcArchive = struct {
+	lock sync.Mutex
+	file *os.File
+	// written counts the compressed bytes of the current file
+	written *countingWriter
+	// prefix names the files of this run, seq numbers them
+	prefix   string
+	seq      int
+	warcinfo string
+}{}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// newWARCRecordID returns a fresh urn:uuid record ID
+func newWARCRecordID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	// Version 4, variant 10
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+}
+
+func warcDate(at time.Time) string {
+	return at.UTC().Format("2006-01-02T15:04:05Z")
+}
+
+// writeWARCRecord writes one record with a block of length bytes read from block
+func writeWARCRecord(w io.Writer, fields []warcField, block io.Reader, length int64) error {
+	var header bytes.Buffer
+	header.WriteString(warcVersion + "\r\n")
+	for _, field := range fields {
+		fmt.Fprintf(&header, "%s: %s\r\n", field.name, field.value)
+	}
+	fmt.Fprintf(&header, "Content-Length: %d\r\n\r\n", length)
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return err
+	}
+	copied, err := io.CopyN(w, block, length)
+	if err != nil {
+		return fmt.Errorf("writing a %d byte block, got %d: %w", length, copied, err)
+	}
+	_, err = io.WriteString(w, "\r\n\r\n")
+	return err
+}
+
+// writeGzippedRecord writes a record as its own gzip member, so tools can seek to any record
+func writeGzippedRecord(w io.Writer, fields []warcField, block io.Reader, length int64) error {
+	compressed := gzip.NewWriter(w)
+	if err := writeWARCRecord(compressed, fields, block, length); err != nil {
+		compressed.Close()
+		return err
+	}
+	return compressed.Close()
+}
+
+// openWARCFile starts the next WARC file of the run and writes its warcinfo record
+func openWARCFile() error {
+	if err := os.MkdirAll(crawlConfig.WARCDir, 0755); err != nil {
+		return err
+	}
+	if warcArchive.prefix == "" {
+		warcArchive.prefix = "crawl-" + time.Now().UTC().Format("20060102150405")
+	}
+	name := fmt.Sprintf("%s-%05d.warc.gz", warcArchive.prefix, warcArchive.seq)
+	warcArchive.seq++
+	file, err := os.OpenFile(filepath.Join(crawlConfig.WARCDir, name), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	warcArchive.file = file
+	warcArchive.written = &countingWriter{Writer: file}
+
+	info := fmt.Sprintf("software: %s\r\nformat: WARC File Format 1.1\r\n"+
+		"conformsTo: http://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/\r\n"+
+		"http-header-user-agent: %s\r\nrobots: obey\r\n", DefaultUserAgent, crawlConfig.UserAgent)
+	warcArchive.warcinfo = newWARCRecordID()
+	return writeGzippedRecord(warcArchive.written, []warcField{
+		{"WARC-Type", "warcinfo"},
+		{"WARC-Record-ID", warcArchive.warcinfo},
+		{"WARC-Date", warcDate(time.Now())},
+		{"WARC-Filename", name},
+		{"Content-Type", "application/warc-fields"},
+	}, strings.NewReader(info), int64(len(info)))
+}
+
+func closeWARCFile() {
+	warcArchive.lock.Lock()
+	defer warcArchive.lock.Unlock()
+	if warcArchive.file != nil {
+		warcArchive.file.Close()
+		warcArchive.file = nil
+	}
+}
+
+// archiveFetch writes the request and response of a fetched page to the WARC archive, with
+// the stored body under key as payload. The payload is the decoded body, so the response
+// carries no Content-Encoding and its Content-Length is the length of the stored body.
+func archiveFetch(resp *http.Response, key string, body storedBody, at time.Time) error {
+	if crawlConfig.WARCDir == "" {
+		return nil
+	}
+	payload, err := pageStore.Get(key, PartBody)
+	if err != nil {
+		return err
+	}
+	defer payload.Close()
+
+	req := resp.Request
+	target := req.URL.String()
+	var requestBlock bytes.Buffer
+	fmt.Fprintf(&requestBlock, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.URL.Host)
+	req.Header.Write(&requestBlock)
+	requestBlock.WriteString("\r\n")
+
+	header := resp.Header.Clone()
+	header.Del("Transfer-Encoding")
+	header.Set("Content-Length", strconv.FormatInt(body.size, 10))
+	var responseHead bytes.Buffer
+	fmt.Fprintf(&responseHead, "%s %s\r\n", resp.Proto, resp.Status)
+	header.Write(&responseHead)
+	responseHead.WriteString("\r\n")
+
+	digest, _ := hex.DecodeString(body.hash)
+	date := warcDate(at)
+	responseID := newWARCRecordID()
+
+	warcArchive.lock.Lock()
+	defer warcArchive.lock.Unlock()
+	if warcArchive.file != nil && crawlConfig.WARCMaxSize > 0 && warcArchive.written.n >= crawlConfig.WARCMaxSize {
+		warcArchive.file.Close()
+		warcArchive.file = nil
+	}
+	if warcArchive.file == nil {
+		if err := openWARCFile(); err != nil {
+			return err
+		}
+	}
+	responseFields := []warcField{
+		{"WARC-Type", "response"},
+		{"WARC-Record-ID", responseID},
+		{"WARC-Warcinfo-ID", warcArchive.warcinfo},
+		{"WARC-Date", date},
+		{"WARC-Target-URI", target},
+		{"Content-Type", "application/http;msgtype=response"},
+		{"WARC-Payload-Digest", "sha256:" + base32.StdEncoding.EncodeToString(digest)},
+	}
+	if body.truncated {
+		responseFields = append(responseFields, warcField{"WARC-Truncated", "length"})
+	}
+	block := io.MultiReader(&responseHead, payload)
+	if err := writeGzippedRecord(warcArchive.written, responseFields, block, int64(responseHead.Len())+body.size); err != nil {
+		return err
+	}
+	return writeGzippedRecord(warcArchive.written, []warcField{
+		{"WARC-Type", "request"},
+		{"WARC-Record-ID", newWARCRecordID()},
+		{"WARC-Warcinfo-ID", warcArchive.warcinfo},
+		{"WARC-Date", date},
+		{"WARC-Target-URI", target},
+		{"WARC-Concurrent-To", responseID},
+		{"Content-Type", "application/http;msgtype=request"},
+	}, &requestBlock, int64(requestBlock.Len()))
+}
+
+// warcReader reads the records of a WARC file, gzipped or not
+type warcReader struct {
+	r *bufio.Reader
+	// block is the rest of the current record
+	block *io.LimitedReader
+}
+
+func newWARCReader(r io.Reader) (*warcReader, error) {
+	buffered := bufio.NewReader(r)
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		// One gzip member per record, gzip.Reader reads through all of them
+		decompressed, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		buffered = bufio.NewReader(decompressed)
+	}
+	return &warcReader{r: buffered}, nil
+}
+
+// next returns the header and block of the next record, io.EOF after the last one.
+// The block is only valid until next is called again.
+func (w *warcReader) next() (textproto.MIMEHeader, io.Reader, error) {
+	if w.block != nil {
+		if _, err := io.Copy(io.Discard, w.block); err != nil {
+			return nil, nil, err
+		}
+	}
+	// Skip the blank lines that end the previous record
+	for {
+		line, err := w.r.ReadString('\n')
+		if err == io.EOF && strings.TrimSpace(line) == "" {
+			return nil, nil, io.EOF
+		} else if err != nil {
+			return nil, nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "WARC/") {
+			return nil, nil, fmt.Errorf("expected a WARC record, got %q", line)
+		}
+		break
+	}
+	header, err := textproto.NewReader(w.r).ReadMIMEHeader()
+	if err == io.EOF {
+		// The file ends inside a record header, it was cut off
+		return nil, nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, nil, err
+	}
+	length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return nil, nil, errors.New("WARC record without a valid Content-Length")
+	}
+	w.block = &io.LimitedReader{R: w.r, N: length}
+	return header, w.block, nil
+}
+
+// ImportWARC reads the response records of WARC files, gzipped or not, into the page store. Their
+// bodies are extracted like crawled pages and flagged for reindexing, so an incremental indexing run
+// picks them up. Directories are searched for *.warc and *.warc.gz files. It returns the number of
+// pages imported. Cancelling ctx stops after the record in progress.
+func ImportWARC(ctx context.Context, cfg CrawlConfig, paths []string) (int, error) {
+	crawlConfig = cfg
+	pageStore = cfg.Store
+	snapshotStore = cfg.Snapshots
+	catalog = cfg.Catalog
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return 0, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		for _, pattern := range []string{"*.warc", "*.warc.gz"} {
+			matches, _ := filepath.Glob(filepath.Join(path, pattern))
+			files = append(files, matches...)
+		}
+	}
+
+	imported := 0
+	for _, name := range files {
+		count, err := importWARCFile(ctx, name)
+		imported += count
+		if err != nil {
+			return imported, fmt.Errorf("%s: %w", name, err)
+		}
+		log.Printf("Imported %d pages from %s", count, name)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return imported, nil
+}
+
+func importWARCFile(ctx context.Context, name string) (int, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	reader, err := newWARCReader(file)
+	if err != nil {
+		return 0, err
+	}
+	imported := 0
+	for ctx.Err() == nil {
+		header, block, err := reader.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return imported, err
+		}
+		if header.Get("WARC-Type") != "response" || !strings.HasPrefix(header.Get("Content-Type"), "application/http") {
+			continue
+		}
+		// WARC 1.0 writers may put the URI in angle brackets
+		target := strings.Trim(header.Get("WARC-Target-URI"), "<>")
+		at, err := time.Parse(time.RFC3339Nano, header.Get("WARC-Date"))
+		if err != nil {
+			at = time.Now()
+		}
+		if err := importWARCResponse(target, at, block, header.Get("WARC-Truncated") != ""); err != nil {
+			log.Printf("Skipping %s: %s", target, err)
+			continue
+		}
+		imported++
+	}
+	return imported, nil
+}
+
+// importWARCResponse stores and extracts one archived response, like processEntry does for a fetched page
+func importWARCResponse(target string, at time.Time, block io.Reader, truncated bool) error {
+	resp, err := http.ReadResponse(bufio.NewReader(block), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	extract, ok := helpers.ExtractorFor(contentType)
+	if !ok && contentType != "" {
+		return fmt.Errorf("no extractor for %s", contentType)
+	} else if !ok {
+		// Pages archived without a content type are HTML
+		extract = helpers.ExtractDocument
+	}
+	payload, err := decodeBody(resp.Body, resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		return err
+	}
+
+	// The page is stored, extracted and compared with its canonical link under the URL the crawl would use
+	requested := target
+	target, err = urlNormalizer.Normalize(target)
+	if err != nil {
+		return err
+	}
+	key := PageKey(target)
+	hasher := sha256.New()
+	counter := &countingReader{Reader: io.TeeReader(payload, hasher)}
+	if err := pageStore.Put(key, PartBody, counter); err != nil {
+		return err
+	}
+	file, err := pageStore.Get(key, PartBody)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	tree := parseStoredPage(file, contentType)
+	directives := readDirectives(tree, target, resp.Header.Values("X-Robots-Tag"))
+	doc, ok := helpers.ExtractParsed(tree, target, contentType)
+	if !ok && contentType == "" && tree != nil {
+		// Pages archived without a content type are HTML
+		doc, ok = tree.Document(target), true
+	}
+	if !ok {
+		file.Seek(0, 0)
+		if doc, err = extract(file, target, contentType); err != nil {
+			return err
+		}
+	}
+	if existing, err := loadDocument(pageStore, key); err == nil {
+		doc.Aliases = existing.Aliases
+	}
+
+	meta, _ := loadPageMeta(pageStore, key)
+	text := doc.Body
+	if tree != nil {
+		text = tree.MainText()
+	}
+	if !setFingerprint(&meta, text) {
+		doc.ClusterID = meta.ClusterID
+	}
+	if err := saveDocument(pageStore, key, doc); err != nil {
+		return err
+	}
+	meta.URL = target
+	meta.ETag = resp.Header.Get("ETag")
+	meta.LastModified = resp.Header.Get("Last-Modified")
+	meta.FetchedAt = at
+	meta.Status = resp.StatusCode
+	meta.ContentType = contentType
+	meta.BodyHash = hex.EncodeToString(hasher.Sum(nil))
+	meta.Size = counter.n
+	meta.Truncated = truncated
+	meta.NeedsReindex = true
+	meta.NoIndex = directives.NoIndex
+	meta.NoFollow = directives.NoFollow
+	meta.Canonical = directives.Canonical
+	if err := takeSnapshot(key, &meta, doc, at); err != nil {
+		return err
+	}
+	if err := savePageMeta(pageStore, key, meta); err != nil {
+		return err
+	}
+	catalogPage(catalog, key, requested, meta, &doc)
+	return nil
+}
@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+type testRecord struct {
+	kind, target, block string
+}
+
+var testRecords = []testRecord{
+	{"warcinfo", "", "software: crawler\r\n"},
+	{"response", "https://example.com/", "HTTP/1.1 200 OK\r\nContent-Type: text/html\r\n\r\n<p>hello</p>"},
+	{"response", "https://example.com/empty", ""},
+	// A block that itself looks like the start of a record must not confuse the reader
+	{"resource", "https://example.com/nested", "\r\n\r\nWARC/1.1\r\nContent-Length: 3\r\n\r\nabc"},
+}
+
+func writeTestRecords(t testing.TB, gzipped bool) []byte {
+	t.Helper()
+	write := writeWARCRecord
+	if gzipped {
+		write = writeGzippedRecord
+	}
+	var buf bytes.Buffer
+	for _, record := range testRecords {
+		fields := []warcField{{"WARC-Type", record.kind}, {"WARC-Record-ID", newWARCRecordID()}}
+		if record.target != "" {
+			fields = append(fields, warcField{"WARC-Target-URI", record.target})
+		}
+		if err := write(&buf, fields, strings.NewReader(record.block), int64(len(record.block))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestWARCRoundTrip(t *testing.T) {
+	for _, gzipped := range []bool{false, true} {
+		reader, err := newWARCReader(bytes.NewReader(writeTestRecords(t, gzipped)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, want := range testRecords {
+			header, block, err := reader.next()
+			if err != nil {
+				t.Fatalf("gzipped %v, record %d: %s", gzipped, i, err)
+			}
+			if got := header.Get("WARC-Type"); got != want.kind {
+				t.Errorf("gzipped %v, record %d: type %q, want %q", gzipped, i, got, want.kind)
+			}
+			if got := header.Get("WARC-Target-URI"); got != want.target {
+				t.Errorf("gzipped %v, record %d: target %q, want %q", gzipped, i, got, want.target)
+			}
+			data, err := io.ReadAll(block)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != want.block {
+				t.Errorf("gzipped %v, record %d: block %q, want %q", gzipped, i, data, want.block)
+			}
+		}
+		if _, _, err := reader.next(); err != io.EOF {
+			t.Errorf("gzipped %v: after the last record got %v, want io.EOF", gzipped, err)
+		}
+	}
+}
+
+func TestWARCReaderSkipsUnreadBlocks(t *testing.T) {
+	reader, err := newWARCReader(bytes.NewReader(writeTestRecords(t, true)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for {
+		header, block, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		kinds = append(kinds, header.Get("WARC-Type"))
+		// Read a few bytes at most, next has to discard the rest
+		block.Read(make([]byte, 4))
+	}
+	if got := strings.Join(kinds, ","); got != "warcinfo,response,response,resource" {
+		t.Errorf("got records %s", got)
+	}
+}
+
+func TestWARCReaderMalformed(t *testing.T) {
+	tests := []struct {
+		name, input string
+	}{
+		{"not a WARC file", "<html></html>\r\n"},
+		{"missing Content-Length", "WARC/1.1\r\nWARC-Type: response\r\n\r\nbody"},
+		{"bad Content-Length", "WARC/1.1\r\nContent-Length: ten\r\n\r\nbody"},
+		{"negative Content-Length", "WARC/1.1\r\nContent-Length: -4\r\n\r\nbody"},
+		{"truncated header", "WARC/1.1\r\nContent-Length: 4"},
+	}
+	for _, test := range tests {
+		reader, err := newWARCReader(strings.NewReader(test.input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := reader.next(); err == nil || err == io.EOF {
+			t.Errorf("%s: got %v, want an error", test.name, err)
+		}
+	}
+}
+
+func TestWARCReaderTruncatedBlock(t *testing.T) {
+	reader, err := newWARCReader(strings.NewReader("WARC/1.1\r\nContent-Length: 100\r\n\r\nshort"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, block, err := reader.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(block)
+	if string(data) != "short" {
+		t.Errorf("got block %q", data)
+	}
+	if _, _, err := reader.next(); err != io.EOF {
+		t.Errorf("after a truncated block got %v, want io.EOF", err)
+	}
+}
+
+func FuzzWARCReader(f *testing.F) {
+	f.Add(string(writeTestRecords(f, false)))
+	f.Add("WARC/1.1\r\nContent-Length: 99999999999\r\n\r\n")
+	f.Add("\r\n\r\nWARC/1.0\r\nWARC-Type: response\r\nContent-Length: 0\r\n\r\n\r\n\r\n")
+	f.Fuzz(func(t *testing.T, input string) {
+		reader, err := newWARCReader(strings.NewReader(input))
+		if err != nil {
+			return
+		}
+		for i := 0; i < 1000; i++ {
+			if _, _, err := reader.next(); err != nil {
+				return
+			}
+		}
+	})
+}
@@ -11,7 +11,11 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/elastic/go-elasticsearch/v8"
 	"github.com/joho/godotenv"
@@ -20,14 +24,104 @@ import (
 func main() {
 	modeArg := flag.String("mode", "server", "Crawler mode that the program should run in")
 	testIndex := flag.Bool("test", false, "Test indexes but compile time values")
+	incremental := flag.Bool("incremental", false, "Index mode: only send pages that changed since the last indexing run")
+	storeKind := flag.String("store", internal.StoreFlat, "Page store layout in ./site: flat, sharded or pack. The diff, lookup and server modes follow a crawl writing the same store")
+	maxDistance := flag.Int("max-distance", 3, "Dedup mode: SimHash bits two pages may differ in to count as near-duplicates (-1 = exact duplicates only)")
+	reportSize := flag.Int("report", 20, "Dedup mode: number of largest duplicate clusters to list (0 = all)")
+	diffURL := flag.String("url", "", "Diff mode: page whose snapshots are compared, lookup mode: page to find the storage key of")
+	diffOld := flag.String("old", "", "Diff mode: ID of the older snapshot (default: the one before -new)")
+	diffNew := flag.String("new", "", "Diff mode: ID of the newer snapshot (default: the latest)")
+	lookupKey := flag.String("key", "", "Lookup mode: storage key or stored filename to find the URL of")
+	migrateFrom := flag.String("from", "", "Migrate mode: page store layout to copy the pages from into the -store layout, the same layout compacts it in place. Pages stored under outdated keys are moved either way")
+	crawlCfg := internal.DefaultCrawlConfig()
+	flag.StringVar(&crawlCfg.UserAgent, "user-agent", crawlCfg.UserAgent, "User-Agent sent by the crawler and matched against robots.txt")
+	stripParamsSet := false
+	flag.Func("strip-params", "Query parameters removed before deduplication, a trailing * matches a prefix (default utm_*,fbclid,gclid,...). Storage keys depend on them, so pass the same list to every mode", func(v string) error {
+		// The first use replaces the defaults, further uses add to the list
+		if !stripParamsSet {
+			crawlCfg.StripParams, stripParamsSet = nil, true
+		}
+		return listFlag(&crawlCfg.StripParams)(v)
+	})
+	flag.BoolVar(&crawlCfg.Resume, "resume", false, "Continue the previous crawl from its frontier log in ./site/.crawl")
+	flag.DurationVar(&crawlCfg.MinHostDelay, "host-delay", crawlCfg.MinHostDelay, "Minimum delay between requests to the same host")
+	flag.DurationVar(&crawlCfg.MaxHostDelay, "max-host-delay", crawlCfg.MaxHostDelay, "Upper bound for the per-host delay when backing off")
+	flag.IntVar(&crawlCfg.MaxHostConns, "host-conns", crawlCfg.MaxHostConns, "Maximum concurrent connections per host")
+	flag.IntVar(&crawlCfg.MaxPages, "max-pages", crawlCfg.MaxPages, "Stop the crawl after this many pages (0 = no limit)")
+	flag.IntVar(&crawlCfg.MaxPagesPerHost, "max-pages-per-host", crawlCfg.MaxPagesPerHost, "Maximum pages fetched from a single host (0 = no limit)")
+	flag.IntVar(&crawlCfg.MaxDepth, "max-depth", crawlCfg.MaxDepth, "Maximum link depth from the seeds (0 = no limit)")
+	flag.IntVar(&crawlCfg.SnapshotRetention, "snapshots", crawlCfg.SnapshotRetention, "Snapshots kept per page of its changed versions (0 = off)")
+	flag.BoolVar(&crawlCfg.Refresh, "refresh", false, "Revalidate stored pages with conditional requests and re-extract the ones that changed")
+	flag.IntVar(&crawlCfg.RecrawlBudget, "recrawl-budget", crawlCfg.RecrawlBudget, "Recrawl mode: maximum pages fetched per round")
+	flag.DurationVar(&crawlCfg.MinRecrawlInterval, "min-recrawl-interval", crawlCfg.MinRecrawlInterval, "Shortest planned interval between two visits of a page")
+	flag.DurationVar(&crawlCfg.MaxRecrawlInterval, "max-recrawl-interval", crawlCfg.MaxRecrawlInterval, "Longest planned interval between two visits of a page")
+	flag.IntVar(&crawlCfg.MaxRetries, "max-retries", crawlCfg.MaxRetries, "Retries for transient fetch failures (timeouts, resets, 5xx, 429)")
+	flag.DurationVar(&crawlCfg.RetryBaseDelay, "retry-delay", crawlCfg.RetryBaseDelay, "Initial backoff before retrying a failed fetch, doubled per attempt")
+	flag.IntVar(&crawlCfg.MaxRedirects, "max-redirects", crawlCfg.MaxRedirects, "Redirect hops followed before a fetch fails")
+	flag.Int64Var(&crawlCfg.MaxBodySize, "max-body-size", crawlCfg.MaxBodySize, "Bytes stored per page, longer bodies are truncated (0 = no limit)")
+	flag.StringVar(&crawlCfg.ControlAddr, "control-addr", crawlCfg.ControlAddr, "Address of the crawl control API (/crawl/...) and Prometheus /metrics (empty = off)")
+	flag.IntVar(&crawlCfg.Workers, "workers", crawlCfg.Workers, "Number of crawl workers")
+	flag.BoolVar(&crawlCfg.Wait, "wait", false, "Keep running when the frontier is exhausted, waiting for seeds from the control API")
+	flag.BoolVar(&crawlCfg.StartPaused, "paused", false, "Start paused, POST /crawl/start on the control API begins crawling")
+	flag.Int64Var(&crawlCfg.CrawlLogMaxSize, "crawl-log-size", crawlCfg.CrawlLogMaxSize, "Bytes after which the crawl log in ./site/.crawl is rotated (0 = never)")
+	flag.StringVar(&crawlCfg.WARCDir, "warc", "", "Directory the fetched pages are archived to as WARC 1.1 files (empty = off)")
+	flag.Int64Var(&crawlCfg.WARCMaxSize, "warc-size", crawlCfg.WARCMaxSize, "Compressed bytes after which a new WARC file is started (0 = never)")
+	var warcImports []string
+	flag.Func("import", "Import mode: WARC file or directory of *.warc(.gz) files to import (repeatable or comma separated)", listFlag(&warcImports))
+	noIndex := flag.Bool("no-index", false, "Import mode: only store the imported pages, skip indexing them")
+	flag.IntVar(&crawlCfg.CrawlLogFiles, "crawl-log-files", crawlCfg.CrawlLogFiles, "Rotated crawl logs to keep")
+	var logQuery internal.CrawlLogQuery
+	flag.Func("status", `Log mode: status codes to show, e.g. "404", "5xx" or "error" (repeatable or comma separated)`, listFlag(&logQuery.Statuses))
+	flag.StringVar(&logQuery.Host, "host", "", "Log mode: only show fetches of this host")
+	since := flag.String("since", "", `Log mode: only show fetches from this time on (RFC 3339, YYYY-MM-DD or a duration ago like "2h")`)
+	until := flag.String("until", "", "Log mode: only show fetches before this time (same formats as -since, a date includes that whole day)")
+	headersSet := false
+	flag.Func("header", `Header added to every request, e.g. "Accept-Language: fa" (repeatable, the first use replaces the defaults)`, func(v string) error {
+		name, value, ok := strings.Cut(v, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return fmt.Errorf("expected \"Name: value\", got %q", v)
+		}
+		if !headersSet {
+			crawlCfg.Headers, headersSet = http.Header{}, true
+		}
+		crawlCfg.Headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+		return nil
+	})
+	flag.StringVar(&crawlCfg.Proxy, "proxy", "", `Proxy URL for all requests, "direct" to ignore HTTP_PROXY/HTTPS_PROXY`)
+	flag.DurationVar(&crawlCfg.ConnectTimeout, "connect-timeout", crawlCfg.ConnectTimeout, "Timeout for establishing a connection")
+	flag.DurationVar(&crawlCfg.TLSTimeout, "tls-timeout", crawlCfg.TLSTimeout, "Timeout for the TLS handshake")
+	flag.DurationVar(&crawlCfg.ReadTimeout, "read-timeout", crawlCfg.ReadTimeout, "Timeout for response headers and between reads of the body")
+	flag.DurationVar(&crawlCfg.RequestTimeout, "request-timeout", crawlCfg.RequestTimeout, "Timeout for a whole request including the body (0 = none)")
+	scopeFile := flag.String("scope", "", "JSON file describing the crawl scope (seeds, allowed_hosts, include_subdomains, include, exclude)")
+	var scopeFlags internal.CrawlScope
+	flag.Func("seed", "Seed URL to start crawling from (repeatable or comma separated), recrawl and import take the crawl scope from it too", listFlag(&scopeFlags.Seeds))
+	flag.Func("allow-host", "Host the crawler may visit, defaults to the seed hosts (repeatable or comma separated)", listFlag(&scopeFlags.AllowedHosts))
+	flag.BoolVar(&scopeFlags.IncludeSubdomains, "subdomains", false, "Also crawl subdomains of the allowed hosts")
+	flag.Func("include", "Regex a URL path must match to be crawled (repeatable)", func(v string) error {
+		scopeFlags.Include = append(scopeFlags.Include, v)
+		return nil
+	})
+	flag.Func("exclude", "Regex of URL paths that are never crawled (repeatable)", func(v string) error {
+		scopeFlags.Exclude = append(scopeFlags.Exclude, v)
+		return nil
+	})
 	flag.Parse()
 	godotenv.Load(".env")
 
+	// The first SIGINT/SIGTERM asks the running mode to wrap up, a second one kills the process
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	stopNotice := context.AfterFunc(ctx, func() {
+		log.Println("Shutting down, interrupt again to exit immediately")
+		stop()
+	})
+	defer stopNotice()
+
 	// 1. Initialize ES Client with Configuration
 	// Elasticsearch is configured with SSL/TLS and requires authentication
 	// Get credentials from environment variables or use defaults
 	var es *elasticsearch.Client
-	if *modeArg == "index" || *modeArg == "server" {
+	if *modeArg == "index" || *modeArg == "server" || (*modeArg == "import" && !*noIndex) {
 		esUser := os.Getenv("ELASTIC_USER")
 		if esUser == "" {
 			esUser = "elastic" // Default username
@@ -66,14 +160,185 @@ func main() {
 		}
 	}
 
+	// Storage keys are built from normalized URLs, so every mode normalizes like the crawl did
+	internal.SetStripParams(crawlCfg.StripParams)
+
+	var store, snapshots internal.PageStore
+	var catalog *internal.Catalog
+	switch *modeArg {
+	case "crawl", "recrawl", "fix", "index", "migrate", "import", "dedup", "diff", "lookup", "server":
+		var err error
+		if readOnlyMode(*modeArg) {
+			// Like the catalog, a crawl running next to these modes keeps writing the store
+			store, err = internal.OpenPageStoreReader(*storeKind, "./site")
+		} else {
+			store, err = internal.OpenPageStore(*storeKind, "./site")
+		}
+		if err != nil {
+			log.Fatalf("Could not open the page store: %s", err)
+		}
+		defer store.Close()
+		crawlCfg.Store = store
+	}
+	switch *modeArg {
+	case "crawl", "recrawl", "fix", "index", "migrate", "import", "dedup":
+		// The catalog maps the storage keys back to their URLs, pages it misses are added from the store
+		var err error
+		catalog, err = internal.OpenCatalog(store)
+		if err != nil {
+			log.Fatalf("Could not open the crawl catalog: %s", err)
+		}
+		defer catalog.Close()
+		crawlCfg.Catalog = catalog
+	case "lookup", "server":
+		// These only read the catalog, a crawl running next to them keeps writing it
+		var err error
+		catalog, err = internal.OpenCatalogReader()
+		if err != nil {
+			log.Fatalf("Could not open the crawl catalog: %s", err)
+		}
+	}
+	switch *modeArg {
+	case "crawl", "recrawl", "import", "diff", "server":
+		// Snapshots use the same layout in a directory of their own
+		var err error
+		if readOnlyMode(*modeArg) {
+			snapshots, err = internal.OpenPageStoreReader(*storeKind, "./site/.snapshots")
+		} else {
+			snapshots, err = internal.OpenPageStore(*storeKind, "./site/.snapshots")
+		}
+		if err != nil {
+			log.Fatalf("Could not open the snapshot store: %s", err)
+		}
+		defer snapshots.Close()
+		crawlCfg.Snapshots = snapshots
+	}
+
+	switch *modeArg {
+	case "crawl", "recrawl", "import":
+		// Redirects are only followed within the scope and canonical links only count within it,
+		// so revisits and imports need the crawl's scope too
+		scope, err := internal.BuildCrawlScope(*scopeFile, scopeFlags)
+		if err != nil {
+			log.Fatalf("Invalid crawl scope: %s", err)
+		}
+		crawlCfg.Scope = scope
+	}
+
 	switch *modeArg {
 	case "crawl":
-		internal.StartDownloader()
+		internal.StartDownloader(ctx, crawlCfg)
+	case "recrawl":
+		// Recrawl mode: revisit the stored pages that are due according to their change rate
+		internal.StartRecrawl(ctx, crawlCfg)
+	case "log":
+		// Log mode: print the crawl log records matching -status, -host, -since and -until
+		var err error
+		now := time.Now()
+		if logQuery.Since, err = internal.ParseLogTime(*since, now); err != nil {
+			log.Fatal(err)
+		}
+		if logQuery.Until, err = internal.ParseLogUntil(*until, now); err != nil {
+			log.Fatal(err)
+		}
+		matched, scanned, err := internal.QueryCrawlLog(logQuery, os.Stdout)
+		if err != nil {
+			log.Fatalf("Could not read the crawl log: %s", err)
+		}
+		fmt.Fprintf(os.Stderr, "%d of %d fetches matched\n", matched, scanned)
 	case "fix":
 		// Fix mode: Re-parse all HTML files and regenerate JSON files with proper encoding
-		internal.FixJSONFiles("./site")
+		internal.FixJSONFiles(ctx, store, catalog)
 	case "index":
-		internal.StartIndexing(es, "./site")
+		internal.StartIndexing(ctx, es, store, catalog, *incremental)
+	case "import":
+		// Import mode: store and extract the pages of WARC files, then index them
+		if len(warcImports) == 0 {
+			log.Fatal("Import mode needs at least one -import file or directory")
+		}
+		imported, err := internal.ImportWARC(ctx, crawlCfg, warcImports)
+		if err != nil {
+			log.Fatalf("Import stopped after %d pages: %s", imported, err)
+		}
+		log.Printf("Imported %d pages", imported)
+		if !*noIndex && ctx.Err() == nil {
+			internal.StartIndexing(ctx, es, store, catalog, true)
+		}
+	case "dedup":
+		// Dedup mode: cluster the stored pages by their fingerprints and report the largest clusters
+		clusters, err := internal.ClusterDuplicates(ctx, store, catalog, *maxDistance)
+		if err != nil {
+			log.Fatalf("Could not cluster the stored pages: %s", err)
+		}
+		internal.WriteDuplicateReport(os.Stdout, clusters, *reportSize)
+	case "diff":
+		// Diff mode: show what changed between two snapshots of a page
+		if *diffURL == "" {
+			log.Fatal("Diff mode needs the -url of a crawled page")
+		}
+		list, err := internal.ListSnapshots(store, *diffURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, snapshot := range list {
+			fmt.Fprintf(os.Stderr, "snapshot %s  body %.12s\n", snapshot.ID, snapshot.BodyHash)
+		}
+		diff, err := internal.DiffSnapshots(store, snapshots, *diffURL, *diffOld, *diffNew)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Print(internal.FormatSnapshotDiff(diff))
+	case "lookup":
+		// Lookup mode: map a URL to its storage key or a storage key back to its URL
+		query := *diffURL
+		if query == "" {
+			query = *lookupKey
+		}
+		if query == "" || (*diffURL != "" && *lookupKey != "") {
+			log.Fatal("Lookup mode needs either -url or -key")
+		}
+		record, ok := catalog.Lookup(query)
+		if !ok {
+			log.Fatalf("%s is not in the crawl catalog", query)
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(record); err != nil {
+			log.Fatal(err)
+		}
+	case "migrate":
+		// Migrate mode: copy every page from the -from layout into the -store layout, or compact
+		// the store in place when both are the same. Either way, pages stored under the key of
+		// their raw URL, as before URLs were normalized, move to the key a crawl looks them up by.
+		if *migrateFrom == "" {
+			log.Fatal("Migrate mode needs -from with the layout to copy the pages from")
+		}
+		if *migrateFrom != *storeKind {
+			source, err := internal.OpenPageStore(*migrateFrom, "./site")
+			if err != nil {
+				log.Fatalf("Could not open the %s page store: %s", *migrateFrom, err)
+			}
+			defer source.Close()
+			copied, err := internal.CopyPages(store, source)
+			if err != nil {
+				log.Fatalf("Migration stopped after %d pages: %s", copied, err)
+			}
+			log.Printf("Copied %d pages from the %s to the %s store, the %s copy is left in place", copied, *migrateFrom, *storeKind, *migrateFrom)
+		}
+		moved, dropped, err := internal.RekeyPages(store, catalog)
+		if err != nil {
+			log.Fatalf("Could not move the pages stored under outdated keys: %s", err)
+		}
+		log.Printf("Moved %d pages stored under outdated keys, dropped %d outdated copies of pages stored under both", moved, dropped)
+		compactStore(store, "./site")
+		if *migrateFrom == *storeKind {
+			snapshots, err := internal.OpenPageStore(*storeKind, "./site/.snapshots")
+			if err != nil {
+				log.Fatalf("Could not open the snapshot store: %s", err)
+			}
+			defer snapshots.Close()
+			compactStore(snapshots, "./site/.snapshots")
+		}
 	case "server":
 		if *testIndex {
 			testQuerySearch(es, internal.PersianKeywordCorrection("گیتار"))
@@ -142,14 +407,68 @@ func main() {
 					internal.SearchIndexHandler(es, w, query, internal.PersianAutocompleteSuggest(query), page, size, true)
 				}
 			})
+			http.HandleFunc("/snapshots", func(w http.ResponseWriter, r *http.Request) {
+				internal.SnapshotListHandler(store, w, r.URL.Query().Get("url"))
+			})
+			http.HandleFunc("/lookup", func(w http.ResponseWriter, r *http.Request) {
+				internal.CatalogLookupHandler(catalog, w, r.URL.Query().Get("q"))
+			})
+			http.HandleFunc("/diff", func(w http.ResponseWriter, r *http.Request) {
+				params := r.URL.Query()
+				internal.SnapshotDiffHandler(store, snapshots, w, params.Get("url"), params.Get("from"), params.Get("to"))
+			})
 			log.Println("Webpage is accessible from http://localhost:8080/")
-			log.Fatal(http.ListenAndServe(":8080", nil))
+			server := &http.Server{Addr: ":8080"}
+			shutdownDone := make(chan struct{})
+			context.AfterFunc(ctx, func() {
+				// Let the requests in progress finish
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+				if err := server.Shutdown(shutdownCtx); err != nil {
+					log.Printf("Server shutdown: %s", err)
+				}
+				close(shutdownDone)
+			})
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+			<-shutdownDone
 		}
 	default:
-		fmt.Println("Invalid mode. Use 'crawl', 'fix', 'index', or 'server'.")
+		fmt.Println("Invalid mode. Use 'crawl', 'recrawl', 'log', 'fix', 'index', 'import', 'dedup', 'diff', 'lookup', 'migrate', or 'server'.")
 	}
 }
 
+// listFlag collects repeated and comma separated flag values into target
+func listFlag(target *[]string) func(string) error {
+	return func(value string) error {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*target = append(*target, item)
+			}
+		}
+		return nil
+	}
+}
+
+// compactStore reclaims the space of replaced and deleted parts in the page store in dir
+func compactStore(store internal.PageStore, dir string) {
+	reclaimed, ok, err := internal.CompactPages(store)
+	switch {
+	case err != nil:
+		log.Fatalf("Could not compact the page store in %s: %s", dir, err)
+	case !ok:
+		log.Printf("The page store in %s replaces pages in place, there is nothing to compact", dir)
+	default:
+		log.Printf("Compacted the page store in %s, reclaimed %d bytes", dir, reclaimed)
+	}
+}
+
+// readOnlyMode reports whether a mode only reads the page store, so it can run next to a crawl
+func readOnlyMode(mode string) bool {
+	return mode == "diff" || mode == "lookup" || mode == "server"
+}
+
 func testQuerySearch(es *elasticsearch.Client, query map[string]any) {
 	var buf bytes.Buffer
 	if err := json.NewEncoder(&buf).Encode(query); err != nil {
@@ -10,4 +10,14 @@ type Document struct {
 	H4    string `json:"h4"`
 	H5    string `json:"h5"`
 	H6    string `json:"h6"`
+	// Aliases are the URLs that redirect to URL
+	Aliases []string `json:"aliases,omitempty"`
+	// Charset is the encoding the page was served in, the text fields are always UTF-8
+	Charset string `json:"charset,omitempty"`
+	// Metadata holds format specific details, e.g. the author and page count of a PDF
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Mojibake flags text that still looks like wrongly decoded UTF-8, fix mode repairs it
+	Mojibake bool `json:"mojibake,omitempty"`
+	// ClusterID is shared by the near-duplicate copies of a page, empty if the page has none
+	ClusterID string `json:"cluster_id,omitempty"`
 }
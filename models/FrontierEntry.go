@@ -0,0 +1,14 @@
+package models
+
+// FrontierEntry is a URL waiting in the crawl queue together with what we know about it
+type FrontierEntry struct {
+	URL      string  `json:"url"`
+	LastMod  string  `json:"lastmod,omitempty"`
+	Priority float64 `json:"priority,omitempty"`
+	// Depth is the number of links followed from a seed, seeds have depth 0
+	Depth int `json:"depth"`
+	// Referrer is the page (or sitemap) the URL was found on, empty for seeds
+	Referrer string `json:"referrer,omitempty"`
+	// RobotsRetries counts how often the entry was put back because robots.txt could not be fetched
+	RobotsRetries int `json:"robots_retries,omitempty"`
+}
@@ -0,0 +1,59 @@
+package models
+
+import "time"
+
+// PageMeta holds the fetch state of a stored page, saved next to its HTML
+type PageMeta struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	FetchedAt    time.Time `json:"fetched_at"`
+	Status       int       `json:"status"`
+	ContentType  string    `json:"content_type,omitempty"`
+	// BodyHash is the sha256 of the stored body, Size its length in bytes
+	BodyHash string `json:"body_hash,omitempty"`
+	Size     int64  `json:"size"`
+	// Truncated is set when the body was cut off at the configured maximum size
+	Truncated bool `json:"truncated,omitempty"`
+	// NeedsReindex is set when the stored content changed since the last indexing run
+	NeedsReindex bool `json:"needs_reindex"`
+	// NoIndex and NoFollow come from the page's robots meta tags and X-Robots-Tag header
+	NoIndex  bool `json:"noindex,omitempty"`
+	NoFollow bool `json:"nofollow,omitempty"`
+	// Canonical is set when the page names another URL as its canonical version
+	Canonical string `json:"canonical,omitempty"`
+
+	// ContentHash is the hash of the main text, ads and navigation excluded
+	ContentHash string `json:"content_hash,omitempty"`
+	// ExactHash and SimHash fingerprint the normalized text for duplicate detection,
+	// SimHash is empty for pages too short to compare
+	ExactHash string `json:"exact_hash,omitempty"`
+	SimHash   string `json:"simhash,omitempty"`
+	// ClusterID mirrors the document's, DuplicateOf is the URL of the cluster's representative
+	// for every other page of the cluster. Duplicates stay out of the index.
+	ClusterID   string `json:"cluster_id,omitempty"`
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+	// History lists the most recent visits, oldest first
+	History []PageVisit `json:"history,omitempty"`
+	// ChangeRate is the estimated number of changes per day
+	ChangeRate float64   `json:"change_rate"`
+	NextVisit  time.Time `json:"next_visit,omitempty"`
+	// Snapshots lists the kept versions of the page, oldest first
+	Snapshots []PageSnapshot `json:"snapshots,omitempty"`
+}
+
+// PageVisit is one fetch of a page and whether its main text had changed
+type PageVisit struct {
+	At      time.Time `json:"at"`
+	Changed bool      `json:"changed"`
+}
+
+// PageSnapshot is a kept version of a page whose extracted text had changed since the previous one
+type PageSnapshot struct {
+	// ID is the UTC time of the fetch, e.g. 20240131T154500Z
+	ID       string    `json:"id"`
+	At       time.Time `json:"at"`
+	BodyHash string    `json:"body_hash"`
+	// TextHash covers the title, headings and body of the document
+	TextHash string `json:"text_hash"`
+}